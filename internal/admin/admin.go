@@ -0,0 +1,129 @@
+package admin
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"go-smtp-slacker/internal/config"
+	"go-smtp-slacker/internal/email"
+	"go-smtp-slacker/internal/logger"
+	"go-smtp-slacker/internal/metrics"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// maxRequestBytes caps the size of the request bodies
+const maxRequestBytes = 1024
+
+// logLevelRequest is the body of the requests changing the log level
+type logLevelRequest struct {
+	Level string `json:"level"`
+}
+
+// pauseRequest is the body of the requests pausing or resuming the SMTP server
+type pauseRequest struct {
+	Paused *bool `json:"paused"`
+}
+
+// NewServer creates the admin HTTP server, listening on the configured address, pausing
+// the SMTP server through pause. Without a token, its endpoints are unauthenticated,
+// which is warned about.
+func NewServer(cfg config.AdminConfig, pause *email.PauseSwitch) *http.Server {
+	if cfg.Token.GetValue() == "" {
+		logger.Warnf("Admin: No token is set, anyone reaching %s can change the log level and pause the SMTP server", cfg.ListenAddr)
+	}
+	return &http.Server{
+		Addr:              cfg.ListenAddr,
+		Handler:           NewHandler(cfg.Token.GetValue(), pause),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+}
+
+// NewHandler returns the handler of the admin endpoints, pausing the SMTP server through
+// pause. When token is set, the requests must carry it as a bearer token.
+func NewHandler(token string, pause *email.PauseSwitch) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/loglevel", handleLogLevel)
+	mux.HandleFunc("/metrics", handleMetrics)
+	mux.HandleFunc("/pause", handlePause(pause))
+
+	if token == "" {
+		return mux
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		provided, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(provided), []byte(token)) != 1 {
+			logger.Warnf("Admin: Unauthorized request to '%s' from %s", r.URL.Path, r.RemoteAddr)
+			writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "unauthorized"})
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// handleLogLevel changes the log level, e.g. POST /loglevel {"level":"debug"}
+func handleLogLevel(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+		return
+	}
+
+	var req logLevelRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRequestBytes)).Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid request body"})
+		return
+	}
+
+	level, ok := logger.LookupLogLevel(req.Level)
+	if !ok {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid log level '" + req.Level + "'"})
+		return
+	}
+
+	logger.Infof("Admin: Changing the log level from %s to %s", logger.GetLogLevel(), level)
+	logger.SetLogLevel(level)
+	writeJSON(w, http.StatusOK, map[string]string{"level": level.String()})
+}
+
+// handlePause returns the handler returning whether the SMTP server is paused, e.g.
+// GET /pause, or pausing or resuming it, e.g. POST /pause {"paused":true}
+func handlePause(pause *email.PauseSwitch) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPost:
+			var req pauseRequest
+			if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRequestBytes)).Decode(&req); err != nil || req.Paused == nil {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid request body"})
+				return
+			}
+			logger.Infof("Admin: Setting the SMTP server paused to %t", *req.Paused)
+			pause.SetPaused(*req.Paused)
+		default:
+			w.Header().Set("Allow", http.MethodGet+", "+http.MethodPost)
+			writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]bool{"paused": pause.IsPaused()})
+	}
+}
+
+// handleMetrics returns the current values of the metrics, e.g. GET /metrics
+func handleMetrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+		return
+	}
+	writeJSON(w, http.StatusOK, metrics.Snapshot())
+}
+
+// writeJSON writes a JSON response with the given status code.
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		logger.Errorf("Admin: Error writing the response: %v", err)
+	}
+}
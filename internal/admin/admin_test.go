@@ -0,0 +1,272 @@
+package admin
+
+import (
+	"encoding/json"
+	"go-smtp-slacker/internal/email"
+	"go-smtp-slacker/internal/logger"
+	"go-smtp-slacker/internal/metrics"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLogLevelEndpoint(t *testing.T) {
+	testCases := []struct {
+		name          string
+		token         string
+		method        string
+		authorization string
+		body          string
+		expectedCode  int
+		expectedBody  string
+		expectedLevel logger.LogLevel
+	}{
+		{
+			name:          "change level",
+			method:        http.MethodPost,
+			body:          `{"level":"debug"}`,
+			expectedCode:  http.StatusOK,
+			expectedBody:  `{"level":"DEBUG"}`,
+			expectedLevel: logger.LevelDebug,
+		},
+		{
+			name:          "invalid level",
+			method:        http.MethodPost,
+			body:          `{"level":"verbose"}`,
+			expectedCode:  http.StatusBadRequest,
+			expectedBody:  `{"error":"invalid log level 'verbose'"}`,
+			expectedLevel: logger.LevelError,
+		},
+		{
+			name:          "missing level",
+			method:        http.MethodPost,
+			body:          `{}`,
+			expectedCode:  http.StatusBadRequest,
+			expectedBody:  `{"error":"invalid log level ''"}`,
+			expectedLevel: logger.LevelError,
+		},
+		{
+			name:          "invalid body",
+			method:        http.MethodPost,
+			body:          `level=debug`,
+			expectedCode:  http.StatusBadRequest,
+			expectedBody:  `{"error":"invalid request body"}`,
+			expectedLevel: logger.LevelError,
+		},
+		{
+			name:          "wrong method",
+			method:        http.MethodGet,
+			expectedCode:  http.StatusMethodNotAllowed,
+			expectedBody:  `{"error":"method not allowed"}`,
+			expectedLevel: logger.LevelError,
+		},
+		{
+			name:          "valid token",
+			token:         "s3cret",
+			method:        http.MethodPost,
+			authorization: "Bearer s3cret",
+			body:          `{"level":"TRACE"}`,
+			expectedCode:  http.StatusOK,
+			expectedBody:  `{"level":"TRACE"}`,
+			expectedLevel: logger.LevelTrace,
+		},
+		{
+			name:          "missing token",
+			token:         "s3cret",
+			method:        http.MethodPost,
+			body:          `{"level":"debug"}`,
+			expectedCode:  http.StatusUnauthorized,
+			expectedBody:  `{"error":"unauthorized"}`,
+			expectedLevel: logger.LevelError,
+		},
+		{
+			name:          "wrong token",
+			token:         "s3cret",
+			method:        http.MethodPost,
+			authorization: "Bearer guess",
+			body:          `{"level":"debug"}`,
+			expectedCode:  http.StatusUnauthorized,
+			expectedBody:  `{"error":"unauthorized"}`,
+			expectedLevel: logger.LevelError,
+		},
+	}
+
+	originalLevel := logger.GetLogLevel()
+	t.Cleanup(func() { logger.SetLogLevel(originalLevel) })
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			logger.SetLogLevel(logger.LevelError)
+
+			req := httptest.NewRequest(tc.method, "/loglevel", strings.NewReader(tc.body))
+			if tc.authorization != "" {
+				req.Header.Set("Authorization", tc.authorization)
+			}
+			rec := httptest.NewRecorder()
+			NewHandler(tc.token, &email.PauseSwitch{}).ServeHTTP(rec, req)
+
+			assert.Equal(t, tc.expectedCode, rec.Code)
+			assert.JSONEq(t, tc.expectedBody, rec.Body.String())
+			assert.Equal(t, tc.expectedLevel, logger.GetLogLevel())
+		})
+	}
+}
+
+func TestLogLevelEndpointWhileLogging(t *testing.T) {
+	originalLevel := logger.GetLogLevel()
+	logger.SetOutput(io.Discard)
+	t.Cleanup(func() {
+		logger.SetOutput(os.Stdout)
+		logger.SetLogLevel(originalLevel)
+	})
+
+	// run with -race: the level is read by the logging goroutine while being changed, its
+	// messages being below the levels set, so they don't synchronize through the output
+	started := make(chan struct{})
+	done := make(chan struct{})
+	logged := make(chan struct{})
+	go func() {
+		defer close(logged)
+		logger.Tracef("Delivering email")
+		close(started)
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				// as when delivering an email, rendering its blocks only when they're logged
+				if logger.GetLogLevel() <= logger.LevelTrace {
+					logger.Tracef("Delivering email")
+				}
+			}
+		}
+	}()
+	<-started
+
+	handler := NewHandler("", &email.PauseSwitch{})
+	for _, level := range []string{"debug", "info", "warning", "error"} {
+		req := httptest.NewRequest(http.MethodPost, "/loglevel", strings.NewReader(`{"level":"`+level+`"}`))
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		assert.Equal(t, http.StatusOK, rec.Code)
+	}
+	close(done)
+	<-logged
+
+	assert.Equal(t, logger.LevelError, logger.GetLogLevel())
+}
+
+func TestMetricsEndpoint(t *testing.T) {
+	metrics.QueueDepth.Set(7)
+	metrics.QueueCapacity.Set(100)
+	t.Cleanup(func() {
+		metrics.QueueDepth.Set(0)
+		metrics.QueueCapacity.Set(0)
+	})
+
+	handler := NewHandler("secret", &email.PauseSwitch{})
+
+	req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	var body map[string]int64
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &body))
+	assert.Equal(t, int64(7), body["queue_depth"])
+	assert.Equal(t, int64(100), body["queue_capacity"])
+	assert.Contains(t, body, "delivered")
+	assert.Contains(t, body, "delivery_failed")
+
+	req = httptest.NewRequest(http.MethodPost, "/metrics", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusMethodNotAllowed, rec.Code)
+}
+
+func TestPauseEndpoint(t *testing.T) {
+	testCases := []struct {
+		name           string
+		method         string
+		body           string
+		paused         bool
+		expectedCode   int
+		expectedBody   string
+		expectedPaused bool
+	}{
+		{
+			name:         "get running",
+			method:       http.MethodGet,
+			expectedCode: http.StatusOK,
+			expectedBody: `{"paused":false}`,
+		},
+		{
+			name:           "get paused",
+			method:         http.MethodGet,
+			paused:         true,
+			expectedCode:   http.StatusOK,
+			expectedBody:   `{"paused":true}`,
+			expectedPaused: true,
+		},
+		{
+			name:           "pause",
+			method:         http.MethodPost,
+			body:           `{"paused":true}`,
+			expectedCode:   http.StatusOK,
+			expectedBody:   `{"paused":true}`,
+			expectedPaused: true,
+		},
+		{
+			name:         "resume",
+			method:       http.MethodPost,
+			body:         `{"paused":false}`,
+			paused:       true,
+			expectedCode: http.StatusOK,
+			expectedBody: `{"paused":false}`,
+		},
+		{
+			name:           "missing paused",
+			method:         http.MethodPost,
+			body:           `{}`,
+			paused:         true,
+			expectedCode:   http.StatusBadRequest,
+			expectedBody:   `{"error":"invalid request body"}`,
+			expectedPaused: true,
+		},
+		{
+			name:         "invalid body",
+			method:       http.MethodPost,
+			body:         `paused=true`,
+			expectedCode: http.StatusBadRequest,
+			expectedBody: `{"error":"invalid request body"}`,
+		},
+		{
+			name:         "wrong method",
+			method:       http.MethodDelete,
+			expectedCode: http.StatusMethodNotAllowed,
+			expectedBody: `{"error":"method not allowed"}`,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			pause := &email.PauseSwitch{}
+			pause.SetPaused(tc.paused)
+
+			req := httptest.NewRequest(tc.method, "/pause", strings.NewReader(tc.body))
+			rec := httptest.NewRecorder()
+			NewHandler("", pause).ServeHTTP(rec, req)
+
+			assert.Equal(t, tc.expectedCode, rec.Code)
+			assert.JSONEq(t, tc.expectedBody, rec.Body.String())
+			assert.Equal(t, tc.expectedPaused, pause.IsPaused())
+		})
+	}
+}
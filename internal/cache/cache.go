@@ -0,0 +1,144 @@
+package cache
+
+import (
+	"context"
+	"go-smtp-slacker/internal/logger"
+	"go-smtp-slacker/internal/metrics"
+	"sync"
+	"time"
+)
+
+// Cache holds values for a TTL, up to a maximum number of entries. When full, the entries
+// closest to expiring are evicted to make room for new ones. Its size is recorded in the
+// cache size gauge of its name. Safe for concurrent use.
+type Cache[V any] struct {
+	// Now is the clock of the expiries, time.Now by default
+	Now func() time.Time
+
+	name    string
+	ttl     time.Duration
+	maxSize int
+	size    *metrics.Gauge
+
+	mu      sync.Mutex
+	entries map[string]entry[V]
+}
+
+// entry is a value in the cache, along with its expiry.
+type entry[V any] struct {
+	value   V
+	expires time.Time
+}
+
+// New creates a cache named name (e.g. in the metrics), holding values for ttl, up to
+// maxSize entries, or without limit if 0.
+func New[V any](name string, ttl time.Duration, maxSize int) *Cache[V] {
+	c := &Cache[V]{
+		Now:     time.Now,
+		name:    name,
+		ttl:     ttl,
+		maxSize: maxSize,
+		size:    metrics.CacheSize(name),
+		entries: make(map[string]entry[V]),
+	}
+	c.size.Set(0)
+	return c
+}
+
+// Get returns the value of a key, if cached and not expired.
+func (c *Cache[V]) Get(key string) (V, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	cached, ok := c.entries[key]
+	if !ok {
+		var zero V
+		return zero, false
+	}
+	if !c.Now().Before(cached.expires) {
+		c.remove(key)
+		var zero V
+		return zero, false
+	}
+	return cached.value, true
+}
+
+// Put caches the value of a key until the TTL expires, evicting other entries if full.
+func (c *Cache[V]) Put(key string, value V) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := c.Now()
+	if _, ok := c.entries[key]; !ok && c.maxSize > 0 && len(c.entries) >= c.maxSize {
+		c.removeExpired(now)
+		for len(c.entries) >= c.maxSize {
+			c.evict()
+		}
+	}
+	c.entries[key] = entry[V]{value: value, expires: now.Add(c.ttl)}
+	c.size.Set(int64(len(c.entries)))
+}
+
+// Len returns the number of entries in the cache, expired ones included until cleaned up.
+func (c *Cache[V]) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return len(c.entries)
+}
+
+// Cleanup removes the expired entries, returning how many were removed.
+func (c *Cache[V]) Cleanup() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.removeExpired(c.Now())
+}
+
+// RunCleanup cleans up the expired entries every interval, until the context is done.
+func (c *Cache[V]) RunCleanup(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if removed := c.Cleanup(); removed > 0 {
+				logger.Debugf("Removed %d expired entries from cache '%s'", removed, c.name)
+			}
+		}
+	}
+}
+
+// remove deletes an entry, updating the size of the cache. The lock must be held.
+func (c *Cache[V]) remove(key string) {
+	delete(c.entries, key)
+	c.size.Set(int64(len(c.entries)))
+}
+
+// removeExpired deletes the expired entries, returning how many were. The lock must be held.
+func (c *Cache[V]) removeExpired(now time.Time) int {
+	removed := 0
+	for key, cached := range c.entries {
+		if !now.Before(cached.expires) {
+			delete(c.entries, key)
+			removed++
+		}
+	}
+	c.size.Set(int64(len(c.entries)))
+	return removed
+}
+
+// evict deletes the entry closest to expiring, cached the longest ago. The lock must be held.
+func (c *Cache[V]) evict() {
+	var oldest string
+	var oldestExpires time.Time
+	for key, cached := range c.entries {
+		if oldest == "" || cached.expires.Before(oldestExpires) {
+			oldest, oldestExpires = key, cached.expires
+		}
+	}
+	logger.Debugf("Cache '%s' is full (%d entries), evicting '%s'", c.name, c.maxSize, oldest)
+	c.remove(oldest)
+}
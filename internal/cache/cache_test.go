@@ -0,0 +1,108 @@
+package cache
+
+import (
+	"context"
+	"go-smtp-slacker/internal/metrics"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCache(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	c := New[string]("test", time.Minute, 0)
+	c.Now = func() time.Time { return now }
+
+	_, ok := c.Get("alice")
+	assert.False(t, ok)
+
+	c.Put("alice", "U123")
+	value, ok := c.Get("alice")
+	require.True(t, ok)
+	assert.Equal(t, "U123", value)
+
+	now = now.Add(time.Minute)
+	_, ok = c.Get("alice")
+	assert.False(t, ok, "after the TTL")
+	assert.Zero(t, c.Len(), "expired entries are removed when read")
+}
+
+func TestCacheEviction(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	c := New[int]("test_eviction", time.Hour, 3)
+	c.Now = func() time.Time { return now }
+
+	for i := range 3 {
+		c.Put(strconv.Itoa(i), i)
+		now = now.Add(time.Second)
+	}
+
+	t.Run("updating an entry of a full cache", func(t *testing.T) {
+		c.Put("1", 10)
+		assert.Equal(t, 3, c.Len())
+		for _, key := range []string{"0", "1", "2"} {
+			_, ok := c.Get(key)
+			assert.True(t, ok, key)
+		}
+	})
+
+	t.Run("the oldest entries are evicted", func(t *testing.T) {
+		c.Put("3", 3)
+		c.Put("4", 4)
+		assert.Equal(t, 3, c.Len())
+		assert.Equal(t, int64(3), metrics.CacheSize("test_eviction").Value())
+
+		// "1" was updated after "2", so it's the newest of the first entries
+		for key, expected := range map[string]bool{"0": false, "1": true, "2": false, "3": true, "4": true} {
+			_, ok := c.Get(key)
+			assert.Equal(t, expected, ok, key)
+		}
+	})
+
+	t.Run("expired entries are removed first", func(t *testing.T) {
+		c.Put("5", 5)
+		now = now.Add(time.Hour)
+		c.Put("6", 6)
+		assert.Equal(t, 1, c.Len())
+		_, ok := c.Get("6")
+		assert.True(t, ok)
+	})
+}
+
+func TestCacheCleanup(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	c := New[bool]("test_cleanup", time.Minute, 0)
+	c.Now = func() time.Time { return now }
+
+	c.Put("alice", true)
+	now = now.Add(30 * time.Second)
+	c.Put("bob", false)
+	assert.Zero(t, c.Cleanup())
+
+	now = now.Add(30 * time.Second)
+	assert.Equal(t, 1, c.Cleanup())
+	assert.Equal(t, 1, c.Len())
+	assert.Equal(t, int64(1), metrics.CacheSize("test_cleanup").Value())
+	assert.Equal(t, int64(1), metrics.Snapshot()["cache_size_test_cleanup"])
+}
+
+func TestCacheRunCleanup(t *testing.T) {
+	c := New[bool]("test_run_cleanup", time.Millisecond, 0)
+	c.Put("alice", true)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		c.RunCleanup(ctx, time.Millisecond)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+
+	assert.Eventually(t, func() bool { return c.Len() == 0 }, time.Second, time.Millisecond)
+}
@@ -1,12 +1,16 @@
 package config
 
 import (
+	"errors"
 	"fmt"
 	"go-smtp-slacker/internal/logger"
 	"go-smtp-slacker/internal/utils"
 	"go-smtp-slacker/internal/version"
+	"io/fs"
 	"os"
+	"regexp"
 	"strings"
+	"time"
 
 	"github.com/go-playground/validator/v10"
 	"github.com/spf13/pflag"
@@ -21,32 +25,237 @@ type SMTPConfig struct {
 		From Policy `mapstructure:"from" validate:"required"`
 		To   Policy `mapstructure:"to" validate:"required"`
 	} `mapstructure:"policies" validate:"required"`
-	PreferHTMLBody *bool `mapstructure:"prefer-html-body"`
+	PreferHTMLBody             *bool         `mapstructure:"prefer-html-body"`
+	MaxMessagesPerSession      int           `mapstructure:"max-messages-per-session" validate:"gte=0"`
+	MaxMessageBytes            int64         `mapstructure:"max-message-bytes" validate:"gte=0"`
+	NormalizeAddresses         bool          `mapstructure:"normalize-addresses"`
+	TrustedProxies             []string      `mapstructure:"trusted-proxies" validate:"dive,cidr|ip"`
+	ClientIPSource             string        `mapstructure:"client-ip-source" validate:"omitempty,oneof=header proxy-protocol"`
+	ClientIPHeader             string        `mapstructure:"client-ip-header"`
+	SynchronousDelivery        bool          `mapstructure:"synchronous-delivery"`
+	SynchronousDeliveryTimeout time.Duration `mapstructure:"synchronous-delivery-timeout"`
+	EnqueueTimeout             time.Duration `mapstructure:"enqueue-timeout"`
+	TrustAllowedSenders        bool          `mapstructure:"trust-allowed-senders"`
+	BindRetries                int           `mapstructure:"bind-retries" validate:"gte=0"`
+	BindRetryDelay             time.Duration `mapstructure:"bind-retry-delay"`
+	ServerLogLevel             string        `mapstructure:"server-log-level" validate:"omitempty,loglevel"`
+	BccOnly                    string        `mapstructure:"bcc-only" validate:"omitempty,oneof=skip deliver"`
+	InvalidRecipients          string        `mapstructure:"invalid-recipients" validate:"omitempty,oneof=skip reject"`
+	UndecodableBody            string        `mapstructure:"undecodable-body" validate:"omitempty,oneof=raw reject"`
+	StartPaused                bool          `mapstructure:"start-paused"`
+	LogRawEmails               bool          `mapstructure:"log-raw-emails"`
+	RawEmailLogMaxBytes        int           `mapstructure:"raw-email-log-max-bytes" validate:"gte=0"`
+	ShutdownGrace              time.Duration `mapstructure:"shutdown-grace" validate:"gte=0"`
+	TLS                        TLSConfig     `mapstructure:"tls"`
+	DNSBL                      DNSBLConfig   `mapstructure:"dnsbl"`
+	VerifyRecipients           VerifyConfig  `mapstructure:"verify-recipients"`
+}
+
+// VerifyConfig holds the settings for verifying the recipients at RCPT.
+type VerifyConfig struct {
+	Enabled      bool          `mapstructure:"enabled"`
+	CacheTTL     time.Duration `mapstructure:"cache-ttl" validate:"gte=0"`
+	CacheMaxSize int           `mapstructure:"cache-max-size" validate:"gte=0"`
+}
+
+// DNSBLConfig holds the DNS-based blocklists the client IPs are looked up in.
+type DNSBLConfig struct {
+	Zones        []string      `mapstructure:"zones" validate:"dive,fqdn"`
+	Timeout      time.Duration `mapstructure:"timeout" validate:"gte=0"`
+	CacheTTL     time.Duration `mapstructure:"cache-ttl" validate:"gte=0"`
+	CacheMaxSize int           `mapstructure:"cache-max-size" validate:"gte=0"`
+}
+
+// TLSConfig holds the settings for serving SMTP over TLS, enabled when a certificate is set.
+type TLSConfig struct {
+	Mode     string `mapstructure:"mode" validate:"omitempty,oneof=starttls implicit"`
+	CertFile string `mapstructure:"cert-file" validate:"required_with=KeyFile,required_if=Mode implicit"`
+	KeyFile  string `mapstructure:"key-file" validate:"required_with=CertFile"`
 }
 
 // PoliciesConfig holds the policy settings.
 type Policy struct {
-	Allow         []string `mapstructure:"allow"`
-	Deny          []string `mapstructure:"deny"`
-	DefaultAction string   `mapstructure:"default-action" validate:"oneof=allow deny"`
+	Allow              []string `mapstructure:"allow"`
+	Deny               []string `mapstructure:"deny"`
+	DefaultAction      string   `mapstructure:"default-action" validate:"oneof=allow deny"`
+	RejectCode         int      `mapstructure:"reject-code" validate:"omitempty,gte=500,lte=599"`
+	RejectEnhancedCode string   `mapstructure:"reject-enhanced-code" validate:"omitempty,enhancedcode"`
+	RejectMessage      string   `mapstructure:"reject-message"`
+	RejectTemporary    bool     `mapstructure:"reject-temporary"`
 }
 
 // AuthConfig holds the authentication settings.
 type AuthConfig struct {
-	UserDatabase string `mapstructure:"user-database" validate:"required_if=Enabled true"`
-	Enabled      *bool  `mapstructure:"enabled" validate:"required"`
+	UserDatabase         string        `mapstructure:"user-database" validate:"required_if=Enabled true"`
+	Enabled              *bool         `mapstructure:"enabled" validate:"required"`
+	UserDatabaseMaxSize  int64         `mapstructure:"user-database-max-size" validate:"gte=0"`
+	UserDatabaseMaxUsers int           `mapstructure:"user-database-max-users" validate:"gte=0"`
+	IPAuthorizationTTL   time.Duration `mapstructure:"ip-authorization-ttl"`
+}
+
+// RouteConfig holds the settings for recipients matching a route.
+type RouteConfig struct {
+	Match        string   `mapstructure:"match" validate:"required"`
+	Channel      string   `mapstructure:"channel"`
+	AlsoChannels []string `mapstructure:"also-channels"`
+	Template     string   `mapstructure:"template"`
+}
+
+// DomainRouteConfig holds the default destination of the recipients of a domain.
+type DomainRouteConfig struct {
+	Domain  string `mapstructure:"domain" validate:"required"`
+	Channel string `mapstructure:"channel" validate:"required_without=User,excluded_with=User"`
+	User    string `mapstructure:"user" validate:"omitempty,email"`
+}
+
+// SenderNameConfig holds the name shown in the message header in place of matching senders.
+type SenderNameConfig struct {
+	Match string `mapstructure:"match" validate:"required"`
+	Name  string `mapstructure:"name" validate:"required"`
+}
+
+// SenderTemplateConfig holds the header template of the messages from matching senders.
+type SenderTemplateConfig struct {
+	Match    string `mapstructure:"match" validate:"required"`
+	Template string `mapstructure:"template" validate:"required"`
+}
+
+// OversizedConfig holds the handling of the emails too large to be shown in Slack.
+type OversizedConfig struct {
+	Threshold int  `mapstructure:"threshold" validate:"gte=0"`
+	UploadRaw bool `mapstructure:"upload-raw"`
+}
+
+// RetryConfig holds the settings for retrying failed Slack API calls.
+type RetryConfig struct {
+	MaxAttempts int           `mapstructure:"max-attempts" validate:"gte=0"`
+	Backoff     time.Duration `mapstructure:"backoff"`
+	MaxBackoff  time.Duration `mapstructure:"max-backoff"`
+	Jitter      float64       `mapstructure:"jitter" validate:"gte=0,lte=1"`
+}
+
+// DailyThreadConfig holds the threading of the messages under a root message posted
+// each day in their channel.
+type DailyThreadConfig struct {
+	Enabled  bool   `mapstructure:"enabled"`
+	Text     string `mapstructure:"text"`
+	Timezone string `mapstructure:"timezone"`
+}
+
+// ScheduleConfig holds the settings for scheduling the messages instead of posting them right away.
+type ScheduleConfig struct {
+	Delay         time.Duration `mapstructure:"delay" validate:"gte=0"`
+	BusinessHours string        `mapstructure:"business-hours" validate:"excluded_with=Delay"`
+	BusinessDays  []string      `mapstructure:"business-days"`
+	Timezone      string        `mapstructure:"timezone"`
 }
 
 // SlackConfig holds the Slack settings.
 type SlackConfig struct {
-	Token utils.Secret `mapstructure:"token" validate:"required"`
+	Token                 utils.Secret           `mapstructure:"token" validate:"required_unless=DryRun true"`
+	DryRun                bool                   `mapstructure:"dry-run"`
+	Username              string                 `mapstructure:"username"`
+	IconEmoji             string                 `mapstructure:"icon-emoji" validate:"excluded_with=IconURL"`
+	IconURL               string                 `mapstructure:"icon-url" validate:"omitempty,url"`
+	Dividers              string                 `mapstructure:"dividers" validate:"omitempty,oneof=none both top bottom"`
+	Compact               bool                   `mapstructure:"compact"`
+	MaxSubjectChars       int                    `mapstructure:"max-subject-chars" validate:"gte=0"`
+	Templates             map[string]string      `mapstructure:"templates"`
+	Routes                []RouteConfig          `mapstructure:"routes" validate:"dive"`
+	DomainRoutes          []DomainRouteConfig    `mapstructure:"domain-routes" validate:"dive"`
+	SenderNames           []SenderNameConfig     `mapstructure:"sender-names" validate:"dive"`
+	SenderTemplates       []SenderTemplateConfig `mapstructure:"sender-templates" validate:"dive"`
+	Retry                 RetryConfig            `mapstructure:"retry"`
+	Oversized             OversizedConfig        `mapstructure:"oversized"`
+	AllowEmptyBody        bool                   `mapstructure:"allow-empty-body"`
+	APIURL                string                 `mapstructure:"api-url" validate:"omitempty,url"`
+	ProxyURL              string                 `mapstructure:"proxy-url" validate:"omitempty,url"`
+	NoProxy               string                 `mapstructure:"no-proxy"`
+	MinTLS                string                 `mapstructure:"min-tls" validate:"omitempty,oneof=1.2 1.3"`
+	UserNotFound          string                 `mapstructure:"user-not-found" validate:"omitempty,oneof=reject drop fallback"`
+	FallbackChannel       string                 `mapstructure:"fallback-channel" validate:"required_if=UserNotFound fallback,required_if=DMUnavailable fallback"`
+	DMUnavailable         string                 `mapstructure:"dm-unavailable" validate:"omitempty,oneof=reject fallback"`
+	ChannelNotFound       string                 `mapstructure:"channel-not-found" validate:"omitempty,oneof=reject dm"`
+	AuthRevoked           string                 `mapstructure:"auth-revoked" validate:"omitempty,oneof=stop pause"`
+	AuthCheckInterval     time.Duration          `mapstructure:"auth-check-interval" validate:"gte=0,required_if=AuthRevoked pause"`
+	BridgeReplies         bool                   `mapstructure:"bridge-replies" validate:"excluded_if=DailyThread.Enabled true"`
+	AppToken              utils.Secret           `mapstructure:"app-token" validate:"required_if=BridgeReplies true"`
+	UploadAttachments     bool                   `mapstructure:"upload-attachments" validate:"excluded_if=DailyThread.Enabled true"`
+	AttachmentMessages    bool                   `mapstructure:"attachment-messages"`
+	MaxAttachments        int                    `mapstructure:"max-attachments" validate:"gte=0"`
+	ShowAttachmentCount   bool                   `mapstructure:"show-attachment-count"`
+	InlineImageTypes      []string               `mapstructure:"inline-image-types"`
+	EscapeMentions        bool                   `mapstructure:"escape-mentions"`
+	QuoteBody             bool                   `mapstructure:"quote-body"`
+	HeadingStyle          string                 `mapstructure:"heading-style" validate:"omitempty,oneof=header bold"`
+	HeadingPrefixes       map[string]string      `mapstructure:"heading-prefixes" validate:"dive,keys,oneof=h1 h2 h3 h4 h5 h6,endkeys"`
+	MarkdownEscape        string                 `mapstructure:"markdown-escape" validate:"omitempty,oneof=smart disabled"`
+	NormalizeLineEndings  bool                   `mapstructure:"normalize-line-endings"`
+	StripNonContentHTML   bool                   `mapstructure:"strip-non-content-html"`
+	DefaultSubject        string                 `mapstructure:"default-subject"`
+	OpsAlertChannel       string                 `mapstructure:"ops-alert-channel"`
+	OpsAlertInterval      time.Duration          `mapstructure:"ops-alert-interval"`
+	PerRecipientTimeout   time.Duration          `mapstructure:"per-recipient-timeout"`
+	PerUserCooldown       time.Duration          `mapstructure:"per-user-cooldown"`
+	PreviewLines          int                    `mapstructure:"preview-lines" validate:"gte=0,excluded_if=DailyThread.Enabled true"`
+	SeverityEmojis        map[string]string      `mapstructure:"severity-emojis"`
+	MaxConcurrentUploads  int                    `mapstructure:"max-concurrent-uploads" validate:"gte=0"`
+	IncludeHeaders        []string               `mapstructure:"include-headers"`
+	ShowListID            bool                   `mapstructure:"show-list-id"`
+	ShowSenderAvatar      bool                   `mapstructure:"show-sender-avatar"`
+	SameDestination       string                 `mapstructure:"same-destination" validate:"omitempty,oneof=per-recipient combined"`
+	HighlightHighPriority bool                   `mapstructure:"highlight-high-priority"`
+	TrimSignatures        bool                   `mapstructure:"trim-signatures"`
+	SignatureMarkers      []string               `mapstructure:"signature-markers"`
+	SummaryChannel        string                 `mapstructure:"summary-channel"`
+	SummaryInterval       time.Duration          `mapstructure:"summary-interval" validate:"required_with=SummaryChannel"`
+	LinkHeader            string                 `mapstructure:"link-header"`
+	LinkText              string                 `mapstructure:"link-text" validate:"max=75"`
+	Schedule              ScheduleConfig         `mapstructure:"schedule"`
+	DailyThread           DailyThreadConfig      `mapstructure:"daily-thread"`
+	Groups                string                 `mapstructure:"groups"`
+	OptOutFile            string                 `mapstructure:"optout-file"`
+	EphemeralInChannel    bool                   `mapstructure:"ephemeral-in-channel"`
+	PostReaction          string                 `mapstructure:"post-reaction"`
+	UserCacheTTL          time.Duration          `mapstructure:"user-cache-ttl" validate:"gte=0,required_if=PrewarmCache true"`
+	UserCacheMaxSize      int                    `mapstructure:"user-cache-max-size" validate:"gte=0"`
+	PrewarmCache          bool                   `mapstructure:"prewarm-cache"`
+}
+
+// AdminConfig holds the settings of the admin HTTP endpoints.
+type AdminConfig struct {
+	ListenAddr string       `mapstructure:"listen-addr"`
+	Token      utils.Secret `mapstructure:"token"`
 }
 
 // Config holds the application's settings.
 type Config struct {
-	LogLevel string       `mapstructure:"log-level"`
-	Slack    *SlackConfig `mapstructure:"slack" validate:"required"`
-	SMTP     *SMTPConfig  `mapstructure:"smtp" validate:"required"`
+	LogLevel           string       `mapstructure:"log-level" validate:"loglevel"`
+	LogTimestampFormat string       `mapstructure:"log-timestamp-format"`
+	LogUTC             bool         `mapstructure:"log-utc"`
+	LogRedactContent   string       `mapstructure:"log-redact-content" validate:"omitempty,oneof=none redact hash"`
+	Slack              *SlackConfig `mapstructure:"slack" validate:"required"`
+	SMTP               *SMTPConfig  `mapstructure:"smtp" validate:"required"`
+	Admin              AdminConfig  `mapstructure:"admin"`
+}
+
+// policyListEnvs maps the policy lists to the env vars providing them
+var policyListEnvs = map[string]string{
+	"smtp.policies.from.allow": "SMTP_POLICIES_FROM_ALLOW",
+	"smtp.policies.from.deny":  "SMTP_POLICIES_FROM_DENY",
+	"smtp.policies.to.allow":   "SMTP_POLICIES_TO_ALLOW",
+	"smtp.policies.to.deny":    "SMTP_POLICIES_TO_DENY",
+}
+
+// Helper to split a comma separated list, ignoring the blank items
+func splitList(value string) []string {
+	items := []string{}
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
 }
 
 // Helper to read a string flag from the console
@@ -63,9 +272,29 @@ func regFlagBoolP(flag, shorthand string, value bool, usage string) {
 	}
 }
 
+// Helper to validate a log level name, e.g. "info"
+func validateLogLevel(fl validator.FieldLevel) bool {
+	_, ok := logger.LookupLogLevel(fl.Field().String())
+	return ok
+}
+
+// enhancedCodeRegexp matches the enhanced status codes of permanent failures, e.g. 5.7.1
+var enhancedCodeRegexp = regexp.MustCompile(`^5\.\d{1,3}\.\d{1,3}$`)
+
+// Helper to validate an enhanced status code of a permanent failure, e.g. "5.7.1"
+func validateEnhancedCode(fl validator.FieldLevel) bool {
+	return enhancedCodeRegexp.MatchString(fl.Field().String())
+}
+
 // Function to validate the config
 func validateConfig(cfg interface{}) error {
 	validate := validator.New()
+	if err := validate.RegisterValidation("loglevel", validateLogLevel); err != nil {
+		return err
+	}
+	if err := validate.RegisterValidation("enhancedcode", validateEnhancedCode); err != nil {
+		return err
+	}
 	return validate.Struct(cfg)
 }
 
@@ -77,6 +306,55 @@ func LoadConfig() (*Config, error) {
 	viper.SetDefault("log-level", "INFO")
 	viper.SetDefault("smtp.listen-addr", "localhost:25")
 	viper.SetDefault("smtp.prefer-html-body", true)
+	viper.SetDefault("smtp.normalize-addresses", true)
+	viper.SetDefault("smtp.client-ip-source", "header")
+	viper.SetDefault("smtp.client-ip-header", "X-Forwarded-For")
+	viper.SetDefault("smtp.synchronous-delivery-timeout", "30s")
+	viper.SetDefault("smtp.enqueue-timeout", "10s")
+	viper.SetDefault("smtp.bind-retry-delay", "1s")
+	viper.SetDefault("smtp.server-log-level", "ERROR")
+	viper.SetDefault("smtp.bcc-only", "skip")
+	viper.SetDefault("smtp.invalid-recipients", "skip")
+	viper.SetDefault("smtp.undecodable-body", "raw")
+	viper.SetDefault("smtp.log-raw-emails", true)
+	viper.SetDefault("smtp.shutdown-grace", "10s")
+	viper.SetDefault("smtp.tls.mode", "starttls")
+	viper.SetDefault("smtp.dnsbl.timeout", "2s")
+	viper.SetDefault("smtp.dnsbl.cache-ttl", "10m")
+	viper.SetDefault("smtp.dnsbl.cache-max-size", 10000)
+	viper.SetDefault("smtp.verify-recipients.cache-ttl", "10m")
+	viper.SetDefault("smtp.max-message-bytes", 1024*1024)
+	viper.SetDefault("smtp.verify-recipients.cache-max-size", 10000)
+	viper.SetDefault("smtp.auth.user-database-max-size", 1024*1024) // 1 MB
+	viper.SetDefault("smtp.auth.user-database-max-users", 10000)
+	viper.SetDefault("slack.user-cache-max-size", 10000)
+	viper.SetDefault("slack.dividers", "both")
+	viper.SetDefault("slack.user-not-found", "reject")
+	viper.SetDefault("slack.dm-unavailable", "reject")
+	viper.SetDefault("slack.channel-not-found", "reject")
+	viper.SetDefault("slack.auth-revoked", "stop")
+	viper.SetDefault("slack.auth-check-interval", "1m")
+	viper.SetDefault("slack.same-destination", "per-recipient")
+	viper.SetDefault("slack.max-attachments", 10)
+	viper.SetDefault("slack.inline-image-types", []string{"image/png", "image/jpeg", "image/gif", "image/webp"})
+	viper.SetDefault("slack.max-concurrent-uploads", 4)
+	viper.SetDefault("slack.escape-mentions", true)
+	viper.SetDefault("slack.heading-style", "header")
+	viper.SetDefault("slack.markdown-escape", "smart")
+	viper.SetDefault("slack.normalize-line-endings", true)
+	viper.SetDefault("slack.strip-non-content-html", true)
+	viper.SetDefault("slack.default-subject", "(no subject)")
+	viper.SetDefault("slack.ops-alert-interval", "15m")
+	viper.SetDefault("slack.summary-interval", "24h")
+	viper.SetDefault("slack.severity-emojis", map[string]string{
+		"critical": ":red_circle:",
+		"warning":  ":large_yellow_circle:",
+		"info":     ":large_blue_circle:",
+	})
+	viper.SetDefault("slack.retry.max-attempts", 3)
+	viper.SetDefault("slack.retry.backoff", "1s")
+	viper.SetDefault("slack.retry.max-backoff", "30s")
+	viper.SetDefault("slack.retry.jitter", 0.2)
 
 	// Register command flags
 	regFlagString("config-file", viper.GetString("config-file"), "The path to the configuration file (YAML)")
@@ -112,6 +390,17 @@ func LoadConfig() (*Config, error) {
 	// Bind env vars to config directives
 	viper.BindEnv("log-level", "LOG_LEVEL")
 	viper.BindEnv("slack.token", "SLACK_TOKEN")
+	viper.BindEnv("slack.app-token", "SLACK_APP_TOKEN")
+	viper.BindEnv("admin.token", "ADMIN_TOKEN")
+	viper.BindEnv("smtp.policies.from.default-action", "SMTP_POLICIES_FROM_DEFAULT_ACTION")
+	viper.BindEnv("smtp.policies.to.default-action", "SMTP_POLICIES_TO_DEFAULT_ACTION")
+
+	// Policy lists are provided as comma separated env vars
+	for key, env := range policyListEnvs {
+		if value, ok := os.LookupEnv(env); ok {
+			viper.Set(key, splitList(value))
+		}
+	}
 
 	// Load the config from file if it exists.
 	viper.SetConfigFile(viper.GetString("config-file"))
@@ -119,9 +408,12 @@ func LoadConfig() (*Config, error) {
 	logger.Infof("Attempting to load config from '%s'", viper.GetString("config-file"))
 
 	if err := viper.ReadInConfig(); err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, &ErrConfigNotFound{Path: viper.GetString("config-file"), Err: err}
+		}
 		if _, ok := err.(viper.ConfigFileNotFoundError); !ok {
 			// Config file was found but another error was produced
-			return nil, fmt.Errorf("failed to read config file: %w", err)
+			return nil, &ErrConfigRead{Path: viper.GetString("config-file"), Err: err}
 		}
 		logger.Warnf("Config file not found at '%s', using defaults.", viper.GetString("config-file"))
 	}
@@ -133,7 +425,7 @@ func LoadConfig() (*Config, error) {
 		// Read the entire content of the file
 		contentBytes, err := os.ReadFile(pathToSlackTokenFile)
 		if err != nil {
-			return nil, fmt.Errorf("failed to read file '%s': %w", pathToSlackTokenFile, err)
+			return nil, &ErrConfigRead{Path: pathToSlackTokenFile, Err: err}
 		}
 		// Convert byte slice to string
 		contentString := string(contentBytes)
@@ -142,18 +434,23 @@ func LoadConfig() (*Config, error) {
 		viper.Set("slack.token", strings.TrimSpace(contentString))
 	}
 
+	// slack.http-proxy is an alias of slack.proxy-url, which prevails if both are set
+	if viper.IsSet("slack.http-proxy") && !viper.IsSet("slack.proxy-url") {
+		viper.Set("slack.proxy-url", viper.GetString("slack.http-proxy"))
+	}
+
 	cfg := &Config{}
 
 	// Unmarshal the config
 	if err := viper.Unmarshal(&cfg); err != nil {
-		return cfg, fmt.Errorf("failed to unmarshal config: %w", err)
+		return cfg, &ErrConfigUnmarshal{Err: err}
 	}
 
 	logger.Infof("Loaded config: %#v", cfg)
 
 	// Validate the config
 	if err := validateConfig(cfg); err != nil {
-		return nil, fmt.Errorf("config validation error: %w", err)
+		return nil, &ErrConfigValidation{Err: err}
 	}
 
 	return cfg, nil
@@ -0,0 +1,50 @@
+package config
+
+import "fmt"
+
+// ErrConfigNotFound is returned when the configuration file does not exist.
+type ErrConfigNotFound struct {
+	Path string
+	Err  error
+}
+
+func (e *ErrConfigNotFound) Error() string {
+	return fmt.Sprintf("failed to read config file '%s': file not found", e.Path)
+}
+
+func (e *ErrConfigNotFound) Unwrap() error { return e.Err }
+
+// ErrConfigRead is returned when the configuration file (or a file it
+// references, such as the Slack token file) can't be read or parsed.
+type ErrConfigRead struct {
+	Path string
+	Err  error
+}
+
+func (e *ErrConfigRead) Error() string {
+	return fmt.Sprintf("failed to read config file '%s': %v", e.Path, e.Err)
+}
+
+func (e *ErrConfigRead) Unwrap() error { return e.Err }
+
+// ErrConfigUnmarshal is returned when the configuration can't be decoded into the Config struct.
+type ErrConfigUnmarshal struct {
+	Err error
+}
+
+func (e *ErrConfigUnmarshal) Error() string {
+	return fmt.Sprintf("failed to unmarshal config: %v", e.Err)
+}
+
+func (e *ErrConfigUnmarshal) Unwrap() error { return e.Err }
+
+// ErrConfigValidation is returned when the configuration is invalid.
+type ErrConfigValidation struct {
+	Err error
+}
+
+func (e *ErrConfigValidation) Error() string {
+	return fmt.Sprintf("config validation error: %v", e.Err)
+}
+
+func (e *ErrConfigValidation) Unwrap() error { return e.Err }
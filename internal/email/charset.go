@@ -0,0 +1,67 @@
+package email
+
+import (
+	"bytes"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"strings"
+
+	"golang.org/x/text/encoding/htmlindex"
+)
+
+// bodyCharsets returns the charsets declared for the plain text and HTML
+// bodies of a raw email, walking nested multipart parts if needed.
+func bodyCharsets(raw []byte) (textCharset, htmlCharset string) {
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		return "", ""
+	}
+
+	var walk func(contentType string, body io.Reader)
+	walk = func(contentType string, body io.Reader) {
+		mediaType, params, err := mime.ParseMediaType(contentType)
+		if err != nil {
+			return
+		}
+
+		switch {
+		case mediaType == "text/plain" && textCharset == "":
+			textCharset = strings.ToLower(params["charset"])
+		case mediaType == "text/html" && htmlCharset == "":
+			htmlCharset = strings.ToLower(params["charset"])
+		case strings.HasPrefix(mediaType, "multipart/"):
+			reader := multipart.NewReader(body, params["boundary"])
+			for {
+				part, err := reader.NextPart()
+				if err != nil {
+					return
+				}
+				walk(part.Header.Get("Content-Type"), part)
+			}
+		}
+	}
+
+	contentType := msg.Header.Get("Content-Type")
+	if contentType == "" {
+		contentType = "text/plain"
+	}
+	walk(contentType, msg.Body)
+
+	return textCharset, htmlCharset
+}
+
+// decodeCharset converts a body in the given charset to UTF-8.
+func decodeCharset(body, charset string) (string, error) {
+	switch charset {
+	case "", "utf-8", "utf8", "us-ascii", "ascii":
+		return body, nil
+	}
+
+	enc, err := htmlindex.Get(charset)
+	if err != nil {
+		return body, err
+	}
+	return enc.NewDecoder().String(body)
+}
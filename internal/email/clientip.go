@@ -0,0 +1,174 @@
+package email
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"go-smtp-slacker/internal/logger"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Client IP sources: the header of each message, only used for logging it, or the
+// PROXY protocol header of the connection, used for everything (policies, DNSBL,
+// IP authorization and logging).
+const (
+	ClientIPSourceHeader        = "header"
+	ClientIPSourceProxyProtocol = "proxy-protocol"
+)
+
+// maxProxyHeaderLength is the longest PROXY protocol (v1) header, CRLF included.
+const maxProxyHeaderLength = 107
+
+// parseTrustedProxies parses a list of CIDRs (or single IPs) of trusted proxies.
+func parseTrustedProxies(cidrs []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, cidr := range cidrs {
+		if ip := net.ParseIP(cidr); ip != nil {
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy '%s': not an IP or a CIDR", cidr)
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+// isTrustedProxy reports whether the IP belongs to one of the trusted proxy networks.
+func isTrustedProxy(ip net.IP, trustedProxies []*net.IPNet) bool {
+	for _, ipNet := range trustedProxies {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// resolveClientIP returns the IP of the real client. If the connection comes from a
+// trusted proxy, the forwarded-for value (a comma separated list of IPs, as in
+// X-Forwarded-For) is walked from right to left, returning the first IP that
+// is not a trusted proxy. Otherwise, the IP of the connection is returned.
+func resolveClientIP(remoteAddr, forwardedFor string, trustedProxies []*net.IPNet) string {
+	host := hostFromAddr(remoteAddr)
+
+	ip := net.ParseIP(host)
+	if ip == nil || !isTrustedProxy(ip, trustedProxies) || forwardedFor == "" {
+		return host
+	}
+
+	hops := strings.Split(forwardedFor, ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := net.ParseIP(strings.TrimSpace(hops[i]))
+		if hop == nil {
+			// stop at the first invalid entry, it can't be trusted
+			break
+		}
+		host = hop.String()
+		if !isTrustedProxy(hop, trustedProxies) {
+			break
+		}
+	}
+	return host
+}
+
+// proxyListener expects the connections of the trusted proxies to start with a PROXY
+// protocol (v1) header, the address of the client it carries becoming the remote
+// address of the connection. Other connections are served as they are.
+type proxyListener struct {
+	net.Listener
+	proxies []*net.IPNet
+}
+
+func (l *proxyListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if addr, ok := conn.RemoteAddr().(*net.TCPAddr); !ok || !isTrustedProxy(addr.IP, l.proxies) {
+		return conn, nil
+	}
+	// the header is read by the connection itself, not to hold the other ones back
+	return &proxyConn{Conn: conn, reader: bufio.NewReader(conn)}, nil
+}
+
+// proxyConn is a connection of a trusted proxy, reading its PROXY protocol header
+// before anything else.
+type proxyConn struct {
+	net.Conn
+	reader     *bufio.Reader
+	once       sync.Once
+	remoteAddr net.Addr
+	err        error
+}
+
+// readHeader reads the PROXY protocol header once, the connection failing if invalid.
+func (c *proxyConn) readHeader() {
+	c.once.Do(func() {
+		c.remoteAddr, c.err = readProxyHeader(c.reader, c.Conn.RemoteAddr())
+		if c.err != nil {
+			logger.Warnf("Invalid PROXY protocol header from trusted proxy %s: %v", c.Conn.RemoteAddr(), c.err)
+			c.remoteAddr = c.Conn.RemoteAddr()
+		}
+	})
+}
+
+func (c *proxyConn) Read(b []byte) (int, error) {
+	c.readHeader()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.reader.Read(b)
+}
+
+// RemoteAddr returns the address of the client relayed by the proxy.
+func (c *proxyConn) RemoteAddr() net.Addr {
+	c.readHeader()
+	return c.remoteAddr
+}
+
+// readProxyHeader reads a PROXY protocol (v1) header, as in
+// "PROXY TCP4 198.51.100.7 10.0.0.1 52000 25\r\n", returning the address of the
+// client. With the UNKNOWN protocol, the address of the proxy is returned.
+func readProxyHeader(r *bufio.Reader, proxyAddr net.Addr) (net.Addr, error) {
+	var line []byte
+	for !strings.HasSuffix(string(line), "\r\n") {
+		if len(line) >= maxProxyHeaderLength {
+			return nil, errors.New("header too long")
+		}
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+	}
+
+	fields := strings.Split(strings.TrimSuffix(string(line), "\r\n"), " ")
+	if fields[0] != "PROXY" || len(fields) < 2 {
+		return nil, fmt.Errorf("not a PROXY header: %q", line)
+	}
+	if fields[1] == "UNKNOWN" {
+		return proxyAddr, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("malformed PROXY header: %q", line)
+	}
+
+	ip := net.ParseIP(fields[2])
+	if ip == nil || (ip.To4() != nil) != (fields[1] == "TCP4") {
+		return nil, fmt.Errorf("invalid %s source address '%s'", fields[1], fields[2])
+	}
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid source port '%s'", fields[4])
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
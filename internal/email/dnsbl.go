@@ -0,0 +1,127 @@
+package email
+
+import (
+	"context"
+	"errors"
+	"go-smtp-slacker/internal/cache"
+	"go-smtp-slacker/internal/logger"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// resolver looks up the addresses of a host, satisfied by *net.Resolver.
+type resolver interface {
+	LookupHost(ctx context.Context, host string) ([]string, error)
+}
+
+// dnsblChecker looks up client IPs in DNS-based blocklists (e.g. zen.spamhaus.org),
+// caching the results so the same clients aren't looked up for every email.
+type dnsblChecker struct {
+	zones    []string
+	timeout  time.Duration
+	resolver resolver
+	// results holds whether the IPs are listed in each zone, nil if not cached
+	results *cache.Cache[bool]
+}
+
+// newDNSBLChecker creates a checker looking up IPs in the given zones, giving up on the
+// lookups of an IP after timeout, if not 0. The results are cached for ttl, or not at
+// all if 0, up to maxSize IPs and zones, or without limit if 0.
+func newDNSBLChecker(zones []string, timeout, ttl time.Duration, maxSize int) *dnsblChecker {
+	c := &dnsblChecker{
+		zones:    zones,
+		timeout:  timeout,
+		resolver: net.DefaultResolver,
+	}
+	if ttl > 0 {
+		c.results = cache.New[bool]("dnsbl", ttl, maxSize)
+	}
+	return c
+}
+
+// reverseIP returns the name of an IP queried in a zone: the octets of an IPv4 in reverse
+// order, or the nibbles of an IPv6 in reverse order.
+func reverseIP(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return strconv.Itoa(int(ip4[3])) + "." + strconv.Itoa(int(ip4[2])) + "." + strconv.Itoa(int(ip4[1])) + "." + strconv.Itoa(int(ip4[0]))
+	}
+
+	const hex = "0123456789abcdef"
+	nibbles := make([]string, 0, 32)
+	for i := len(ip) - 1; i >= 0; i-- {
+		nibbles = append(nibbles, string(hex[ip[i]&0x0f]), string(hex[ip[i]>>4]))
+	}
+	return strings.Join(nibbles, ".")
+}
+
+// isListing reports whether an answer of a zone lists the IP. Listings are in 127.0.0.0/8,
+// except for 127.255.255.0/24, used by some zones (e.g. Spamhaus) to report query errors.
+func isListing(answer string) bool {
+	ip := net.ParseIP(answer).To4()
+	return ip != nil && ip[0] == 127 && !(ip[1] == 255 && ip[2] == 255)
+}
+
+// listed returns the first zone listing the IP, if any. Private and loopback IPs are never
+// looked up. Lookups failing for other reasons than the IP not being listed (e.g. timeouts)
+// are only logged and not cached, so an unavailable zone doesn't block all emails.
+func (c *dnsblChecker) listed(host string) (string, bool) {
+	ip := net.ParseIP(host)
+	if ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() {
+		return "", false
+	}
+
+	// the timeout caps the lookups in all the zones, not each of them
+	ctx, cancel := context.Background(), context.CancelFunc(func() {})
+	if c.timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, c.timeout)
+	}
+	defer cancel()
+
+	name := reverseIP(ip)
+	for _, zone := range c.zones {
+		zone = strings.TrimSuffix(zone, ".")
+		key := ip.String() + "|" + zone
+		if c.results != nil {
+			if listed, ok := c.results.Get(key); ok {
+				if listed {
+					return zone, true
+				}
+				continue
+			}
+		}
+
+		answers, err := c.resolver.LookupHost(ctx, name+"."+zone)
+		var dnsErr *net.DNSError
+		switch {
+		case errors.As(err, &dnsErr) && dnsErr.IsNotFound:
+			c.cache(key, false)
+			continue
+		case err != nil:
+			logger.Warnf("DNSBL lookup of %s in '%s' failed, ignoring it: %v", host, zone, err)
+			continue
+		}
+
+		listed := false
+		for _, answer := range answers {
+			if isListing(answer) {
+				listed = true
+				break
+			}
+		}
+		c.cache(key, listed)
+		if listed {
+			return zone, true
+		}
+		logger.Debugf("DNSBL lookup of %s in '%s' returned no listing: %v", host, zone, answers)
+	}
+	return "", false
+}
+
+// cache records whether the IP is listed in the zone of key, if the results are cached.
+func (c *dnsblChecker) cache(key string, listed bool) {
+	if c.results != nil {
+		c.results.Put(key, listed)
+	}
+}
@@ -3,17 +3,24 @@ package email
 import (
 	"bufio"
 	"bytes"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"go-smtp-slacker/internal/config"
 	"go-smtp-slacker/internal/logger"
 	"io"
 	"log"
+	"net"
+	"net/mail"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
+	"unicode/utf8"
 
-	"github.com/DusanKasan/parsemail"
 	"github.com/emersion/go-sasl"
 	"github.com/emersion/go-smtp"
 	"golang.org/x/crypto/bcrypt"
@@ -24,35 +31,109 @@ const (
 	PolicyDeny  = "deny"
 )
 
+// Handling of the messages without To or Cc recipients, only sent to Bcc ones
+const (
+	BccOnlySkip    = "skip"
+	BccOnlyDeliver = "deliver"
+)
+
+// Handling of the messages with invalid To or Cc recipients
+const (
+	InvalidRecipientsSkip   = "skip"
+	InvalidRecipientsReject = "reject"
+)
+
 // backend implements SMTP server methods
 type backend struct {
-	emailChan chan *email
-	cfg       *config.SMTPConfig
-	userDb    map[string]user
+	queue    *emailQueue
+	cfg      *config.SMTPConfig
+	userDb   map[string]user
+	ipAuth   *ipAuthCache
+	proxies  []*net.IPNet
+	dnsbl    *dnsblChecker
+	verifier *recipientChecker
+	conns    *connTracker
+	// closing is set once the server shuts down
+	closing atomic.Bool
+	// pause pauses the server for maintenance
+	pause PauseSwitch
 }
 
 // session implements SMTP session methods
 type session struct {
 	authenticated bool
 	cfg           *config.SMTPConfig
-	emailChan     chan *email
+	queue         *emailQueue
 	requireAuth   bool
 	userDb        map[string]user
 	remoteAddr    string
+	ipAuth        *ipAuthCache
+	dnsbl         *dnsblChecker
+	verifier      *recipientChecker
+	closing       *atomic.Bool
+	pause         *PauseSwitch
+	messageCount  int
+	proxies       []*net.IPNet
+	trustedSender bool
+	// envelope recipients of the current message
+	rcpts []string
 }
 
-// email represents a parsed email.
-type email struct {
+// Email represents a parsed email.
+type Email struct {
 	Body    EmailBody
 	From    string
 	Subject string
 	To      []string
+	// Cc holds the recipients copied in the headers, which are not delivered to
+	Cc []string
+	// InvalidRecipients holds the To and Cc recipients which aren't valid addresses
+	InvalidRecipients []string
+	// UndecodableBodies holds the bodies ("text" or "html") which couldn't be decoded from
+	// their transfer encoding, kept as is
+	UndecodableBodies []string
+	// Bcc holds the recipients not listed in the headers, only known from the envelope
+	Bcc []string
+
+	// result receives the delivery result in synchronous mode
+	result chan error
 }
 
-// EmailBody represents the types of email bodies
+// Done reports the result of delivering the email. In synchronous mode, it
+// unblocks the SMTP session waiting to acknowledge the email; otherwise it's a no-op.
+// Errors of type *smtp.SMTPError are returned as is to the client.
+func (e *Email) Done(err error) {
+	if e.result != nil {
+		e.result <- err
+	}
+}
+
+// EmailBody represents the types of email bodies, along with the files attached to the email
 type EmailBody struct {
-	HTML string
-	Text string
+	HTML        string
+	Text        string
+	HTMLCharset string
+	TextCharset string
+	Attachments []Attachment
+	// Calendar holds the iCalendar object of invites (text/calendar), if any
+	Calendar string
+	// DeliveryStatus holds the delivery status of bounces (message/delivery-status), if any
+	DeliveryStatus string
+	// Header holds the full header set of the email
+	Header mail.Header
+	// HighPriority is set for emails flagged as high priority (X-Priority, Importance or Priority headers)
+	HighPriority bool
+	// ListID identifies the mailing list of the email (List-Id header), if any
+	ListID string
+	// Raw holds the email as received, headers included
+	Raw []byte
+}
+
+// Attachment represents a file attached to an email.
+type Attachment struct {
+	Filename    string
+	ContentType string
+	Data        []byte
 }
 
 // user represents an authenticated user with a bcrypt hashed password.
@@ -61,9 +142,24 @@ type user struct {
 	passwordHash string
 }
 
+// LoadUsernames returns the usernames of the user database file, sorted.
+func LoadUsernames(cfg config.AuthConfig) ([]string, error) {
+	users, err := loadUserDatabase(cfg.UserDatabase, cfg.UserDatabaseMaxSize, cfg.UserDatabaseMaxUsers)
+	if err != nil {
+		return nil, err
+	}
+	usernames := make([]string, 0, len(users))
+	for username := range users {
+		usernames = append(usernames, username)
+	}
+	sort.Strings(usernames)
+	return usernames, nil
+}
+
 // loadUserDatabase reads an user database file and returns a map of users.
 // It expects bcrypt hashes (e.g., $2y$10$...).
-func loadUserDatabase(filePath string) (map[string]user, error) {
+// A maxSize (in bytes) or maxUsers of 0 disables the respective limit.
+func loadUserDatabase(filePath string, maxSize int64, maxUsers int) (map[string]user, error) {
 	users := make(map[string]user)
 
 	file, err := os.Open(filePath)
@@ -72,6 +168,17 @@ func loadUserDatabase(filePath string) (map[string]user, error) {
 	}
 	defer file.Close()
 
+	// Refuse to load files larger than the configured limit
+	if maxSize > 0 {
+		info, err := file.Stat()
+		if err != nil {
+			return nil, fmt.Errorf("failed to stat user database file '%s': %w", filePath, err)
+		}
+		if info.Size() > maxSize {
+			return nil, fmt.Errorf("user database file '%s' is too large (%d bytes, max %d bytes)", filePath, info.Size(), maxSize)
+		}
+	}
+
 	scanner := bufio.NewScanner(file)
 	lineNum := 0
 	for scanner.Scan() {
@@ -90,6 +197,10 @@ func loadUserDatabase(filePath string) (map[string]user, error) {
 		username := parts[0]
 		passwordHash := parts[1]
 
+		if _, exists := users[username]; !exists && maxUsers > 0 && len(users) >= maxUsers {
+			return nil, fmt.Errorf("user database file '%s' exceeds the maximum of %d users", filePath, maxUsers)
+		}
+
 		users[username] = user{username: username, passwordHash: passwordHash}
 	}
 
@@ -99,26 +210,30 @@ func loadUserDatabase(filePath string) (map[string]user, error) {
 	return users, nil
 }
 
+// normalizeAddress extracts the bare email address from an envelope address that
+// may contain angle brackets or a display name (e.g. "Alice <alice@example.com>").
+func normalizeAddress(address string) string {
+	if parsed, err := mail.ParseAddress(address); err == nil {
+		return parsed.Address
+	}
+	address = strings.TrimSpace(address)
+	address = strings.TrimPrefix(address, "<")
+	address = strings.TrimSuffix(address, ">")
+	return strings.TrimSpace(address)
+}
+
 // Check if address is allowed/denied (deny list takes precedence)
 func isAddressAllowed(address string, allowList, denyList []string, defaultPolicy string) bool {
 	logger.Debugf("Checking address '%s' against allow list %v and deny list %v with default policy '%s'", address, allowList, denyList, defaultPolicy)
 
-	for _, pattern := range denyList {
-		if matched, err := filepath.Match(pattern, address); err != nil {
-			logger.Errorf("Invalid glob pattern '%s' in deny list: %v", pattern, err)
-		} else if matched {
-			logger.Debugf("Address '%s' matched deny pattern '%s', rejecting", address, pattern)
-			return false
-		}
+	if pattern, matched := matchPattern(address, denyList, "deny"); matched {
+		logger.Debugf("Address '%s' matched deny pattern '%s', rejecting", address, pattern)
+		return false
 	}
 
-	for _, pattern := range allowList {
-		if matched, err := filepath.Match(pattern, address); err != nil {
-			logger.Errorf("Invalid glob pattern '%s' in allow list: %v", pattern, err)
-		} else if matched {
-			logger.Debugf("Address '%s' matched allow pattern '%s', accepting", address, pattern)
-			return true
-		}
+	if pattern, matched := matchPattern(address, allowList, "allow"); matched {
+		logger.Debugf("Address '%s' matched allow pattern '%s', accepting", address, pattern)
+		return true
 	}
 
 	switch defaultPolicy {
@@ -134,18 +249,83 @@ func isAddressAllowed(address string, allowList, denyList []string, defaultPolic
 	}
 }
 
+// policyRejection returns the error rejecting an address denied by a policy, with the
+// configured code and message, 550 and the given message by default. Temporary rejections
+// turn the codes into their 4xx counterparts (e.g. 450), so the senders retry later.
+func policyRejection(policy config.Policy, defaultMessage string) *smtp.SMTPError {
+	err := &smtp.SMTPError{
+		Code:    550,
+		Message: defaultMessage,
+	}
+	if policy.RejectCode != 0 {
+		err.Code = policy.RejectCode
+	}
+	if policy.RejectMessage != "" {
+		err.Message = policy.RejectMessage
+	}
+	// the enhanced code is validated when loading the config, e.g. 5.7.1
+	if parts := strings.Split(policy.RejectEnhancedCode, "."); len(parts) == 3 {
+		for i, part := range parts {
+			err.EnhancedCode[i], _ = strconv.Atoi(part)
+		}
+	}
+	if policy.RejectTemporary {
+		err.Code -= 100
+		if err.EnhancedCode != smtp.EnhancedCodeNotSet {
+			err.EnhancedCode[0] = 4
+		}
+	}
+	return err
+}
+
+// matchPattern returns the first pattern of the list matching the address, if any.
+func matchPattern(address string, patterns []string, listName string) (string, bool) {
+	for _, pattern := range patterns {
+		if matched, err := filepath.Match(pattern, address); err != nil {
+			logger.Errorf("Invalid glob pattern '%s' in %s list: %v", pattern, listName, err)
+		} else if matched {
+			return pattern, true
+		}
+	}
+	return "", false
+}
+
 // NewSession is called after client greeting (EHLO, HELO).
 func (bkd *backend) NewSession(c *smtp.Conn) (smtp.Session, error) {
+	if bkd.pause.IsPaused() {
+		logger.Debugf("Server is paused, rejecting session from %s", c.Conn().RemoteAddr())
+		return nil, errPaused
+	}
+
 	return &session{
 		authenticated: false,
 		cfg:           bkd.cfg,
-		emailChan:     bkd.emailChan,
+		queue:         bkd.queue,
 		requireAuth:   *bkd.cfg.Auth.Enabled,
 		userDb:        bkd.userDb,
 		remoteAddr:    c.Conn().RemoteAddr().String(),
+		ipAuth:        bkd.ipAuth,
+		dnsbl:         bkd.dnsbl,
+		verifier:      bkd.verifier,
+		closing:       &bkd.closing,
+		pause:         &bkd.pause,
+		proxies:       bkd.proxies,
 	}, nil
 }
 
+// isAuthorized reports whether the session may send emails, either because it
+// authenticated or because its IP was recently authorized by another session.
+func (s *session) isAuthorized() bool {
+	if s.authenticated {
+		return true
+	}
+	if s.ipAuth != nil && s.ipAuth.isAuthorized(hostFromAddr(s.remoteAddr)) {
+		logger.Debugf("Client %s is authorized by a previous authentication from the same IP", s.remoteAddr)
+		return true
+	}
+	return false
+}
+
 // AuthMechanisms returns available auth mechanisms; only PLAIN is supported.
 func (s *session) AuthMechanisms() []string {
 	if s.requireAuth {
@@ -171,49 +351,104 @@ func (s *session) Auth(mech string) (sasl.Server, error) {
 
 		// Mark authentication as successful
 		s.authenticated = true
+
+		// Authorize subsequent connections from the same IP
+		if s.ipAuth != nil {
+			s.ipAuth.grant(hostFromAddr(s.remoteAddr))
+		}
 		return nil
 	}), nil
 }
 
 func (s *session) Mail(from string, opts *smtp.MailOptions) error {
 
+	// Sessions opened before the server was paused are turned down as well
+	if s.pause != nil && s.pause.IsPaused() {
+		logger.Debugf("Server is paused, rejecting email from %s", s.remoteAddr)
+		return errPaused
+	}
+
+	// Sessions finishing their emails during a shutdown can't start new ones
+	if s.closing != nil && s.closing.Load() {
+		logger.Debugf("Server is shutting down, rejecting email from %s", s.remoteAddr)
+		return errShuttingDown
+	}
+
 	// Check if user is authenticated
-	if s.requireAuth && !s.authenticated {
+	if s.requireAuth && !s.isAuthorized() {
 		logger.Warnf("There was an attempt to send an email without authentication from %s, rejecting", s.remoteAddr)
 		return smtp.ErrAuthRequired
 	}
 
+	// Check if the client IP is in a blocklist, unless the client authenticated
+	if s.dnsbl != nil && !s.isAuthorized() {
+		if zone, listed := s.dnsbl.listed(hostFromAddr(s.remoteAddr)); listed {
+			logger.Warnf("Client %s is listed in DNSBL '%s', rejecting", s.remoteAddr, zone)
+			return &smtp.SMTPError{
+				Code:         554,
+				EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+				Message:      fmt.Sprintf("Client host %s blocked using %s", hostFromAddr(s.remoteAddr), zone),
+			}
+		}
+	}
+
+	// Check if the session already sent the maximum number of messages
+	if s.cfg.MaxMessagesPerSession > 0 && s.messageCount >= s.cfg.MaxMessagesPerSession {
+		logger.Warnf("Client %s reached the limit of %d messages per session, rejecting", s.remoteAddr, s.cfg.MaxMessagesPerSession)
+		return &smtp.SMTPError{
+			Code:    421,
+			Message: "Too many messages in this session, please reconnect",
+		}
+	}
+
+	if s.cfg.NormalizeAddresses {
+		from = normalizeAddress(from)
+	}
+
 	// Check against allowed/denied senders
 	logger.Debugf("Checking if sender '%s' is allowed or denied", from)
 	if !isAddressAllowed(from, s.cfg.Policies.From.Allow, s.cfg.Policies.From.Deny, s.cfg.Policies.From.DefaultAction) {
 		logger.Warnf("Sender '%s' rejected by policy", from)
-		return &smtp.SMTPError{
-			Code:    550,
-			Message: "Sender not allowed",
-		}
+		return policyRejection(s.cfg.Policies.From, "Sender not allowed")
 	}
 
+	// Senders explicitly allowed may be trusted to send to any recipient
+	_, allowed := matchPattern(from, s.cfg.Policies.From.Allow, "allow")
+	s.trustedSender = s.cfg.TrustAllowedSenders && allowed
+
 	return nil
 }
 
 func (s *session) Rcpt(to string, opts *smtp.RcptOptions) error {
 
 	// Check if user is authenticated
-	if s.requireAuth && !s.authenticated {
+	if s.requireAuth && !s.isAuthorized() {
 		logger.Warnf("There was an attempt to send an email without authentication from %s, rejecting", s.remoteAddr)
 		return smtp.ErrAuthRequired
 	}
 
-	// Check against allowed/denied recipients
-	logger.Debugf("Checking if recipient '%s' is allowed or denied", to)
-	if !isAddressAllowed(to, s.cfg.Policies.To.Allow, s.cfg.Policies.To.Deny, s.cfg.Policies.To.DefaultAction) {
-		logger.Warnf("Recipient '%s' rejected by policy", to)
-		return &smtp.SMTPError{
-			Code:    550,
-			Message: "Recipient not allowed",
+	if s.cfg.NormalizeAddresses {
+		to = normalizeAddress(to)
+	}
+
+	if s.trustedSender {
+		logger.Debugf("Sender is trusted, skipping the policy check of recipient '%s'", to)
+	} else {
+		// Check against allowed/denied recipients
+		logger.Debugf("Checking if recipient '%s' is allowed or denied", to)
+		if !isAddressAllowed(to, s.cfg.Policies.To.Allow, s.cfg.Policies.To.Deny, s.cfg.Policies.To.DefaultAction) {
+			logger.Warnf("Recipient '%s' rejected by policy", to)
+			return policyRejection(s.cfg.Policies.To, "Recipient not allowed")
 		}
 	}
 
+	// Check that the recipient can be delivered, so the client knows right away
+	if s.verifier != nil && !s.verifier.exists(to) {
+		logger.Warnf("Recipient '%s' is unknown, rejecting", to)
+		return errUnknownRecipient
+	}
+
+	s.rcpts = append(s.rcpts, to)
 	return nil
 }
 
@@ -221,7 +456,7 @@ func (s *session) Rcpt(to string, opts *smtp.RcptOptions) error {
 func (s *session) Data(r io.Reader) error {
 
 	// Check if user is authenticated
-	if s.requireAuth && !s.authenticated {
+	if s.requireAuth && !s.isAuthorized() {
 		logger.Warnf("There was an attempt to send an email without authentication from %s, rejecting", s.remoteAddr)
 		return smtp.ErrAuthRequired
 	}
@@ -230,89 +465,252 @@ func (s *session) Data(r io.Reader) error {
 	if err != nil {
 		return err
 	}
+	if s.cfg.LogRawEmails {
+		raw := truncateRawEmail(b, s.cfg.RawEmailLogMaxBytes)
+		if logger.IsRedacting() {
+			raw = logger.Redact(raw)
+		}
+		logger.Tracef("Raw email:\n%s", raw)
+	}
 
-	// log RAW email
-	logger.Tracef("Raw email:\n%s", string(b))
-
-	emailParsed, err := parsemail.Parse(bytes.NewReader(b))
+	email, err := ParseEmail(bytes.NewReader(b))
+	var skipped *ErrSkipped
+	if errors.As(err, &skipped) {
+		if skipped.Reason == SkipUnparsable {
+			logger.Errorf("Error parsing email: %v", skipped.Err)
+		}
+		return nil // accepted, but not delivered
+	}
 	if err != nil {
-		logger.Errorf("Error parsing email: %v", err)
-		return nil // skip if parse errors
+		return err
 	}
 
-	var from string
-	// skip if no from
-	if len(emailParsed.From) == 0 {
-		return nil
-	} else {
-		from = emailParsed.From[0].Address
+	// The header of a message relayed by a trusted proxy only comes after the checks
+	// of the session, so the client IP it forwards is only logged, for this message
+	if len(s.proxies) > 0 && s.cfg.ClientIPSource == ClientIPSourceHeader && s.cfg.ClientIPHeader != "" {
+		clientIP := resolveClientIP(s.remoteAddr, email.Body.Header.Get(s.cfg.ClientIPHeader), s.proxies)
+		if clientIP != hostFromAddr(s.remoteAddr) {
+			logger.Infof("Email from '%s' relayed by trusted proxy %s for client %s", email.From, s.remoteAddr, clientIP)
+		}
+	}
+
+	// Invalid recipients are skipped, unless the sender is told to fix them
+	if len(email.InvalidRecipients) > 0 && s.cfg.InvalidRecipients == InvalidRecipientsReject {
+		return &smtp.SMTPError{
+			Code:         550,
+			EnhancedCode: smtp.EnhancedCode{5, 1, 3},
+			Message:      fmt.Sprintf("Invalid recipient address: %s", strings.Join(email.InvalidRecipients, ", ")),
+		}
 	}
 
-	var to []string
-	for _, recipient := range emailParsed.To {
-		to = append(to, recipient.Address)
+	// Undecodable bodies are delivered as is, unless the sender is told to fix them
+	if len(email.UndecodableBodies) > 0 && s.cfg.UndecodableBody == UndecodableBodyReject {
+		return &smtp.SMTPError{
+			Code:         550,
+			EnhancedCode: smtp.EnhancedCode{5, 6, 0},
+			Message:      "Message body can't be decoded from its Content-Transfer-Encoding",
+		}
+	}
+
+	// Messages only sent to Bcc recipients can be delivered to the envelope recipients
+	if len(email.To) == 0 && len(email.Cc) == 0 && s.cfg.BccOnly == BccOnlyDeliver && len(s.rcpts) > 0 {
+		logger.Debugf("Email from '%s' has no To or Cc recipient, delivering to the envelope recipients %v", email.From, s.rcpts)
+		email.Bcc = append(email.Bcc, s.rcpts...)
 	}
 
 	// Skip if no recipients
-	if len(to) == 0 {
-		logger.Warnf("Email from '%s' has no recipient; skipping", from)
+	if len(email.To) == 0 && len(email.Bcc) == 0 {
+		logger.Warnf("Email from '%s' has no recipient; skipping", email.From)
 		return nil
 	}
 
-	email := &email{
-		From:    from,
-		To:      to,
-		Subject: emailParsed.Subject,
-		Body: EmailBody{
-			HTML: emailParsed.HTMLBody,
-			Text: emailParsed.TextBody,
-		},
+	// In synchronous mode, wait for the delivery result before acknowledging the email
+	if s.cfg.SynchronousDelivery {
+		email.result = make(chan error, 1)
 	}
 
 	// Send the parsed email to the channel
-	if s.emailChan != nil {
-		s.emailChan <- email
+	if s.queue != nil {
+		if err := s.enqueue(email); err != nil {
+			return err
+		}
+	}
+	s.messageCount++
+
+	if email.result != nil && s.queue != nil {
+		return s.waitForDelivery(email)
 	}
 
 	return nil
 }
 
-func (s *session) Reset() {}
+// truncateRawEmail returns the raw email logged, cut after maxBytes (if not 0) at the
+// start of a character, noting how much was left out.
+func truncateRawEmail(b []byte, maxBytes int) string {
+	if maxBytes <= 0 || len(b) <= maxBytes {
+		return string(b)
+	}
+	cut := maxBytes
+	for cut > 0 && !utf8.RuneStart(b[cut]) {
+		cut--
+	}
+	return fmt.Sprintf("%s\n[... %d more bytes]", b[:cut], len(b)-cut)
+}
+
+// enqueue sends the email to the queue, giving up with a temporary error if the
+// queue stays full for longer than the configured timeout, or is closed.
+func (s *session) enqueue(e *Email) error {
+	s.queue.mu.RLock()
+	defer s.queue.mu.RUnlock()
+	if s.queue.closed {
+		return errShuttingDown
+	}
+
+	var timeout <-chan time.Time
+	if s.cfg.EnqueueTimeout > 0 {
+		timer := time.NewTimer(s.cfg.EnqueueTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case s.queue.ch <- e:
+		return nil
+	case <-s.queue.closing:
+		return errShuttingDown
+	case <-timeout:
+		logger.Warnf("Queue is full, rejecting email from '%s' temporarily", e.From)
+		return &smtp.SMTPError{
+			Code:    451,
+			Message: "Queue is full, please try again later",
+		}
+	}
+}
+
+// waitForDelivery waits for the result of delivering the email, translating a
+// failure into an SMTP error so the client can retry. Once the timeout elapses, the
+// email is accepted while its delivery goes on, not to be posted twice on retry.
+func (s *session) waitForDelivery(e *Email) error {
+	var timeout <-chan time.Time
+	if s.cfg.SynchronousDeliveryTimeout > 0 {
+		timeout = time.After(s.cfg.SynchronousDeliveryTimeout)
+	}
+
+	select {
+	case err := <-e.result:
+		if err == nil {
+			return nil
+		}
+		logger.Warnf("Delivery of email from '%s' failed: %v", e.From, err)
+		var smtpErr *smtp.SMTPError
+		if errors.As(err, &smtpErr) {
+			return smtpErr
+		}
+		return &smtp.SMTPError{
+			Code:    451,
+			Message: "Delivery failed, please try again later",
+		}
+	case <-timeout:
+		// the delivery keeps going and may still succeed, a retry would post it twice:
+		// its failures, if any, are reported to the ops alerts
+		logger.Warnf("Timed out waiting for the delivery of email from '%s', accepting it while it's still being delivered", e.From)
+		return nil
+	}
+}
+
+// Reset is called after every message, so only the envelope recipients are cleared:
+// the message count is deliberately kept for the whole session.
+func (s *session) Reset() {
+	s.rcpts = nil
+}
 
 func (s *session) Logout() error {
 	return nil
 }
 
+// serverLogLevel returns the level the messages of the go-smtp server are logged at,
+// errors unless configured otherwise.
+func serverLogLevel(cfg config.SMTPConfig) logger.LogLevel {
+	if cfg.ServerLogLevel == "" {
+		return logger.LevelError
+	}
+	return logger.ParseLogLevel(cfg.ServerLogLevel)
+}
+
 // NewServer creates a new SMTP server that pushes parsed emails to a channel.
-func NewServer(cfg config.SMTPConfig) (*smtp.Server, chan *email) {
-	emailChan := make(chan *email, 100) // buffered channel
+func NewServer(cfg config.SMTPConfig, verifier RecipientVerifier) (*smtp.Server, chan *Email, error) {
+	emailChan := make(chan *Email, 100) // buffered channel
 
 	var users map[string]user
 	if *cfg.Auth.Enabled {
 		var err error
-		users, err = loadUserDatabase(cfg.Auth.UserDatabase)
+		users, err = loadUserDatabase(cfg.Auth.UserDatabase, cfg.Auth.UserDatabaseMaxSize, cfg.Auth.UserDatabaseMaxUsers)
 		if err != nil {
-			logger.Fatalf("Failed to load user database file: %v", err)
+			return nil, nil, fmt.Errorf("failed to load user database file: %w", err)
 		}
 		logger.Infof("Loaded %d users from user database file '%s'", len(users), cfg.Auth.UserDatabase)
 	}
 
 	be := &backend{
-		emailChan: emailChan,
-		cfg:       &cfg,
-		userDb:    users,
+		queue:  newEmailQueue(emailChan),
+		cfg:    &cfg,
+		userDb: users,
+		conns:  newConnTracker(),
+	}
+
+	if len(cfg.TrustedProxies) > 0 {
+		proxies, err := parseTrustedProxies(cfg.TrustedProxies)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to parse trusted proxies: %w", err)
+		}
+		be.proxies = proxies
+	}
+	if cfg.ClientIPSource == ClientIPSourceProxyProtocol {
+		if len(be.proxies) == 0 {
+			logger.Warnf("The client IP source is the PROXY protocol, but no trusted proxy is set: the header is never read")
+		} else {
+			logger.Infof("The connections of the trusted proxies must start with a PROXY protocol header")
+		}
+	}
+
+	if *cfg.Auth.Enabled && cfg.Auth.IPAuthorizationTTL > 0 {
+		be.ipAuth = newIPAuthCache(cfg.Auth.IPAuthorizationTTL)
+		logger.Infof("Successful authentications will authorize the client IP for %s", cfg.Auth.IPAuthorizationTTL)
+	}
+
+	var tlsConfig *tls.Config
+	if cfg.TLS.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.TLS.CertFile, cfg.TLS.KeyFile)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to load TLS certificate: %w", err)
+		}
+		tlsConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+		logger.Infof("Serving SMTP over TLS (%s) with certificate '%s'", cfg.TLS.Mode, cfg.TLS.CertFile)
+	}
+
+	if len(cfg.DNSBL.Zones) > 0 {
+		be.dnsbl = newDNSBLChecker(cfg.DNSBL.Zones, cfg.DNSBL.Timeout, cfg.DNSBL.CacheTTL, cfg.DNSBL.CacheMaxSize)
+		logger.Infof("Checking client IPs against DNSBL zones: %s", strings.Join(cfg.DNSBL.Zones, ", "))
+	}
+
+	if cfg.VerifyRecipients.Enabled && verifier != nil {
+		be.verifier = newRecipientChecker(verifier, cfg.VerifyRecipients.CacheTTL, cfg.VerifyRecipients.CacheMaxSize)
+		logger.Infof("Verifying the recipients at RCPT, caching the results for %s", cfg.VerifyRecipients.CacheTTL)
 	}
 
 	s := smtp.NewServer(be)
-	s.ErrorLog = log.New(logger.NewLineWriter(logger.LevelError, "smtp/server:"), "", 0)
+	// clients are offered STARTTLS when set, unless the connection already is over TLS
+	s.TLSConfig = tlsConfig
+	s.ErrorLog = log.New(logger.NewLineWriter(serverLogLevel(cfg), "smtp/server:"), "", 0)
 	s.Addr = cfg.ListenAddr
 	// TODO: Make these configurable via config file
 	s.Domain = "localhost"
 	s.ReadTimeout = 10 * time.Second
 	s.WriteTimeout = 10 * time.Second
-	s.MaxMessageBytes = 1024 * 1024 // 1 MB
+	// advertised with the SIZE extension, so clients can avoid sending larger messages
+	s.MaxMessageBytes = cfg.MaxMessageBytes
 	s.MaxRecipients = 50
 	s.AllowInsecureAuth = true
 
-	return s, emailChan
+	return s, emailChan, nil
 }
@@ -1,16 +1,34 @@
 package email
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
 	"errors"
 	"fmt"
 	"go-smtp-slacker/internal/config"
+	"go-smtp-slacker/internal/logger"
+	"log"
+	"math/big"
+	"net"
+	"net/mail"
 	"os"
 	"path/filepath"
+	"reflect"
 	"strings"
 	"testing"
+	"testing/iotest"
 	"time"
 
+	"github.com/emersion/go-sasl"
 	"github.com/emersion/go-smtp"
 	"golang.org/x/crypto/bcrypt"
 )
@@ -48,6 +66,8 @@ user3:andanotherhash
 		name          string
 		content       string
 		filePath      string
+		maxSize       int64
+		maxUsers      int
 		expectError   bool
 		errorContains string
 		expectedUsers int
@@ -91,6 +111,28 @@ user3:andanotherhash
 			expectError:   false,
 			expectedUsers: 0,
 		},
+		{
+			name:          "file exceeds max size",
+			content:       validContent,
+			maxSize:       16,
+			expectError:   true,
+			errorContains: "is too large",
+		},
+		{
+			name:          "file exceeds max users",
+			content:       validContent,
+			maxUsers:      2,
+			expectError:   true,
+			errorContains: "exceeds the maximum of 2 users",
+		},
+		{
+			name:          "file within limits",
+			content:       validContent,
+			maxSize:       int64(len(validContent)),
+			maxUsers:      3,
+			expectError:   false,
+			expectedUsers: 3,
+		},
 	}
 
 	for _, tc := range testCases {
@@ -100,7 +142,7 @@ user3:andanotherhash
 				filePath = createTempUserDB(t, tc.content)
 			}
 
-			users, err := loadUserDatabase(filePath)
+			users, err := loadUserDatabase(filePath, tc.maxSize, tc.maxUsers)
 
 			if tc.expectError {
 				if err == nil {
@@ -124,6 +166,23 @@ user3:andanotherhash
 	}
 }
 
+func TestLoadUsernames(t *testing.T) {
+	path := createTempUserDB(t, "# users\nrelay:hash\nbob@example.com:hash\nalice@example.com:hash\n")
+
+	usernames, err := LoadUsernames(config.AuthConfig{UserDatabase: path})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := []string{"alice@example.com", "bob@example.com", "relay"}
+	if fmt.Sprint(usernames) != fmt.Sprint(expected) {
+		t.Errorf("expected usernames %v, got %v", expected, usernames)
+	}
+
+	if _, err := LoadUsernames(config.AuthConfig{UserDatabase: path, UserDatabaseMaxUsers: 2}); err == nil {
+		t.Error("expected the limits of the user database to apply")
+	}
+}
+
 func TestIsAddressAllowed(t *testing.T) {
 	testCases := []struct {
 		name          string
@@ -229,7 +288,7 @@ func TestIsAddressAllowed(t *testing.T) {
 	}
 }
 
-func newTestSession(t *testing.T, cfg *config.SMTPConfig, authenticated bool, emailChan chan *email) *session {
+func newTestSession(t *testing.T, cfg *config.SMTPConfig, authenticated bool, emailChan chan *Email) *session {
 	t.Helper()
 
 	var userDb map[string]user
@@ -247,10 +306,15 @@ func newTestSession(t *testing.T, cfg *config.SMTPConfig, authenticated bool, em
 		}
 	}
 
+	var queue *emailQueue
+	if emailChan != nil {
+		queue = newEmailQueue(emailChan)
+	}
+
 	return &session{
 		authenticated: authenticated,
 		cfg:           cfg,
-		emailChan:     emailChan,
+		queue:         queue,
 		requireAuth:   cfg.Auth.Enabled != nil && *cfg.Auth.Enabled,
 		userDb:        userDb,
 		remoteAddr:    "127.0.0.1:12345",
@@ -277,6 +341,18 @@ func TestSession_MailAndRcpt(t *testing.T) {
 	cfgAuthDisabled := baseCfg
 	cfgAuthDisabled.Auth.Enabled = &authDisabled
 
+	cfgCustomReject := cfgAuthDisabled
+	cfgCustomReject.Policies.From.RejectCode = 554
+	cfgCustomReject.Policies.From.RejectEnhancedCode = "5.7.1"
+	cfgCustomReject.Policies.From.RejectMessage = "Relay access denied"
+	cfgCustomReject.Policies.To.RejectCode = 553
+
+	cfgTemporaryReject := cfgAuthDisabled
+	cfgTemporaryReject.Policies.From.RejectTemporary = true
+	cfgTemporaryReject.Policies.To = cfgCustomReject.Policies.From
+	cfgTemporaryReject.Policies.To.DefaultAction = PolicyDeny
+	cfgTemporaryReject.Policies.To.RejectTemporary = true
+
 	testCases := []struct {
 		name          string
 		method        string // "Mail" or "Rcpt"
@@ -336,6 +412,40 @@ func TestSession_MailAndRcpt(t *testing.T) {
 			authenticated: false,
 			expectErr:     nil,
 		},
+		// Configured rejections
+		{
+			name:          "Mail - Sender denied with the configured code and message",
+			method:        "Mail",
+			address:       "bad-sender@example.com",
+			cfg:           cfgCustomReject,
+			authenticated: false,
+			expectErr:     &smtp.SMTPError{Code: 554, EnhancedCode: smtp.EnhancedCode{5, 7, 1}, Message: "Relay access denied"},
+		},
+		{
+			name:          "Rcpt - Recipient denied with the configured code",
+			method:        "Rcpt",
+			address:       "bad-rcpt@example.com",
+			cfg:           cfgCustomReject,
+			authenticated: false,
+			expectErr:     &smtp.SMTPError{Code: 553, Message: "Recipient not allowed"},
+		},
+		// Temporary rejections
+		{
+			name:          "Mail - Sender denied temporarily",
+			method:        "Mail",
+			address:       "bad-sender@example.com",
+			cfg:           cfgTemporaryReject,
+			authenticated: false,
+			expectErr:     &smtp.SMTPError{Code: 450, Message: "Sender not allowed"},
+		},
+		{
+			name:          "Rcpt - Recipient denied temporarily with the configured code",
+			method:        "Rcpt",
+			address:       "bad-rcpt@example.com",
+			cfg:           cfgTemporaryReject,
+			authenticated: false,
+			expectErr:     &smtp.SMTPError{Code: 454, EnhancedCode: smtp.EnhancedCode{4, 7, 1}, Message: "Relay access denied"},
+		},
 	}
 
 	for _, tc := range testCases {
@@ -352,7 +462,7 @@ func TestSession_MailAndRcpt(t *testing.T) {
 				// Handle comparison for SMTPError which doesn't work well with errors.Is
 				if expected, ok := tc.expectErr.(*smtp.SMTPError); ok {
 					if actual, ok := err.(*smtp.SMTPError); ok {
-						if expected.Code == actual.Code && expected.Message == actual.Message {
+						if expected.Code == actual.Code && expected.EnhancedCode == actual.EnhancedCode && expected.Message == actual.Message {
 							return // Errors match
 						}
 					}
@@ -380,7 +490,7 @@ This is the body.`
 		authenticated bool
 		expectErr     error
 		expectOnChan  bool
-		checkEmail    func(*testing.T, *email)
+		checkEmail    func(*testing.T, *Email)
 	}{
 		{
 			name:          "Auth required, not authenticated",
@@ -397,7 +507,7 @@ This is the body.`
 			authenticated: true,
 			expectErr:     nil,
 			expectOnChan:  true,
-			checkEmail: func(t *testing.T, e *email) {
+			checkEmail: func(t *testing.T, e *Email) {
 				if e.From != "from@example.com" {
 					t.Errorf("expected From 'from@example.com', got '%s'", e.From)
 				}
@@ -437,7 +547,7 @@ This is the body.`
 
 	for _, tc := range testCases {
 		t.Run(tc.name, func(t *testing.T) {
-			emailChan := make(chan *email, 1)
+			emailChan := make(chan *Email, 1)
 			s := newTestSession(t, &tc.cfg, tc.authenticated, emailChan)
 
 			reader := bytes.NewReader([]byte(tc.emailContent))
@@ -467,3 +577,2226 @@ This is the body.`
 		})
 	}
 }
+
+func TestIPAuthCache(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	c := newIPAuthCache(5 * time.Minute)
+	c.now = func() time.Time { return now }
+
+	if c.isAuthorized("10.0.0.1") {
+		t.Fatal("expected IP to be unauthorized before any grant")
+	}
+
+	c.grant("10.0.0.1")
+	if !c.isAuthorized("10.0.0.1") {
+		t.Error("expected IP to be authorized right after grant")
+	}
+	if c.isAuthorized("10.0.0.2") {
+		t.Error("expected other IPs to remain unauthorized")
+	}
+
+	now = now.Add(4 * time.Minute)
+	if !c.isAuthorized("10.0.0.1") {
+		t.Error("expected IP to still be authorized before the TTL expires")
+	}
+
+	now = now.Add(time.Minute)
+	if c.isAuthorized("10.0.0.1") {
+		t.Error("expected IP authorization to expire after the TTL")
+	}
+	if _, ok := c.expires["10.0.0.1"]; ok {
+		t.Error("expected expired entry to be removed")
+	}
+}
+
+func TestSession_IPAuthorization(t *testing.T) {
+	authEnabled := true
+	cfg := config.SMTPConfig{
+		Auth: config.AuthConfig{Enabled: &authEnabled},
+	}
+	cfg.Policies.From.DefaultAction = PolicyAllow
+	cfg.Policies.To.DefaultAction = PolicyAllow
+
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	ipAuth := newIPAuthCache(time.Minute)
+	ipAuth.now = func() time.Time { return now }
+
+	// First session authenticates, which authorizes its IP
+	first := newTestSession(t, &cfg, false, nil)
+	first.ipAuth = ipAuth
+	server, err := first.Auth(sasl.Plain)
+	if err != nil {
+		t.Fatalf("unexpected error creating auth server: %v", err)
+	}
+	if _, _, err := server.Next([]byte("\x00testuser\x00password123")); err != nil {
+		t.Fatalf("expected authentication to succeed, got: %v", err)
+	}
+
+	// A new unauthenticated session from the same IP is accepted
+	second := newTestSession(t, &cfg, false, nil)
+	second.ipAuth = ipAuth
+	second.remoteAddr = "127.0.0.1:54321"
+	if err := second.Mail("from@example.com", nil); err != nil {
+		t.Errorf("expected Mail to be accepted from an authorized IP, got: %v", err)
+	}
+	if err := second.Rcpt("to@example.com", nil); err != nil {
+		t.Errorf("expected Rcpt to be accepted from an authorized IP, got: %v", err)
+	}
+
+	// A session from another IP still needs to authenticate
+	other := newTestSession(t, &cfg, false, nil)
+	other.ipAuth = ipAuth
+	other.remoteAddr = "10.0.0.1:12345"
+	if err := other.Mail("from@example.com", nil); !errors.Is(err, smtp.ErrAuthRequired) {
+		t.Errorf("expected ErrAuthRequired from an unauthorized IP, got: %v", err)
+	}
+
+	// Once the authorization expires, authentication is required again
+	now = now.Add(time.Minute)
+	if err := second.Mail("from@example.com", nil); !errors.Is(err, smtp.ErrAuthRequired) {
+		t.Errorf("expected ErrAuthRequired after the authorization expired, got: %v", err)
+	}
+}
+
+func TestSession_MaxMessagesPerSession(t *testing.T) {
+	authDisabled := false
+	cfg := config.SMTPConfig{
+		Auth:                  config.AuthConfig{Enabled: &authDisabled},
+		MaxMessagesPerSession: 2,
+	}
+	cfg.Policies.From.DefaultAction = PolicyAllow
+	cfg.Policies.To.DefaultAction = PolicyAllow
+
+	emailChan := make(chan *Email, 10)
+	s := newTestSession(t, &cfg, false, emailChan)
+
+	sendMessage := func() error {
+		if err := s.Mail("from@example.com", nil); err != nil {
+			return err
+		}
+		if err := s.Rcpt("to@example.com", nil); err != nil {
+			return err
+		}
+		err := s.Data(strings.NewReader("From: from@example.com\nTo: to@example.com\nSubject: Test\n\nbody"))
+		s.Reset()
+		return err
+	}
+
+	for i := 0; i < cfg.MaxMessagesPerSession; i++ {
+		if err := sendMessage(); err != nil {
+			t.Fatalf("expected message %d to be accepted, got: %v", i+1, err)
+		}
+	}
+
+	err := sendMessage()
+	var smtpErr *smtp.SMTPError
+	if !errors.As(err, &smtpErr) || smtpErr.Code != 421 {
+		t.Fatalf("expected a 421 error after reaching the limit, got: %v", err)
+	}
+	if len(emailChan) != cfg.MaxMessagesPerSession {
+		t.Errorf("expected %d emails on the channel, got %d", cfg.MaxMessagesPerSession, len(emailChan))
+	}
+
+	// A new session starts with a fresh count
+	s = newTestSession(t, &cfg, false, emailChan)
+	if err := sendMessage(); err != nil {
+		t.Errorf("expected a new session to accept messages, got: %v", err)
+	}
+}
+
+func TestNormalizeAddress(t *testing.T) {
+	testCases := []struct {
+		input    string
+		expected string
+	}{
+		{input: "alice@corp.com", expected: "alice@corp.com"},
+		{input: "<alice@corp.com>", expected: "alice@corp.com"},
+		{input: " <alice@corp.com> ", expected: "alice@corp.com"},
+		{input: "Alice <alice@corp.com>", expected: "alice@corp.com"},
+		{input: "\"Alice Smith\" <alice@corp.com>", expected: "alice@corp.com"},
+		{input: "<not an address>", expected: "not an address"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.input, func(t *testing.T) {
+			if actual := normalizeAddress(tc.input); actual != tc.expected {
+				t.Errorf("expected '%s', got '%s'", tc.expected, actual)
+			}
+		})
+	}
+}
+
+func TestSession_NormalizeAddresses(t *testing.T) {
+	authDisabled := false
+	cfg := config.SMTPConfig{
+		Auth:               config.AuthConfig{Enabled: &authDisabled},
+		NormalizeAddresses: true,
+	}
+	cfg.Policies.From = config.Policy{DefaultAction: PolicyDeny, Allow: []string{"alice@corp.com"}}
+	cfg.Policies.To = config.Policy{DefaultAction: PolicyDeny, Allow: []string{"bob@corp.com"}}
+
+	s := newTestSession(t, &cfg, false, nil)
+	if err := s.Mail("<alice@corp.com>", nil); err != nil {
+		t.Errorf("expected bracketed sender to be allowed, got: %v", err)
+	}
+	if err := s.Mail("Alice <alice@corp.com>", nil); err != nil {
+		t.Errorf("expected sender with display name to be allowed, got: %v", err)
+	}
+	if err := s.Rcpt("Bob <bob@corp.com>", nil); err != nil {
+		t.Errorf("expected recipient with display name to be allowed, got: %v", err)
+	}
+
+	// Without normalization the raw address doesn't match the policy
+	cfg.NormalizeAddresses = false
+	if err := s.Mail("<alice@corp.com>", nil); err == nil {
+		t.Error("expected bracketed sender to be rejected without normalization")
+	}
+}
+
+func TestResolveClientIP(t *testing.T) {
+	proxies, err := parseTrustedProxies([]string{"10.0.0.0/8", "192.168.1.1"})
+	if err != nil {
+		t.Fatalf("failed to parse trusted proxies: %v", err)
+	}
+
+	testCases := []struct {
+		name         string
+		remoteAddr   string
+		forwardedFor string
+		expected     string
+	}{
+		{
+			name:       "direct connection without header",
+			remoteAddr: "203.0.113.5:1234",
+			expected:   "203.0.113.5",
+		},
+		{
+			name:         "untrusted connection ignores header",
+			remoteAddr:   "203.0.113.5:1234",
+			forwardedFor: "198.51.100.7",
+			expected:     "203.0.113.5",
+		},
+		{
+			name:       "trusted proxy without header",
+			remoteAddr: "10.1.2.3:1234",
+			expected:   "10.1.2.3",
+		},
+		{
+			name:         "trusted proxy with single forwarded IP",
+			remoteAddr:   "10.1.2.3:1234",
+			forwardedFor: "198.51.100.7",
+			expected:     "198.51.100.7",
+		},
+		{
+			name:         "chain of trusted proxies",
+			remoteAddr:   "192.168.1.1:1234",
+			forwardedFor: "198.51.100.7, 10.0.0.9",
+			expected:     "198.51.100.7",
+		},
+		{
+			name:         "spoofed leftmost entry is ignored",
+			remoteAddr:   "10.1.2.3:1234",
+			forwardedFor: "1.1.1.1, 198.51.100.7",
+			expected:     "198.51.100.7",
+		},
+		{
+			name:         "invalid entry stops the walk",
+			remoteAddr:   "10.1.2.3:1234",
+			forwardedFor: "198.51.100.7, garbage",
+			expected:     "10.1.2.3",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if actual := resolveClientIP(tc.remoteAddr, tc.forwardedFor, proxies); actual != tc.expected {
+				t.Errorf("expected '%s', got '%s'", tc.expected, actual)
+			}
+		})
+	}
+
+	_, err = parseTrustedProxies([]string{"10.0.0.1", "10.0.0.300"})
+	if err == nil || !strings.Contains(err.Error(), "'10.0.0.300'") {
+		t.Errorf("expected an error reporting the invalid trusted proxy as written, got %v", err)
+	}
+}
+
+func TestSession_DataTrustedProxy(t *testing.T) {
+	authDisabled := false
+	cfg := config.SMTPConfig{
+		Auth:           config.AuthConfig{Enabled: &authDisabled},
+		ClientIPSource: ClientIPSourceHeader,
+		ClientIPHeader: "X-Forwarded-For",
+	}
+	proxies, err := parseTrustedProxies([]string{"127.0.0.1"})
+	if err != nil {
+		t.Fatalf("failed to parse trusted proxies: %v", err)
+	}
+
+	emailChan := make(chan *Email, 1)
+	s := newTestSession(t, &cfg, false, emailChan)
+	s.proxies = proxies
+	remoteAddr := s.remoteAddr
+
+	content := "From: from@example.com\nTo: to@example.com\nX-Forwarded-For: 198.51.100.7\nSubject: Test\n\nbody"
+	if err := s.Data(strings.NewReader(content)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// the header only comes after the checks of the session, and only applies to its message
+	if s.remoteAddr != remoteAddr {
+		t.Errorf("expected the address of the connection to be kept, got '%s'", s.remoteAddr)
+	}
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	proxyAddr := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 40000}
+
+	testCases := []struct {
+		name        string
+		header      string
+		expected    string
+		expectError bool
+	}{
+		{name: "tcp4", header: "PROXY TCP4 198.51.100.7 10.0.0.1 52000 25\r\n", expected: "198.51.100.7:52000"},
+		{name: "tcp6", header: "PROXY TCP6 2001:db8::7 2001:db8::1 52000 25\r\n", expected: "[2001:db8::7]:52000"},
+		{name: "unknown protocol", header: "PROXY UNKNOWN\r\n", expected: "10.0.0.1:40000"},
+		{name: "not a proxy header", header: "EHLO client.example.com\r\n", expectError: true},
+		{name: "missing fields", header: "PROXY TCP4 198.51.100.7\r\n", expectError: true},
+		{name: "family mismatch", header: "PROXY TCP4 2001:db8::7 10.0.0.1 52000 25\r\n", expectError: true},
+		{name: "invalid port", header: "PROXY TCP4 198.51.100.7 10.0.0.1 99999 25\r\n", expectError: true},
+		{name: "without crlf", header: "PROXY TCP4 198.51.100.7 10.0.0.1 52000 25\n", expectError: true},
+		{name: "too long", header: "PROXY " + strings.Repeat("x", 200) + "\r\n", expectError: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			addr, err := readProxyHeader(bufio.NewReader(strings.NewReader(tc.header)), proxyAddr)
+			if tc.expectError {
+				if err == nil {
+					t.Errorf("expected an error, got address %v", addr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if addr.String() != tc.expected {
+				t.Errorf("expected '%s', got '%s'", tc.expected, addr)
+			}
+		})
+	}
+}
+
+func TestProxyListener(t *testing.T) {
+	accept := func(t *testing.T, trusted string, sent string) net.Conn {
+		t.Helper()
+		proxies, err := parseTrustedProxies([]string{trusted})
+		if err != nil {
+			t.Fatalf("failed to parse trusted proxies: %v", err)
+		}
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("failed to listen: %v", err)
+		}
+		t.Cleanup(func() { l.Close() })
+
+		client, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatalf("failed to dial: %v", err)
+		}
+		t.Cleanup(func() { client.Close() })
+		if _, err := client.Write([]byte(sent)); err != nil {
+			t.Fatalf("failed to write: %v", err)
+		}
+
+		conn, err := (&proxyListener{Listener: l, proxies: proxies}).Accept()
+		if err != nil {
+			t.Fatalf("failed to accept: %v", err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		return conn
+	}
+
+	t.Run("trusted proxy", func(t *testing.T) {
+		conn := accept(t, "127.0.0.1", "PROXY TCP4 198.51.100.7 127.0.0.1 52000 25\r\nEHLO client\r\n")
+		if addr := hostFromAddr(conn.RemoteAddr().String()); addr != "198.51.100.7" {
+			t.Errorf("expected the client address of the header, got '%s'", addr)
+		}
+		line, err := bufio.NewReader(conn).ReadString('\n')
+		if err != nil || line != "EHLO client\r\n" {
+			t.Errorf("expected the SMTP session after the header, got %q (%v)", line, err)
+		}
+	})
+
+	t.Run("trusted proxy without header", func(t *testing.T) {
+		conn := accept(t, "127.0.0.1", "EHLO client\r\n")
+		if _, err := conn.Read(make([]byte, 64)); err == nil {
+			t.Error("expected the connection to fail without a PROXY header")
+		}
+	})
+
+	t.Run("untrusted peer", func(t *testing.T) {
+		conn := accept(t, "10.0.0.0/8", "PROXY TCP4 198.51.100.7 127.0.0.1 52000 25\r\n")
+		if addr := hostFromAddr(conn.RemoteAddr().String()); addr != "127.0.0.1" {
+			t.Errorf("expected the header of an untrusted peer to be ignored, got '%s'", addr)
+		}
+	})
+}
+
+func TestSession_DataCharsets(t *testing.T) {
+	authDisabled := false
+	cfg := config.SMTPConfig{Auth: config.AuthConfig{Enabled: &authDisabled}}
+
+	testCases := []struct {
+		name          string
+		content       string
+		expectText    string
+		expectHTML    string
+		expectCharset string
+	}{
+		{
+			name:          "iso-8859-1",
+			content:       "From: a@example.com\nTo: b@example.com\nContent-Type: text/plain; charset=ISO-8859-1\n\nCaf\xe9 ferm\xe9",
+			expectText:    "Café fermé",
+			expectCharset: "iso-8859-1",
+		},
+		{
+			name:          "windows-1252",
+			content:       "From: a@example.com\nTo: b@example.com\nContent-Type: text/plain; charset=windows-1252\n\n\x80 10 \x96 \x93quoted\x94",
+			expectText:    "€ 10 – “quoted”",
+			expectCharset: "windows-1252",
+		},
+		{
+			name:          "shift_jis",
+			content:       "From: a@example.com\nTo: b@example.com\nContent-Type: text/plain; charset=Shift_JIS\n\n\x93\xfa\x96\x7b",
+			expectText:    "日本",
+			expectCharset: "shift_jis",
+		},
+		{
+			name:          "utf-8 is kept as is",
+			content:       "From: a@example.com\nTo: b@example.com\nContent-Type: text/plain; charset=utf-8\n\nCafé",
+			expectText:    "Café",
+			expectCharset: "utf-8",
+		},
+		{
+			name:          "unknown charset is kept as is",
+			content:       "From: a@example.com\nTo: b@example.com\nContent-Type: text/plain; charset=x-unknown\n\nplain",
+			expectText:    "plain",
+			expectCharset: "x-unknown",
+		},
+		{
+			name: "multipart with different charsets",
+			content: "From: a@example.com\nTo: b@example.com\nContent-Type: multipart/alternative; boundary=XX\n\n" +
+				"--XX\nContent-Type: text/plain; charset=iso-8859-1\n\nCaf\xe9\n" +
+				"--XX\nContent-Type: text/html; charset=windows-1252\n\n<p>\x80</p>\n" +
+				"--XX--\n",
+			expectText:    "Café",
+			expectHTML:    "<p>€</p>",
+			expectCharset: "iso-8859-1",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			emailChan := make(chan *Email, 1)
+			s := newTestSession(t, &cfg, false, emailChan)
+
+			if err := s.Data(strings.NewReader(tc.content)); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			e := <-emailChan
+			if strings.TrimSpace(e.Body.Text) != tc.expectText {
+				t.Errorf("expected text body '%s', got '%s'", tc.expectText, e.Body.Text)
+			}
+			if tc.expectHTML != "" && strings.TrimSpace(e.Body.HTML) != tc.expectHTML {
+				t.Errorf("expected HTML body '%s', got '%s'", tc.expectHTML, e.Body.HTML)
+			}
+			if e.Body.TextCharset != tc.expectCharset {
+				t.Errorf("expected charset '%s', got '%s'", tc.expectCharset, e.Body.TextCharset)
+			}
+		})
+	}
+}
+
+func TestSession_SynchronousDelivery(t *testing.T) {
+	authDisabled := false
+	content := "From: from@example.com\nTo: to@example.com\nSubject: Test\n\nbody"
+
+	testCases := []struct {
+		name         string
+		result       error
+		noConsumer   bool
+		expectedCode int
+	}{
+		{
+			name:         "successful delivery is acknowledged",
+			result:       nil,
+			expectedCode: 0,
+		},
+		{
+			name:         "failed delivery returns a temporary error",
+			result:       errors.New("slack is down"),
+			expectedCode: 451,
+		},
+		{
+			name:         "SMTP errors are returned as is",
+			result:       &smtp.SMTPError{Code: 550, Message: "Recipient not found in Slack"},
+			expectedCode: 550,
+		},
+		{
+			name:       "delivery timeout is acknowledged, the delivery going on",
+			noConsumer: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := config.SMTPConfig{
+				Auth:                       config.AuthConfig{Enabled: &authDisabled},
+				SynchronousDelivery:        true,
+				SynchronousDeliveryTimeout: 100 * time.Millisecond,
+			}
+			emailChan := make(chan *Email, 1)
+			s := newTestSession(t, &cfg, false, emailChan)
+
+			if !tc.noConsumer {
+				go func() {
+					e := <-emailChan
+					e.Done(tc.result)
+				}()
+			}
+
+			err := s.Data(strings.NewReader(content))
+			if tc.expectedCode == 0 {
+				if err != nil {
+					t.Errorf("expected no error, got: %v", err)
+				}
+				return
+			}
+
+			var smtpErr *smtp.SMTPError
+			if !errors.As(err, &smtpErr) || smtpErr.Code != tc.expectedCode {
+				t.Errorf("expected SMTP error with code %d, got: %v", tc.expectedCode, err)
+			}
+		})
+	}
+
+	t.Run("asynchronous mode doesn't wait", func(t *testing.T) {
+		cfg := config.SMTPConfig{Auth: config.AuthConfig{Enabled: &authDisabled}}
+		emailChan := make(chan *Email, 1)
+		s := newTestSession(t, &cfg, false, emailChan)
+
+		if err := s.Data(strings.NewReader(content)); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		e := <-emailChan
+		e.Done(errors.New("ignored")) // must not block
+	})
+}
+
+func TestSession_EnqueueTimeout(t *testing.T) {
+	authDisabled := false
+	cfg := config.SMTPConfig{
+		Auth:           config.AuthConfig{Enabled: &authDisabled},
+		EnqueueTimeout: 50 * time.Millisecond,
+	}
+	content := "From: from@example.com\nTo: to@example.com\nSubject: Test\n\nbody"
+
+	// a full queue without a consumer
+	emailChan := make(chan *Email, 1)
+	emailChan <- &Email{}
+	s := newTestSession(t, &cfg, false, emailChan)
+
+	start := time.Now()
+	err := s.Data(strings.NewReader(content))
+	var smtpErr *smtp.SMTPError
+	if !errors.As(err, &smtpErr) || smtpErr.Code != 451 {
+		t.Fatalf("expected a 451 error when the queue is full, got: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < cfg.EnqueueTimeout {
+		t.Errorf("expected to wait for the timeout, only waited %s", elapsed)
+	}
+	if s.messageCount != 0 {
+		t.Errorf("expected rejected email not to be counted, got %d", s.messageCount)
+	}
+
+	// once there's room in the queue, the email is accepted
+	<-emailChan
+	if err := s.Data(strings.NewReader(content)); err != nil {
+		t.Errorf("expected email to be accepted, got: %v", err)
+	}
+}
+
+func TestSession_DataAttachments(t *testing.T) {
+	authDisabled := false
+	cfg := config.SMTPConfig{Auth: config.AuthConfig{Enabled: &authDisabled}}
+
+	content := "From: a@example.com\nTo: b@example.com\nContent-Type: multipart/mixed; boundary=XX\n\n" +
+		"--XX\nContent-Type: text/plain\n\nSee the attached report\n" +
+		"--XX\nContent-Type: text/csv\nContent-Disposition: attachment; filename=\"report.csv\"\nContent-Transfer-Encoding: base64\n\n" +
+		base64.StdEncoding.EncodeToString([]byte("host,status\ndb-1,down\n")) + "\n" +
+		"--XX--\n"
+
+	emailChan := make(chan *Email, 1)
+	s := newTestSession(t, &cfg, false, emailChan)
+
+	if err := s.Data(strings.NewReader(content)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	e := <-emailChan
+	if len(e.Body.Attachments) != 1 {
+		t.Fatalf("expected 1 attachment, got %d", len(e.Body.Attachments))
+	}
+	attachment := e.Body.Attachments[0]
+	if attachment.Filename != "report.csv" || attachment.ContentType != "text/csv" {
+		t.Errorf("unexpected attachment %q (%q)", attachment.Filename, attachment.ContentType)
+	}
+	if !strings.Contains(string(attachment.Data), "db-1,down") {
+		t.Errorf("unexpected attachment data %q", attachment.Data)
+	}
+}
+
+func TestSession_DataCalendar(t *testing.T) {
+	authDisabled := false
+	cfg := config.SMTPConfig{Auth: config.AuthConfig{Enabled: &authDisabled}}
+
+	ics := "BEGIN:VCALENDAR\r\nMETHOD:REQUEST\r\nBEGIN:VEVENT\r\nSUMMARY:Weekly sync\r\nDTSTART:20240105T100000Z\r\nEND:VEVENT\r\nEND:VCALENDAR\r\n"
+	content := "From: a@example.com\nTo: b@example.com\nSubject: Invitation: Weekly sync\n" +
+		"Content-Type: multipart/mixed; boundary=OUTER\n\n" +
+		"--OUTER\nContent-Type: multipart/alternative; boundary=INNER\n\n" +
+		"--INNER\nContent-Type: text/plain; charset=utf-8\n\nYou have been invited\n" +
+		"--INNER\nContent-Type: text/calendar; charset=utf-8; method=REQUEST\nContent-Transfer-Encoding: base64\n\n" +
+		base64.StdEncoding.EncodeToString([]byte(ics)) + "\n" +
+		"--INNER--\n" +
+		"--OUTER--\n"
+
+	emailChan := make(chan *Email, 1)
+	s := newTestSession(t, &cfg, false, emailChan)
+
+	if err := s.Data(strings.NewReader(content)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	select {
+	case e := <-emailChan:
+		if e.Body.Calendar != ics {
+			t.Errorf("expected calendar %q, got %q", ics, e.Body.Calendar)
+		}
+		if e.Body.Text != "You have been invited" {
+			t.Errorf("expected text body %q, got %q", "You have been invited", e.Body.Text)
+		}
+		if e.Subject != "Invitation: Weekly sync" || e.From != "a@example.com" {
+			t.Errorf("unexpected headers: from %q, subject %q", e.From, e.Subject)
+		}
+	default:
+		t.Fatal("expected the invite to be queued")
+	}
+}
+
+func TestSession_DataDeliveryStatus(t *testing.T) {
+	authDisabled := false
+	cfg := config.SMTPConfig{Auth: config.AuthConfig{Enabled: &authDisabled}}
+
+	status := "Reporting-MTA: dns; mx.example.com\n\n" +
+		"Final-Recipient: rfc822; nobody@example.org\nAction: failed\nStatus: 5.1.1\n" +
+		"Diagnostic-Code: smtp; 550 5.1.1 User unknown\n"
+	content := "From: MAILER-DAEMON@mx.example.com\nTo: alerts@example.com\nSubject: Undelivered Mail Returned to Sender\n" +
+		"Content-Type: multipart/report; report-type=delivery-status; boundary=REPORT\n\n" +
+		"--REPORT\nContent-Type: text/plain; charset=us-ascii\n\nI'm sorry to have to inform you that your message could not be delivered.\n" +
+		"--REPORT\nContent-Type: message/delivery-status\n\n" + status +
+		"--REPORT\nContent-Type: message/rfc822\n\nFrom: alerts@example.com\nTo: nobody@example.org\nSubject: Disk full\n\nbody\n" +
+		"--REPORT--\n"
+
+	emailChan := make(chan *Email, 1)
+	s := newTestSession(t, &cfg, false, emailChan)
+
+	if err := s.Data(strings.NewReader(content)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	select {
+	case e := <-emailChan:
+		// the parts of a multipart body don't include the line break before the boundary
+		if e.Body.DeliveryStatus != strings.TrimSuffix(status, "\n") {
+			t.Errorf("expected delivery status %q, got %q", status, e.Body.DeliveryStatus)
+		}
+		if e.Subject != "Undelivered Mail Returned to Sender" || e.From != "MAILER-DAEMON@mx.example.com" {
+			t.Errorf("unexpected headers: from %q, subject %q", e.From, e.Subject)
+		}
+	default:
+		t.Fatal("expected the bounce to be queued")
+	}
+}
+
+func TestSession_DataHeaders(t *testing.T) {
+	authDisabled := false
+	cfg := config.SMTPConfig{Auth: config.AuthConfig{Enabled: &authDisabled}}
+
+	content := "Received: from mx1.example.com\n\tby mx2.example.com\n" +
+		"Received: from client.example.com by mx1.example.com\n" +
+		"Message-ID: <1234@example.com>\n" +
+		"From: a@example.com\nTo: b@example.com\nSubject: Hello\n\nBody\n"
+
+	emailChan := make(chan *Email, 1)
+	s := newTestSession(t, &cfg, false, emailChan)
+
+	if err := s.Data(strings.NewReader(content)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	select {
+	case e := <-emailChan:
+		if got := e.Body.Header.Get("Message-Id"); got != "<1234@example.com>" {
+			t.Errorf("expected Message-ID %q, got %q", "<1234@example.com>", got)
+		}
+		received := e.Body.Header["Received"]
+		if len(received) != 2 || received[0] != "from mx1.example.com by mx2.example.com" {
+			t.Errorf("unexpected Received headers: %q", received)
+		}
+	default:
+		t.Fatal("expected the email to be queued")
+	}
+}
+
+func TestSession_TrustAllowedSenders(t *testing.T) {
+	authDisabled := false
+
+	testCases := []struct {
+		name          string
+		trust         bool
+		from          string
+		to            string
+		expectRcptErr bool
+	}{
+		{
+			name:  "allowed sender bypasses the recipient policy",
+			trust: true,
+			from:  "monitoring@corp.com",
+			to:    "anyone@example.com",
+		},
+		{
+			name:          "sender allowed by default action is not trusted",
+			trust:         true,
+			from:          "someone@corp.com",
+			to:            "anyone@example.com",
+			expectRcptErr: true,
+		},
+		{
+			name:          "bypass disabled",
+			from:          "monitoring@corp.com",
+			to:            "anyone@example.com",
+			expectRcptErr: true,
+		},
+		{
+			name:  "recipients allowed by policy are still accepted",
+			trust: true,
+			from:  "someone@corp.com",
+			to:    "bob@corp.com",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := config.SMTPConfig{
+				Auth:                config.AuthConfig{Enabled: &authDisabled},
+				TrustAllowedSenders: tc.trust,
+			}
+			cfg.Policies.From = config.Policy{DefaultAction: PolicyAllow, Allow: []string{"monitoring@corp.com"}}
+			cfg.Policies.To = config.Policy{DefaultAction: PolicyDeny, Allow: []string{"bob@corp.com"}}
+
+			s := newTestSession(t, &cfg, false, nil)
+			if err := s.Mail(tc.from, nil); err != nil {
+				t.Fatalf("unexpected sender error: %v", err)
+			}
+			err := s.Rcpt(tc.to, nil)
+			if tc.expectRcptErr && err == nil {
+				t.Error("expected the recipient to be rejected")
+			}
+			if !tc.expectRcptErr && err != nil {
+				t.Errorf("expected the recipient to be accepted, got: %v", err)
+			}
+		})
+	}
+
+	t.Run("trust doesn't carry over to the next message", func(t *testing.T) {
+		cfg := config.SMTPConfig{
+			Auth:                config.AuthConfig{Enabled: &authDisabled},
+			TrustAllowedSenders: true,
+		}
+		cfg.Policies.From = config.Policy{DefaultAction: PolicyAllow, Allow: []string{"monitoring@corp.com"}}
+		cfg.Policies.To = config.Policy{DefaultAction: PolicyDeny}
+
+		s := newTestSession(t, &cfg, false, nil)
+		if err := s.Mail("monitoring@corp.com", nil); err != nil {
+			t.Fatalf("unexpected sender error: %v", err)
+		}
+		if err := s.Mail("someone@corp.com", nil); err != nil {
+			t.Fatalf("unexpected sender error: %v", err)
+		}
+		if err := s.Rcpt("anyone@example.com", nil); err == nil {
+			t.Error("expected the recipient to be rejected")
+		}
+	})
+}
+
+func TestListenRetries(t *testing.T) {
+	// occupy a port
+	occupied, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	addr := occupied.Addr().String()
+
+	t.Run("gives up once the retries are exhausted", func(t *testing.T) {
+		var delays []time.Duration
+		_, err := listen(addr, 2, 10*time.Millisecond, func(d time.Duration) { delays = append(delays, d) })
+		if err == nil {
+			t.Fatal("expected binding an occupied port to fail")
+		}
+		if len(delays) != 2 || delays[0] != 10*time.Millisecond || delays[1] != 20*time.Millisecond {
+			t.Errorf("unexpected retry delays %v", delays)
+		}
+	})
+
+	t.Run("binds once the port is released", func(t *testing.T) {
+		attempts := 0
+		l, err := listen(addr, 5, time.Millisecond, func(time.Duration) {
+			attempts++
+			if attempts == 2 {
+				occupied.Close()
+			}
+		})
+		if err != nil {
+			t.Fatalf("expected the port to be bound after it was released, got: %v", err)
+		}
+		defer l.Close()
+		if attempts != 2 {
+			t.Errorf("expected 2 retries, got %d", attempts)
+		}
+	})
+}
+
+func TestNewServerLogLevel(t *testing.T) {
+	authDisabled := false
+
+	testCases := []struct {
+		name           string
+		serverLogLevel string
+		logLevel       logger.LogLevel
+		expected       string
+	}{
+		{name: "errors by default", logLevel: logger.LevelInfo, expected: "ERROR: smtp/server: accept failed\n"},
+		{name: "debug hidden at info", serverLogLevel: "debug", logLevel: logger.LevelInfo, expected: ""},
+		{name: "debug shown at debug", serverLogLevel: "debug", logLevel: logger.LevelDebug, expected: "DEBUG: smtp/server: accept failed\n"},
+		{name: "trace shown at trace", serverLogLevel: "TRACE", logLevel: logger.LevelTrace, expected: "TRACE: smtp/server: accept failed\n"},
+	}
+
+	originalLevel := logger.GetLogLevel()
+	originalFlags := log.Flags()
+	t.Cleanup(func() {
+		logger.SetLogLevel(originalLevel)
+		logger.SetOutput(os.Stdout)
+		log.SetFlags(originalFlags)
+	})
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := config.SMTPConfig{
+				Auth:           config.AuthConfig{Enabled: &authDisabled},
+				ServerLogLevel: tc.serverLogLevel,
+			}
+			s, _, err := NewServer(cfg, nil)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			logger.SetLogLevel(tc.logLevel)
+			var buf bytes.Buffer
+			logger.SetOutput(&buf)
+			log.SetFlags(0)
+
+			s.ErrorLog.Printf("accept failed")
+			if buf.String() != tc.expected {
+				t.Errorf("expected %q, got %q", tc.expected, buf.String())
+			}
+		})
+	}
+}
+
+func TestIsHighPriority(t *testing.T) {
+	testCases := []struct {
+		name     string
+		header   mail.Header
+		expected bool
+	}{
+		{name: "highest x-priority", header: mail.Header{"X-Priority": {"1 (Highest)"}}, expected: true},
+		{name: "high x-priority", header: mail.Header{"X-Priority": {"2"}}, expected: true},
+		{name: "normal x-priority", header: mail.Header{"X-Priority": {"3 (Normal)"}}, expected: false},
+		{name: "low x-priority", header: mail.Header{"X-Priority": {"5 (Lowest)"}}, expected: false},
+		{name: "high importance", header: mail.Header{"Importance": {"High"}}, expected: true},
+		{name: "normal importance", header: mail.Header{"Importance": {"normal"}}, expected: false},
+		{name: "urgent priority", header: mail.Header{"Priority": {"urgent"}}, expected: true},
+		{name: "no priority", header: mail.Header{}, expected: false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := isHighPriority(tc.header); got != tc.expected {
+				t.Errorf("expected %v, got %v", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestDecodeTransfer(t *testing.T) {
+	testCases := []struct {
+		name      string
+		body      string
+		encoding  string
+		expected  string
+		expectErr bool
+	}{
+		{name: "no encoding", body: "Hello", expected: "Hello"},
+		{name: "7bit with 8-bit characters", body: "Caf\xc3\xa9", encoding: "7bit", expected: "Caf\xc3\xa9"},
+		{name: "base64", body: "SGVsbG8gd29ybGQ=", encoding: "base64", expected: "Hello world"},
+		{name: "base64 case and spaces", body: "SGVs\r\nbG8gd29y\r\nbGQ=\r\n", encoding: " Base64 ", expected: "Hello world"},
+		{name: "base64 without padding", body: "SGVsbG8gd29ybGQ", encoding: "base64", expected: "Hello world"},
+		{name: "broken base64", body: "Hello world!", encoding: "base64", expected: "Hello world!", expectErr: true},
+		{name: "quoted-printable", body: "Caf=C3=A9 =\r\nau lait", encoding: "quoted-printable", expected: "Café au lait"},
+		{name: "invalid quoted-printable escapes kept", body: "100% =ZZ", encoding: "quoted-printable", expected: "100% =ZZ"},
+		{name: "unsupported encoding", body: "begin 644 file", encoding: "x-uuencode", expected: "begin 644 file", expectErr: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := decodeTransfer(tc.body, tc.encoding)
+			if (err != nil) != tc.expectErr {
+				t.Fatalf("expected error %v, got '%v'", tc.expectErr, err)
+			}
+			if got != tc.expected {
+				t.Errorf("expected %q, got %q", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestSession_DataUndecodableBody(t *testing.T) {
+	authDisabled := false
+	const msg = "From: a@example.com\nTo: b@example.com\nSubject: Hello\nContent-Transfer-Encoding: base64\n\nNot base64!\n"
+
+	testCases := []struct {
+		name            string
+		undecodableBody string
+		expectCode      int
+	}{
+		{name: "delivered as is"},
+		{name: "delivered as is when configured", undecodableBody: UndecodableBodyRaw},
+		{name: "rejected", undecodableBody: UndecodableBodyReject, expectCode: 550},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := config.SMTPConfig{Auth: config.AuthConfig{Enabled: &authDisabled}, UndecodableBody: tc.undecodableBody}
+			emailChan := make(chan *Email, 1)
+			s := newTestSession(t, &cfg, false, emailChan)
+
+			err := s.Data(strings.NewReader(msg))
+			if tc.expectCode != 0 {
+				var smtpErr *smtp.SMTPError
+				if !errors.As(err, &smtpErr) || smtpErr.Code != tc.expectCode {
+					t.Fatalf("expected a %d error, got '%v'", tc.expectCode, err)
+				}
+				if len(emailChan) != 0 {
+					t.Error("expected the email not to be queued")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			select {
+			case e := <-emailChan:
+				if e.Body.Text != "Not base64!" {
+					t.Errorf("expected the raw body, got %q", e.Body.Text)
+				}
+			default:
+				t.Fatal("expected the email to be queued")
+			}
+		})
+	}
+}
+
+func TestListID(t *testing.T) {
+	testCases := []struct {
+		name     string
+		header   mail.Header
+		expected string
+	}{
+		{name: "quoted description", header: mail.Header{"List-Id": {`"Announcements" <announce.example.com>`}}, expected: "Announcements <announce.example.com>"},
+		{name: "unquoted description", header: mail.Header{"List-Id": {"Dev list <dev.lists.example.org>"}}, expected: "Dev list <dev.lists.example.org>"},
+		{name: "identifier only", header: mail.Header{"List-Id": {"<ops.example.com>"}}, expected: "<ops.example.com>"},
+		{name: "folded", header: mail.Header{"List-Id": {"\"Release\r\n notes\"\r\n <releases.example.com>"}}, expected: "Release notes <releases.example.com>"},
+		{name: "no brackets", header: mail.Header{"List-Id": {" ops.example.com "}}, expected: "ops.example.com"},
+		{name: "no list", header: mail.Header{}, expected: ""},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := listID(tc.header); got != tc.expected {
+				t.Errorf("expected %q, got %q", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestSession_DataPriority(t *testing.T) {
+	authDisabled := false
+	cfg := config.SMTPConfig{Auth: config.AuthConfig{Enabled: &authDisabled}}
+
+	testCases := []struct {
+		name     string
+		headers  string
+		expected bool
+	}{
+		{name: "high priority", headers: "X-Priority: 1 (Highest)\nImportance: High\n", expected: true},
+		{name: "normal priority", headers: "X-Priority: 3\n", expected: false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			emailChan := make(chan *Email, 1)
+			s := newTestSession(t, &cfg, false, emailChan)
+
+			content := tc.headers + "From: a@example.com\nTo: b@example.com\nSubject: Disk full\n\nBody\n"
+			if err := s.Data(strings.NewReader(content)); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			e := <-emailChan
+			if e.Body.HighPriority != tc.expected {
+				t.Errorf("expected high priority %v, got %v", tc.expected, e.Body.HighPriority)
+			}
+		})
+	}
+}
+
+func TestSession_DataBccOnly(t *testing.T) {
+	authDisabled := false
+
+	testCases := []struct {
+		name        string
+		bccOnly     string
+		headers     string
+		expectQueue bool
+		expectTo    []string
+		expectBcc   []string
+	}{
+		{
+			name:    "skipped by default",
+			headers: "From: a@example.com\nSubject: Hello\n",
+		},
+		{
+			name:        "delivered to the envelope recipients",
+			bccOnly:     BccOnlyDeliver,
+			headers:     "From: a@example.com\nSubject: Hello\n",
+			expectQueue: true,
+			expectBcc:   []string{"b@example.com", "c@example.com"},
+		},
+		{
+			name:        "header recipients are used when present",
+			bccOnly:     BccOnlyDeliver,
+			headers:     "From: a@example.com\nTo: b@example.com\nSubject: Hello\n",
+			expectQueue: true,
+			expectTo:    []string{"b@example.com"},
+		},
+		{
+			name:    "not Bcc only with Cc recipients",
+			bccOnly: BccOnlyDeliver,
+			headers: "From: a@example.com\nCc: b@example.com\nSubject: Hello\n",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := config.SMTPConfig{Auth: config.AuthConfig{Enabled: &authDisabled}, BccOnly: tc.bccOnly}
+			cfg.Policies.To.DefaultAction = PolicyAllow
+			emailChan := make(chan *Email, 1)
+			s := newTestSession(t, &cfg, false, emailChan)
+
+			for _, rcpt := range []string{"b@example.com", "c@example.com"} {
+				if err := s.Rcpt(rcpt, nil); err != nil {
+					t.Fatalf("unexpected Rcpt error: %v", err)
+				}
+			}
+			if err := s.Data(strings.NewReader(tc.headers + "\nBody\n")); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			s.Reset()
+
+			select {
+			case e := <-emailChan:
+				if !tc.expectQueue {
+					t.Fatalf("expected the email to be skipped, got %+v", e)
+				}
+				if fmt.Sprint(e.To) != fmt.Sprint(tc.expectTo) || fmt.Sprint(e.Bcc) != fmt.Sprint(tc.expectBcc) {
+					t.Errorf("expected to %v and bcc %v, got %v and %v", tc.expectTo, tc.expectBcc, e.To, e.Bcc)
+				}
+			default:
+				if tc.expectQueue {
+					t.Fatal("expected the email to be queued")
+				}
+			}
+
+			// the envelope recipients don't carry over to the next message
+			if len(s.rcpts) != 0 {
+				t.Errorf("expected the envelope recipients to be reset, got %v", s.rcpts)
+			}
+		})
+	}
+}
+
+// createTempCertificate writes a self-signed certificate for 127.0.0.1 and its key,
+// returning their paths and a pool trusting the certificate.
+func createTempCertificate(t *testing.T) (string, string, *x509.CertPool) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %v", err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("failed to marshal key: %v", err)
+	}
+
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatalf("failed to write certificate: %v", err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		t.Fatalf("failed to write key: %v", err)
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("failed to parse certificate: %v", err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return certFile, keyFile, pool
+}
+
+func TestServeTLS(t *testing.T) {
+	authDisabled := false
+	certFile, keyFile, pool := createTempCertificate(t)
+
+	testCases := []struct {
+		name string
+		mode string
+		dial func(addr string, cfg *tls.Config) (*smtp.Client, error)
+	}{
+		{name: "starttls", mode: TLSModeStartTLS, dial: smtp.DialStartTLS},
+		{name: "implicit", mode: TLSModeImplicit, dial: smtp.DialTLS},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := config.SMTPConfig{
+				Auth: config.AuthConfig{Enabled: &authDisabled},
+				TLS:  config.TLSConfig{Mode: tc.mode, CertFile: certFile, KeyFile: keyFile},
+			}
+			cfg.Policies.From.DefaultAction = "allow"
+			cfg.Policies.To.DefaultAction = "allow"
+			server, emailChan, err := NewServer(cfg, nil)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatalf("failed to listen: %v", err)
+			}
+			go server.Serve(wrapListener(l, server, tc.mode))
+			t.Cleanup(func() { server.Close() })
+
+			client, err := tc.dial(l.Addr().String(), &tls.Config{RootCAs: pool})
+			if err != nil {
+				t.Fatalf("failed to connect: %v", err)
+			}
+			defer client.Close()
+
+			if _, ok := client.TLSConnectionState(); !ok {
+				t.Fatal("expected the connection to be over TLS")
+			}
+			// the connection is already over TLS, it can't be upgraded again
+			if ok, _ := client.Extension("STARTTLS"); ok {
+				t.Error("expected STARTTLS not to be offered over TLS")
+			}
+
+			msg := "From: alice@example.com\r\nTo: bob@example.com\r\nSubject: Over TLS\r\n\r\nHello\r\n"
+			if err := client.SendMail("alice@example.com", []string{"bob@example.com"}, strings.NewReader(msg)); err != nil {
+				t.Fatalf("failed to send mail: %v", err)
+			}
+
+			select {
+			case e := <-emailChan:
+				if e.Subject != "Over TLS" {
+					t.Errorf("expected subject %q, got %q", "Over TLS", e.Subject)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("timed out waiting for the email")
+			}
+		})
+	}
+
+	t.Run("plain connections are refused with implicit TLS", func(t *testing.T) {
+		cfg := config.SMTPConfig{
+			Auth: config.AuthConfig{Enabled: &authDisabled},
+			TLS:  config.TLSConfig{Mode: TLSModeImplicit, CertFile: certFile, KeyFile: keyFile},
+		}
+		server, _, err := NewServer(cfg, nil)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		server.ReadTimeout = time.Second
+
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("failed to listen: %v", err)
+		}
+		go server.Serve(wrapListener(l, server, TLSModeImplicit))
+		t.Cleanup(func() { server.Close() })
+
+		conn, err := net.DialTimeout("tcp", l.Addr().String(), time.Second)
+		if err != nil {
+			t.Fatalf("failed to connect: %v", err)
+		}
+		defer conn.Close()
+		client := smtp.NewClient(conn)
+		conn.SetDeadline(time.Now().Add(2 * time.Second))
+		if err := client.Hello("localhost"); err == nil {
+			t.Error("expected the plain text greeting to fail")
+		}
+	})
+
+	t.Run("missing certificate", func(t *testing.T) {
+		cfg := config.SMTPConfig{
+			Auth: config.AuthConfig{Enabled: &authDisabled},
+			TLS:  config.TLSConfig{Mode: TLSModeImplicit, CertFile: filepath.Join(t.TempDir(), "missing.pem"), KeyFile: keyFile},
+		}
+		if _, _, err := NewServer(cfg, nil); err == nil || !strings.Contains(err.Error(), "failed to load TLS certificate") {
+			t.Errorf("expected a certificate error, got %v", err)
+		}
+	})
+}
+
+// fakeResolver answers the lookups of the listed names, the others being not found.
+type fakeResolver struct {
+	answers   map[string][]string
+	err       error
+	lookups   []string
+	deadlines []time.Time
+}
+
+func (r *fakeResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	r.lookups = append(r.lookups, host)
+	deadline, _ := ctx.Deadline()
+	r.deadlines = append(r.deadlines, deadline)
+	if r.err != nil {
+		return nil, r.err
+	}
+	if answers, ok := r.answers[host]; ok {
+		return answers, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+}
+
+func TestReverseIP(t *testing.T) {
+	testCases := []struct {
+		ip       string
+		expected string
+	}{
+		{ip: "192.0.2.99", expected: "99.2.0.192"},
+		{ip: "::ffff:192.0.2.99", expected: "99.2.0.192"},
+		{ip: "2001:db8::1", expected: "1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.ip, func(t *testing.T) {
+			if got := reverseIP(net.ParseIP(tc.ip)); got != tc.expected {
+				t.Errorf("expected %q, got %q", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestDNSBLListed(t *testing.T) {
+	testCases := []struct {
+		name            string
+		host            string
+		answers         map[string][]string
+		err             error
+		expectedZone    string
+		expectedListed  bool
+		expectedLookups []string
+	}{
+		{
+			name:            "not listed",
+			host:            "192.0.2.99",
+			expectedLookups: []string{"99.2.0.192.zen.example.org", "99.2.0.192.bl.example.net"},
+		},
+		{
+			name:            "listed",
+			host:            "192.0.2.99",
+			answers:         map[string][]string{"99.2.0.192.zen.example.org": {"127.0.0.2"}},
+			expectedZone:    "zen.example.org",
+			expectedListed:  true,
+			expectedLookups: []string{"99.2.0.192.zen.example.org"},
+		},
+		{
+			name:            "listed in the second zone",
+			host:            "192.0.2.99",
+			answers:         map[string][]string{"99.2.0.192.bl.example.net": {"127.0.0.4"}},
+			expectedZone:    "bl.example.net",
+			expectedListed:  true,
+			expectedLookups: []string{"99.2.0.192.zen.example.org", "99.2.0.192.bl.example.net"},
+		},
+		{
+			name:            "query error answer",
+			host:            "192.0.2.99",
+			answers:         map[string][]string{"99.2.0.192.zen.example.org": {"127.255.255.254"}},
+			expectedLookups: []string{"99.2.0.192.zen.example.org", "99.2.0.192.bl.example.net"},
+		},
+		{
+			name:            "lookup failure",
+			host:            "192.0.2.99",
+			err:             &net.DNSError{Err: "i/o timeout", IsTimeout: true},
+			expectedLookups: []string{"99.2.0.192.zen.example.org", "99.2.0.192.bl.example.net"},
+		},
+		{
+			name: "private IP",
+			host: "10.0.0.1",
+		},
+		{
+			name: "loopback IP",
+			host: "127.0.0.1",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			r := &fakeResolver{answers: tc.answers, err: tc.err}
+			checker := newDNSBLChecker([]string{"zen.example.org", "bl.example.net."}, time.Second, 0, 0)
+			checker.resolver = r
+
+			zone, listed := checker.listed(tc.host)
+			if zone != tc.expectedZone || listed != tc.expectedListed {
+				t.Errorf("expected (%q, %v), got (%q, %v)", tc.expectedZone, tc.expectedListed, zone, listed)
+			}
+			if strings.Join(r.lookups, ",") != strings.Join(tc.expectedLookups, ",") {
+				t.Errorf("expected lookups %v, got %v", tc.expectedLookups, r.lookups)
+			}
+		})
+	}
+}
+
+func TestDNSBLCache(t *testing.T) {
+	r := &fakeResolver{answers: map[string][]string{"99.2.0.192.bl.example.net": {"127.0.0.2"}}}
+	checker := newDNSBLChecker([]string{"zen.example.org", "bl.example.net"}, time.Second, time.Minute, 100)
+	checker.resolver = r
+	now := time.Now()
+	checker.results.Now = func() time.Time { return now }
+
+	// the results of each zone are cached, listed or not
+	for i := 0; i < 2; i++ {
+		if zone, listed := checker.listed("192.0.2.99"); !listed || zone != "bl.example.net" {
+			t.Fatalf("expected the IP to be listed in 'bl.example.net', got (%q, %v)", zone, listed)
+		}
+	}
+	if len(r.lookups) != 2 {
+		t.Errorf("expected the IP to be looked up once per zone, got %v", r.lookups)
+	}
+
+	// until they expire
+	now = now.Add(time.Minute)
+	checker.listed("192.0.2.99")
+	if len(r.lookups) != 4 {
+		t.Errorf("expected the IP to be looked up again once expired, got %v", r.lookups)
+	}
+
+	// failed lookups aren't cached
+	r.err = &net.DNSError{Err: "i/o timeout", IsTimeout: true}
+	checker.listed("192.0.2.100")
+	checker.listed("192.0.2.100")
+	if len(r.lookups) != 8 {
+		t.Errorf("expected the failed lookups to be retried, got %v", r.lookups)
+	}
+}
+
+func TestDNSBLTimeout(t *testing.T) {
+	r := &fakeResolver{}
+	checker := newDNSBLChecker([]string{"zen.example.org", "bl.example.net"}, time.Second, 0, 0)
+	checker.resolver = r
+
+	start := time.Now()
+	checker.listed("192.0.2.99")
+
+	// the timeout caps the lookups in all the zones, not each of them
+	if len(r.deadlines) != 2 || r.deadlines[0].IsZero() || !r.deadlines[0].Equal(r.deadlines[1]) {
+		t.Fatalf("expected the lookups to share a single deadline, got %v", r.deadlines)
+	}
+	if r.deadlines[0].After(start.Add(time.Second + 100*time.Millisecond)) {
+		t.Errorf("expected the deadline within the timeout, got %v", r.deadlines[0].Sub(start))
+	}
+}
+
+func TestSession_DNSBL(t *testing.T) {
+	authEnabled := true
+	authDisabled := false
+	r := &fakeResolver{answers: map[string][]string{"99.2.0.192.zen.example.org": {"127.0.0.2"}}}
+	checker := newDNSBLChecker([]string{"zen.example.org"}, time.Second, 0, 0)
+	checker.resolver = r
+
+	testCases := []struct {
+		name          string
+		authEnabled   *bool
+		authenticated bool
+		remoteAddr    string
+		expectedCode  int
+	}{
+		{name: "listed client is rejected", authEnabled: &authDisabled, remoteAddr: "192.0.2.99:12345", expectedCode: 554},
+		{name: "unlisted client is accepted", authEnabled: &authDisabled, remoteAddr: "192.0.2.100:12345"},
+		{name: "authenticated client is accepted", authEnabled: &authEnabled, authenticated: true, remoteAddr: "192.0.2.99:12345"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := config.SMTPConfig{Auth: config.AuthConfig{Enabled: tc.authEnabled}}
+			cfg.Policies.From.DefaultAction = PolicyAllow
+			cfg.Policies.To.DefaultAction = PolicyAllow
+
+			s := newTestSession(t, &cfg, tc.authenticated, nil)
+			s.dnsbl = checker
+			s.remoteAddr = tc.remoteAddr
+
+			err := s.Mail("from@example.com", nil)
+			if tc.expectedCode == 0 {
+				if err != nil {
+					t.Errorf("expected Mail to be accepted, got: %v", err)
+				}
+				return
+			}
+
+			var smtpErr *smtp.SMTPError
+			if !errors.As(err, &smtpErr) || smtpErr.Code != tc.expectedCode {
+				t.Fatalf("expected a %d error, got: %v", tc.expectedCode, err)
+			}
+			if smtpErr.EnhancedCode != (smtp.EnhancedCode{5, 7, 1}) {
+				t.Errorf("expected enhanced code 5.7.1, got %v", smtpErr.EnhancedCode)
+			}
+			if !strings.Contains(smtpErr.Message, "zen.example.org") {
+				t.Errorf("expected the zone in the message, got %q", smtpErr.Message)
+			}
+		})
+	}
+}
+
+func TestParseEmail(t *testing.T) {
+	testCases := []struct {
+		name         string
+		emailContent string
+		expectSkip   SkipReason
+		checkEmail   func(*testing.T, *Email)
+	}{
+		{
+			name:         "headers and body",
+			emailContent: "From: Alerts <alerts@example.com>\nTo: alice@example.com, bob@example.com\nCc: carol@example.com\nSubject: Disk full\n\nThe disk is full.\n",
+			checkEmail: func(t *testing.T, e *Email) {
+				if e.From != "alerts@example.com" {
+					t.Errorf("expected From 'alerts@example.com', got '%s'", e.From)
+				}
+				if !reflect.DeepEqual(e.To, []string{"alice@example.com", "bob@example.com"}) {
+					t.Errorf("unexpected To %v", e.To)
+				}
+				if !reflect.DeepEqual(e.Cc, []string{"carol@example.com"}) {
+					t.Errorf("unexpected Cc %v", e.Cc)
+				}
+				if len(e.Bcc) != 0 {
+					t.Errorf("expected no Bcc, got %v", e.Bcc)
+				}
+				if e.Subject != "Disk full" {
+					t.Errorf("expected Subject 'Disk full', got '%s'", e.Subject)
+				}
+				if !strings.Contains(e.Body.Text, "The disk is full.") {
+					t.Errorf("unexpected text body %q", e.Body.Text)
+				}
+				if !strings.HasPrefix(string(e.Body.Raw), "From: Alerts <alerts@example.com>\n") {
+					t.Errorf("expected the raw email to be kept, got %q", e.Body.Raw)
+				}
+				if e.Body.Header.Get("Subject") != "Disk full" {
+					t.Errorf("expected the headers to be kept, got %v", e.Body.Header)
+				}
+			},
+		},
+		{
+			name:         "base64 body",
+			emailContent: "From: alerts@example.com\nTo: alice@example.com\nSubject: Disk full\nContent-Type: text/plain; charset=utf-8\nContent-Transfer-Encoding: base64\n\nVGhlIGRpc2sg\naXMgZnVsbC4\n",
+			checkEmail: func(t *testing.T, e *Email) {
+				if e.Body.Text != "The disk is full." {
+					t.Errorf("unexpected text body %q", e.Body.Text)
+				}
+			},
+		},
+		{
+			name:         "quoted-printable body",
+			emailContent: "From: alerts@example.com\nTo: alice@example.com\nSubject: Disk full\nContent-Type: text/plain; charset=utf-8\nContent-Transfer-Encoding: quoted-printable\n\nCaf=C3=A9 disk is =\nfull.\n",
+			checkEmail: func(t *testing.T, e *Email) {
+				if e.Body.Text != "Café disk is full." {
+					t.Errorf("unexpected text body %q", e.Body.Text)
+				}
+			},
+		},
+		{
+			name:         "base64 multipart bodies",
+			emailContent: "From: alerts@example.com\nTo: alice@example.com\nSubject: Disk full\nMIME-Version: 1.0\nContent-Type: multipart/alternative; boundary=XX\n\n--XX\nContent-Type: text/plain\nContent-Transfer-Encoding: base64\n\nRnVsbA==\n--XX\nContent-Type: text/html\nContent-Transfer-Encoding: quoted-printable\n\n<b>Full=21</b>\n--XX--\n",
+			checkEmail: func(t *testing.T, e *Email) {
+				if e.Body.Text != "Full" || e.Body.HTML != "<b>Full!</b>" {
+					t.Errorf("unexpected bodies %q and %q", e.Body.Text, e.Body.HTML)
+				}
+				if len(e.UndecodableBodies) != 0 {
+					t.Errorf("expected the bodies to be decoded, got %v", e.UndecodableBodies)
+				}
+			},
+		},
+		{
+			name:         "broken base64 body kept as is",
+			emailContent: "From: alerts@example.com\nTo: alice@example.com\nSubject: Disk full\nMIME-Version: 1.0\nContent-Type: multipart/alternative; boundary=XX\n\n--XX\nContent-Type: text/plain\nContent-Transfer-Encoding: base64\n\nThe disk is full!\n--XX\nContent-Type: text/html\nContent-Transfer-Encoding: base64\n\nPGI+RnVsbDwvYj4=\n--XX--\n",
+			checkEmail: func(t *testing.T, e *Email) {
+				if e.Body.Text != "The disk is full!" || e.Body.HTML != "<b>Full</b>" {
+					t.Errorf("unexpected bodies %q and %q", e.Body.Text, e.Body.HTML)
+				}
+				if !reflect.DeepEqual(e.UndecodableBodies, []string{"text"}) {
+					t.Errorf("expected the text body to be undecodable, got %v", e.UndecodableBodies)
+				}
+			},
+		},
+		{
+			name:         "8-bit characters in a 7bit body",
+			emailContent: "From: alerts@example.com\nTo: alice@example.com\nSubject: Disk full\nContent-Type: text/plain; charset=utf-8\nContent-Transfer-Encoding: 7bit\n\nCaf\xc3\xa9 disk is full.\n",
+			checkEmail: func(t *testing.T, e *Email) {
+				if e.Body.Text != "Café disk is full." || len(e.UndecodableBodies) != 0 {
+					t.Errorf("unexpected text body %q (undecodable %v)", e.Body.Text, e.UndecodableBodies)
+				}
+			},
+		},
+		{
+			name:         "mailing list",
+			emailContent: "From: alerts@example.com\nTo: alice@example.com\nList-Id: \"Ops alerts\" <ops-alerts.example.com>\nSubject: Disk full\n\nbody",
+			checkEmail: func(t *testing.T, e *Email) {
+				if e.Body.ListID != "Ops alerts <ops-alerts.example.com>" {
+					t.Errorf("unexpected list ID %q", e.Body.ListID)
+				}
+			},
+		},
+		{
+			name:         "no recipient is left to the session",
+			emailContent: "From: alerts@example.com\nSubject: Disk full\n\nbody",
+			checkEmail: func(t *testing.T, e *Email) {
+				if len(e.To) != 0 || len(e.Cc) != 0 {
+					t.Errorf("expected no recipient, got To %v and Cc %v", e.To, e.Cc)
+				}
+			},
+		},
+		{
+			name:         "body decoded from its charset",
+			emailContent: "From: alerts@example.com\nTo: alice@example.com\nContent-Type: text/plain; charset=iso-8859-1\n\nCaf\xe9\n",
+			checkEmail: func(t *testing.T, e *Email) {
+				if !strings.Contains(e.Body.Text, "Café") {
+					t.Errorf("expected the body to be decoded, got %q", e.Body.Text)
+				}
+				if e.Body.TextCharset != "iso-8859-1" {
+					t.Errorf("expected charset 'iso-8859-1', got '%s'", e.Body.TextCharset)
+				}
+			},
+		},
+		{
+			name: "attachments",
+			emailContent: "From: alerts@example.com\nTo: alice@example.com\nContent-Type: multipart/mixed; boundary=MIXED\n\n" +
+				"--MIXED\nContent-Type: text/plain\n\nSee the report.\n" +
+				"--MIXED\nContent-Type: text/csv\nContent-Disposition: attachment; filename=\"report.csv\"\nContent-Transfer-Encoding: base64\n\n" +
+				base64.StdEncoding.EncodeToString([]byte("a,b")) + "\n" +
+				"--MIXED--\n",
+			checkEmail: func(t *testing.T, e *Email) {
+				if len(e.Body.Attachments) != 1 {
+					t.Fatalf("expected 1 attachment, got %d", len(e.Body.Attachments))
+				}
+				if a := e.Body.Attachments[0]; a.Filename != "report.csv" || string(a.Data) != "a,b" {
+					t.Errorf("unexpected attachment %q: %q", a.Filename, a.Data)
+				}
+			},
+		},
+		{
+			name:         "high priority",
+			emailContent: "From: alerts@example.com\nTo: alice@example.com\nX-Priority: 1\n\nbody",
+			checkEmail: func(t *testing.T, e *Email) {
+				if !e.Body.HighPriority {
+					t.Error("expected the email to be flagged as high priority")
+				}
+			},
+		},
+		{
+			name:         "no sender",
+			emailContent: "To: alice@example.com\n\nbody",
+			expectSkip:   SkipNoSender,
+		},
+		{
+			name:         "unparsable",
+			emailContent: "From: alerts@example.com\nTo: alice@example.com\nContent-Type: multipart/mixed\n\nbody",
+			expectSkip:   SkipUnparsable,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			e, err := ParseEmail(strings.NewReader(tc.emailContent))
+
+			if tc.expectSkip != "" {
+				var skipped *ErrSkipped
+				if !errors.As(err, &skipped) {
+					t.Fatalf("expected the email to be skipped, got error '%v'", err)
+				}
+				if skipped.Reason != tc.expectSkip {
+					t.Errorf("expected skip reason '%s', got '%s'", tc.expectSkip, skipped.Reason)
+				}
+				if e != nil {
+					t.Errorf("expected no email, got %+v", e)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			tc.checkEmail(t, e)
+		})
+	}
+}
+
+func TestParseEmailReadError(t *testing.T) {
+	readErr := errors.New("connection reset")
+
+	_, err := ParseEmail(iotest.ErrReader(readErr))
+	if !errors.Is(err, readErr) {
+		t.Errorf("expected the read error, got '%v'", err)
+	}
+	var skipped *ErrSkipped
+	if errors.As(err, &skipped) {
+		t.Error("expected a read error not to skip the email")
+	}
+}
+
+func TestTruncateRawEmail(t *testing.T) {
+	testCases := []struct {
+		name     string
+		raw      string
+		maxBytes int
+		expected string
+	}{
+		{name: "no limit", raw: "Subject: hi\n\nbody", maxBytes: 0, expected: "Subject: hi\n\nbody"},
+		{name: "under the limit", raw: "Subject: hi", maxBytes: 20, expected: "Subject: hi"},
+		{name: "at the limit", raw: "Subject: hi", maxBytes: 11, expected: "Subject: hi"},
+		{name: "over the limit", raw: "Subject: hi\n\nbody", maxBytes: 11, expected: "Subject: hi\n[... 6 more bytes]"},
+		{name: "cut at the start of a character", raw: "Café au lait", maxBytes: 4, expected: "Caf\n[... 10 more bytes]"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := truncateRawEmail([]byte(tc.raw), tc.maxBytes); got != tc.expected {
+				t.Errorf("expected %q, got %q", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestSession_DataRawEmailLog(t *testing.T) {
+	authDisabled := false
+	content := "From: alerts@example.com\nTo: alice@example.com\nSubject: Disk full\n\nThe disk is full.\n"
+
+	testCases := []struct {
+		name        string
+		cfg         config.SMTPConfig
+		redaction   string
+		expected    string
+		notExpected string
+	}{
+		{
+			name:     "logged in full",
+			cfg:      config.SMTPConfig{LogRawEmails: true},
+			expected: "TRACE: Raw email:\n" + content,
+		},
+		{
+			name:        "truncated",
+			cfg:         config.SMTPConfig{LogRawEmails: true, RawEmailLogMaxBytes: 24},
+			expected:    "TRACE: Raw email:\nFrom: alerts@example.com\n[... 61 more bytes]",
+			notExpected: "Disk full",
+		},
+		{
+			name:        "disabled",
+			cfg:         config.SMTPConfig{LogRawEmails: false},
+			notExpected: "Raw email",
+		},
+		{
+			name:        "redacted",
+			cfg:         config.SMTPConfig{LogRawEmails: true},
+			redaction:   logger.RedactMask,
+			expected:    "TRACE: Raw email:\n[redacted, 85 bytes]",
+			notExpected: "Disk full",
+		},
+		{
+			name:        "truncated and redacted",
+			cfg:         config.SMTPConfig{LogRawEmails: true, RawEmailLogMaxBytes: 24},
+			redaction:   logger.RedactMask,
+			expected:    "TRACE: Raw email:\n[redacted, 44 bytes]",
+			notExpected: "85 bytes",
+		},
+	}
+
+	originalLevel := logger.GetLogLevel()
+	originalFlags := log.Flags()
+	t.Cleanup(func() {
+		logger.SetLogLevel(originalLevel)
+		logger.SetOutput(os.Stdout)
+		log.SetFlags(originalFlags)
+	})
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.cfg.Auth = config.AuthConfig{Enabled: &authDisabled}
+			emailChan := make(chan *Email, 1)
+			s := newTestSession(t, &tc.cfg, false, emailChan)
+
+			logger.SetLogLevel(logger.LevelTrace)
+			logger.SetRedaction(tc.redaction)
+			t.Cleanup(func() { logger.SetRedaction(logger.RedactNone) })
+			var buf bytes.Buffer
+			logger.SetOutput(&buf)
+			log.SetFlags(0)
+
+			if err := s.Data(strings.NewReader(content)); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if len(emailChan) != 1 {
+				t.Error("expected the email to be queued")
+			}
+
+			if tc.expected != "" && !strings.Contains(buf.String(), tc.expected) {
+				t.Errorf("expected the log to contain %q, got %q", tc.expected, buf.String())
+			}
+			if tc.notExpected != "" && strings.Contains(buf.String(), tc.notExpected) {
+				t.Errorf("expected the log not to contain %q, got %q", tc.notExpected, buf.String())
+			}
+		})
+	}
+}
+
+func TestParseRecipients(t *testing.T) {
+	testCases := []struct {
+		name          string
+		list          string
+		expectValid   []string
+		expectInvalid []string
+	}{
+		{name: "empty", list: ""},
+		{name: "valid", list: "Alice <alice@example.com>, bob@example.com", expectValid: []string{"alice@example.com", "bob@example.com"}},
+		{name: "group without members", list: "undisclosed-recipients:;"},
+		{
+			name:          "valid and invalid",
+			list:          "alice@example.com, bob@, Carol <carol@example.com>",
+			expectValid:   []string{"alice@example.com", "carol@example.com"},
+			expectInvalid: []string{"bob@"},
+		},
+		{
+			name:          "commas in quotes and comments",
+			list:          `"Doe, John" <john@example.com>, alice@example.com (Alice, ops), not an address`,
+			expectValid:   []string{"john@example.com", "alice@example.com"},
+			expectInvalid: []string{"not an address"},
+		},
+		{
+			name:          "all invalid",
+			list:          "alice, bob@",
+			expectInvalid: []string{"alice", "bob@"},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			valid, invalid := parseRecipients(tc.list)
+			if fmt.Sprint(valid) != fmt.Sprint(tc.expectValid) {
+				t.Errorf("expected valid recipients %v, got %v", tc.expectValid, valid)
+			}
+			if fmt.Sprint(invalid) != fmt.Sprint(tc.expectInvalid) {
+				t.Errorf("expected invalid recipients %v, got %v", tc.expectInvalid, invalid)
+			}
+		})
+	}
+}
+
+func TestSession_DataInvalidRecipients(t *testing.T) {
+	authDisabled := false
+
+	testCases := []struct {
+		name              string
+		invalidRecipients string
+		headers           string
+		expectCode        int
+		expectQueue       bool
+		expectTo          []string
+		expectCc          []string
+	}{
+		{
+			name:        "valid recipients still delivered",
+			headers:     "From: a@example.com\nTo: b@example.com, c@\nSubject: Hello\n",
+			expectQueue: true,
+			expectTo:    []string{"b@example.com"},
+		},
+		{
+			name:        "invalid Cc recipients skipped",
+			headers:     "From: a@example.com\nTo: b@example.com\nCc: c@example.com, d@\nSubject: Hello\n",
+			expectQueue: true,
+			expectTo:    []string{"b@example.com"},
+			expectCc:    []string{"c@example.com"},
+		},
+		{
+			name:    "skipped without valid recipients",
+			headers: "From: a@example.com\nTo: c@\nSubject: Hello\n",
+		},
+		{
+			name:              "rejected",
+			invalidRecipients: InvalidRecipientsReject,
+			headers:           "From: a@example.com\nTo: b@example.com, c@\nSubject: Hello\n",
+			expectCode:        550,
+		},
+		{
+			name:              "not rejected when all valid",
+			invalidRecipients: InvalidRecipientsReject,
+			headers:           "From: a@example.com\nTo: b@example.com\nSubject: Hello\n",
+			expectQueue:       true,
+			expectTo:          []string{"b@example.com"},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := config.SMTPConfig{Auth: config.AuthConfig{Enabled: &authDisabled}, InvalidRecipients: tc.invalidRecipients}
+			emailChan := make(chan *Email, 1)
+			s := newTestSession(t, &cfg, false, emailChan)
+
+			err := s.Data(strings.NewReader(tc.headers + "\nBody\n"))
+			if tc.expectCode != 0 {
+				var smtpErr *smtp.SMTPError
+				if !errors.As(err, &smtpErr) || smtpErr.Code != tc.expectCode {
+					t.Fatalf("expected a %d error, got '%v'", tc.expectCode, err)
+				}
+				if !strings.Contains(smtpErr.Message, "c@") {
+					t.Errorf("expected the error to list the invalid recipient, got '%s'", smtpErr.Message)
+				}
+			} else if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			select {
+			case e := <-emailChan:
+				if !tc.expectQueue {
+					t.Fatalf("expected the email not to be queued, got %+v", e)
+				}
+				if fmt.Sprint(e.To) != fmt.Sprint(tc.expectTo) || fmt.Sprint(e.Cc) != fmt.Sprint(tc.expectCc) {
+					t.Errorf("expected to %v and cc %v, got %v and %v", tc.expectTo, tc.expectCc, e.To, e.Cc)
+				}
+			default:
+				if tc.expectQueue {
+					t.Fatal("expected the email to be queued")
+				}
+			}
+		})
+	}
+}
+
+func TestPause(t *testing.T) {
+	authDisabled := false
+	cfg := config.SMTPConfig{Auth: config.AuthConfig{Enabled: &authDisabled}}
+	cfg.Policies.From.DefaultAction = PolicyAllow
+	cfg.Policies.To.DefaultAction = PolicyAllow
+	server, emailChan, err := NewServer(cfg, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	pause := PauseSwitchOf(server)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	go server.Serve(l)
+	t.Cleanup(func() { server.Close() })
+
+	msg := "From: alice@example.com\r\nTo: bob@example.com\r\nSubject: Hello\r\n\r\nHello\r\n"
+	send := func() error {
+		client, err := smtp.Dial(l.Addr().String())
+		if err != nil {
+			t.Fatalf("failed to connect: %v", err)
+		}
+		defer client.Close()
+		return client.SendMail("alice@example.com", []string{"bob@example.com"}, strings.NewReader(msg))
+	}
+
+	// a session opened before the server is paused
+	session := newTestSession(t, &cfg, false, nil)
+	session.pause = pause
+
+	pause.SetPaused(true)
+	if !pause.IsPaused() {
+		t.Fatal("expected the server to be paused")
+	}
+
+	var smtpErr *smtp.SMTPError
+	if err := send(); !errors.As(err, &smtpErr) || smtpErr.Code != 421 {
+		t.Errorf("expected new sessions to fail with 421, got '%v'", err)
+	}
+	if err := session.Mail("alice@example.com", nil); !errors.As(err, &smtpErr) || smtpErr.Code != 421 {
+		t.Errorf("expected open sessions to fail with 421, got '%v'", err)
+	}
+	if len(emailChan) != 0 {
+		t.Error("expected no email to be queued while paused")
+	}
+
+	if pause.TogglePaused() {
+		t.Fatal("expected the server to be resumed")
+	}
+	if err := send(); err != nil {
+		t.Fatalf("expected the email to be accepted once resumed, got '%v'", err)
+	}
+	if err := session.Mail("alice@example.com", nil); err != nil {
+		t.Errorf("expected open sessions to accept emails once resumed, got '%v'", err)
+	}
+	select {
+	case <-emailChan:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the email")
+	}
+
+	if !pause.TogglePaused() || !pause.IsPaused() {
+		t.Error("expected the server to be paused again")
+	}
+
+	// each server has its own switch
+	other, _, err := NewServer(cfg, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if PauseSwitchOf(other).IsPaused() {
+		t.Error("expected another server not to be paused")
+	}
+}
+
+// fakeVerifier is a RecipientVerifier knowing a fixed set of recipients.
+type fakeVerifier struct {
+	known   map[string]bool
+	err     error
+	lookups []string
+}
+
+func (v *fakeVerifier) RecipientExists(recipient string) (bool, error) {
+	v.lookups = append(v.lookups, recipient)
+	return v.known[recipient], v.err
+}
+
+func TestSession_RcptVerifyRecipients(t *testing.T) {
+	authDisabled := false
+
+	testCases := []struct {
+		name       string
+		err        error
+		recipient  string
+		expectCode int
+	}{
+		{name: "known recipient accepted", recipient: "alice@example.com"},
+		{name: "unknown recipient rejected", recipient: "bob@example.com", expectCode: 550},
+		{name: "accepted when the verification fails", err: errors.New("slack unavailable"), recipient: "bob@example.com"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := config.SMTPConfig{Auth: config.AuthConfig{Enabled: &authDisabled}}
+			cfg.Policies.To.DefaultAction = PolicyAllow
+			verifier := &fakeVerifier{known: map[string]bool{"alice@example.com": true}, err: tc.err}
+			s := newTestSession(t, &cfg, false, make(chan *Email, 1))
+			s.verifier = newRecipientChecker(verifier, time.Minute, 0)
+
+			err := s.Rcpt(tc.recipient, nil)
+			if tc.expectCode != 0 {
+				var smtpErr *smtp.SMTPError
+				if !errors.As(err, &smtpErr) || smtpErr.Code != tc.expectCode {
+					t.Fatalf("expected a %d error, got '%v'", tc.expectCode, err)
+				}
+				if len(s.rcpts) != 0 {
+					t.Errorf("expected the recipient not to be added, got %v", s.rcpts)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if len(s.rcpts) != 1 || s.rcpts[0] != tc.recipient {
+				t.Errorf("expected recipients [%s], got %v", tc.recipient, s.rcpts)
+			}
+		})
+	}
+}
+
+func TestRecipientCheckerCache(t *testing.T) {
+	verifier := &fakeVerifier{known: map[string]bool{"alice@example.com": true}}
+	c := newRecipientChecker(verifier, time.Minute, 0)
+	now := time.Now()
+	c.results.Now = func() time.Time { return now }
+
+	if !c.exists("alice@example.com") || c.exists("bob@example.com") {
+		t.Fatal("expected only alice@example.com to exist")
+	}
+	// cached, regardless of the case
+	if !c.exists("Alice@example.com") || c.exists("bob@example.com") {
+		t.Fatal("expected the cached results to be used")
+	}
+	if len(verifier.lookups) != 2 {
+		t.Errorf("expected 2 lookups, got %v", verifier.lookups)
+	}
+
+	// expired
+	now = now.Add(time.Minute)
+	c.exists("bob@example.com")
+	if len(verifier.lookups) != 3 {
+		t.Errorf("expected the expired result to be looked up again, got %v", verifier.lookups)
+	}
+
+	// failed verifications aren't cached
+	verifier.err = errors.New("slack unavailable")
+	c.exists("carol@example.com")
+	c.exists("carol@example.com")
+	if len(verifier.lookups) != 5 {
+		t.Errorf("expected failed verifications not to be cached, got %v", verifier.lookups)
+	}
+
+	// not cached without TTL
+	verifier.err = nil
+	c = newRecipientChecker(verifier, 0, 0)
+	c.exists("alice@example.com")
+	c.exists("alice@example.com")
+	if len(verifier.lookups) != 7 {
+		t.Errorf("expected the verifications not to be cached, got %v", verifier.lookups)
+	}
+}
+
+func TestNewServerMessageSize(t *testing.T) {
+	authDisabled := false
+	cfg := config.SMTPConfig{Auth: config.AuthConfig{Enabled: &authDisabled}, MaxMessageBytes: 200}
+	cfg.Policies.From.DefaultAction = PolicyAllow
+	cfg.Policies.To.DefaultAction = PolicyAllow
+
+	server, _, err := NewServer(cfg, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	go server.Serve(l)
+	t.Cleanup(func() { server.Close() })
+
+	client, err := smtp.Dial(l.Addr().String())
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	t.Cleanup(func() { client.Close() })
+	if err := client.Hello("localhost"); err != nil {
+		t.Fatalf("failed to greet: %v", err)
+	}
+
+	if ok, size := client.Extension("SIZE"); !ok || size != "200" {
+		t.Errorf("expected SIZE 200 to be advertised, got %v %q", ok, size)
+	}
+
+	// declared too large
+	err = client.Mail("alice@example.com", &smtp.MailOptions{Size: 201})
+	var smtpErr *smtp.SMTPError
+	if !errors.As(err, &smtpErr) || smtpErr.Code != 552 {
+		t.Fatalf("expected MAIL to be rejected with a 552, got %v", err)
+	}
+
+	// declared within the limit, but larger once sent
+	if err := client.Mail("alice@example.com", &smtp.MailOptions{Size: 200}); err != nil {
+		t.Fatalf("MAIL failed: %v", err)
+	}
+	if err := client.Rcpt("bob@example.com", nil); err != nil {
+		t.Fatalf("RCPT failed: %v", err)
+	}
+	w, err := client.Data()
+	if err != nil {
+		t.Fatalf("DATA failed: %v", err)
+	}
+	fmt.Fprintf(w, "From: alice@example.com\r\nTo: bob@example.com\r\nSubject: Large\r\n\r\n%s\r\n", strings.Repeat("x", 300))
+	err = w.Close()
+	if !errors.As(err, &smtpErr) || smtpErr.Code != 552 {
+		t.Errorf("expected the message to be rejected with a 552, got %v", err)
+	}
+}
+
+func TestEnqueueClosedQueue(t *testing.T) {
+	authDisabled := false
+	cfg := config.SMTPConfig{Auth: config.AuthConfig{Enabled: &authDisabled}}
+	emailChan := make(chan *Email, 1)
+	emailChan <- &Email{}
+	s := newTestSession(t, &cfg, false, emailChan)
+
+	// a session waiting for room in the queue gives up once it's closed
+	enqueued := make(chan error, 1)
+	go func() { enqueued <- s.enqueue(&Email{From: "alice@example.com"}) }()
+	time.Sleep(50 * time.Millisecond)
+	s.queue.close()
+
+	select {
+	case err := <-enqueued:
+		if err != errShuttingDown {
+			t.Errorf("expected the waiting email to fail with %v, got '%v'", errShuttingDown, err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for the email to give up")
+	}
+	if err := s.enqueue(&Email{From: "alice@example.com"}); err != errShuttingDown {
+		t.Errorf("expected new emails to fail with %v, got '%v'", errShuttingDown, err)
+	}
+
+	// the emails queued before are kept
+	if e, ok := <-emailChan; !ok || e == nil {
+		t.Error("expected the queued email to be kept")
+	}
+	if _, ok := <-emailChan; ok {
+		t.Error("expected the queue to be closed")
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	authDisabled := false
+	cfg := config.SMTPConfig{Auth: config.AuthConfig{Enabled: &authDisabled}}
+	cfg.Policies.From.DefaultAction = PolicyAllow
+	cfg.Policies.To.DefaultAction = PolicyAllow
+
+	serve := func(t *testing.T) (*smtp.Server, chan *Email, *smtp.Client) {
+		server, emailChan, err := NewServer(cfg, nil)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("failed to listen: %v", err)
+		}
+		go server.Serve(wrapListener(l, server, TLSModeStartTLS))
+		t.Cleanup(func() { server.Close() })
+
+		client, err := smtp.Dial(l.Addr().String())
+		if err != nil {
+			t.Fatalf("failed to connect: %v", err)
+		}
+		t.Cleanup(func() { client.Close() })
+		if err := client.Hello("localhost"); err != nil {
+			t.Fatalf("failed to greet: %v", err)
+		}
+		return server, emailChan, client
+	}
+
+	t.Run("in-flight email finishes within the grace period", func(t *testing.T) {
+		server, emailChan, client := serve(t)
+		if err := client.Mail("alice@example.com", nil); err != nil {
+			t.Fatalf("MAIL failed: %v", err)
+		}
+		if err := client.Rcpt("bob@example.com", nil); err != nil {
+			t.Fatalf("RCPT failed: %v", err)
+		}
+
+		done := make(chan error, 1)
+		start := time.Now()
+		go func() { done <- Shutdown(server, 5*time.Second) }()
+
+		// the email is still accepted, while the server is shutting down
+		time.Sleep(50 * time.Millisecond)
+		w, err := client.Data()
+		if err != nil {
+			t.Fatalf("DATA failed: %v", err)
+		}
+		fmt.Fprint(w, "From: alice@example.com\r\nTo: bob@example.com\r\nSubject: In flight\r\n\r\nHello\r\n")
+		if err := w.Close(); err != nil {
+			t.Fatalf("expected the in-flight email to be accepted, got '%v'", err)
+		}
+		select {
+		case e := <-emailChan:
+			if e.Subject != "In flight" {
+				t.Errorf("expected subject %q, got %q", "In flight", e.Subject)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("timed out waiting for the email")
+		}
+
+		// but no other email can start
+		var smtpErr *smtp.SMTPError
+		if err := client.Mail("alice@example.com", nil); !errors.As(err, &smtpErr) || smtpErr.Code != 421 {
+			t.Errorf("expected new emails to fail with 421, got '%v'", err)
+		}
+
+		client.Quit()
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+			if elapsed := time.Since(start); elapsed >= 5*time.Second {
+				t.Errorf("expected the shutdown to end once the session disconnected, took %s", elapsed)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for the shutdown")
+		}
+
+		// the queue is closed, so its forwarding ends
+		if _, ok := <-emailChan; ok {
+			t.Error("expected the queue to be closed once shut down")
+		}
+	})
+
+	t.Run("sessions closed after the grace period", func(t *testing.T) {
+		server, _, client := serve(t)
+		if err := client.Mail("alice@example.com", nil); err != nil {
+			t.Fatalf("MAIL failed: %v", err)
+		}
+
+		start := time.Now()
+		if err := Shutdown(server, 100*time.Millisecond); err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+		if elapsed := time.Since(start); elapsed < 100*time.Millisecond || elapsed > 2*time.Second {
+			t.Errorf("expected the shutdown to wait for the grace period, took %s", elapsed)
+		}
+		if err := client.Noop(); err == nil {
+			t.Error("expected the connection to be closed")
+		}
+	})
+}
@@ -0,0 +1,59 @@
+package email
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// ipAuthCache keeps track of client IPs that recently authenticated
+// successfully (POP-before-SMTP style). While an IP is authorized,
+// subsequent connections from it don't need to authenticate again.
+type ipAuthCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	expires map[string]time.Time
+	now     func() time.Time
+}
+
+// newIPAuthCache creates a new cache where authorizations last for ttl.
+func newIPAuthCache(ttl time.Duration) *ipAuthCache {
+	return &ipAuthCache{
+		ttl:     ttl,
+		expires: make(map[string]time.Time),
+		now:     time.Now,
+	}
+}
+
+// hostFromAddr strips the port from a remote address, if present.
+func hostFromAddr(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
+
+// grant authorizes the given IP until the TTL expires.
+func (c *ipAuthCache) grant(ip string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.expires[ip] = c.now().Add(c.ttl)
+}
+
+// isAuthorized reports whether the given IP holds a non-expired authorization.
+// Expired entries are removed as they are found.
+func (c *ipAuthCache) isAuthorized(ip string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	expiry, ok := c.expires[ip]
+	if !ok {
+		return false
+	}
+	if !c.now().Before(expiry) {
+		delete(c.expires, ip)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,27 @@
+package email
+
+import (
+	"net/mail"
+	"strings"
+)
+
+// listID returns the mailing list of an email from its List-Id header (RFC 2919), e.g.
+// "Announcements <announce.example.com>", or "" if it has none. The quotes around the
+// description and the folding white space are removed.
+func listID(header mail.Header) string {
+	value := strings.Join(strings.Fields(header.Get("List-Id")), " ")
+	start := strings.LastIndex(value, "<")
+	if start == -1 || !strings.HasSuffix(value, ">") {
+		return value
+	}
+
+	id := value[start:]
+	description := strings.TrimSpace(value[:start])
+	if len(description) >= 2 && strings.HasPrefix(description, `"`) && strings.HasSuffix(description, `"`) {
+		description = strings.TrimSpace(description[1 : len(description)-1])
+	}
+	if description == "" {
+		return id
+	}
+	return description + " " + id
+}
@@ -0,0 +1,61 @@
+package email
+
+import (
+	"crypto/tls"
+	"go-smtp-slacker/internal/config"
+	"go-smtp-slacker/internal/logger"
+	"net"
+	"time"
+
+	"github.com/emersion/go-smtp"
+)
+
+// listen binds the address, retrying up to retries times when it fails (e.g. while
+// the previous instance still holds the port during a rolling restart). The delay
+// between attempts starts at delay and doubles after each attempt.
+func listen(addr string, retries int, delay time.Duration, sleep func(time.Duration)) (net.Listener, error) {
+	for attempt := 0; ; attempt++ {
+		l, err := net.Listen("tcp", addr)
+		if err == nil || attempt >= retries {
+			return l, err
+		}
+
+		logger.Warnf("Failed to bind '%s' (attempt %d/%d), retrying in %s: %v", addr, attempt+1, retries+1, delay, err)
+		sleep(delay)
+		delay *= 2
+	}
+}
+
+// TLS modes: upgrading the connections with STARTTLS, or starting them over TLS (SMTPS)
+const (
+	TLSModeStartTLS = "starttls"
+	TLSModeImplicit = "implicit"
+)
+
+// wrapListener returns the listener of the connections to serve: with implicit TLS, the
+// accepted connections are wrapped in TLS right away, instead of negotiating STARTTLS.
+// The connections are tracked, to close the ones left at the end of a shutdown, and
+// the client IP of the trusted proxies is read from their PROXY protocol header if
+// configured, before the session starts.
+func wrapListener(l net.Listener, server *smtp.Server, mode string) net.Listener {
+	if be, ok := server.Backend.(*backend); ok {
+		l = be.conns.listen(l)
+		if be.cfg.ClientIPSource == ClientIPSourceProxyProtocol && len(be.proxies) > 0 {
+			l = &proxyListener{Listener: l, proxies: be.proxies}
+		}
+	}
+	if mode == TLSModeImplicit && server.TLSConfig != nil {
+		return tls.NewListener(l, server.TLSConfig)
+	}
+	return l
+}
+
+// ListenAndServe binds the listen address of the server, retrying as configured,
+// and serves the incoming connections.
+func ListenAndServe(server *smtp.Server, cfg config.SMTPConfig) error {
+	l, err := listen(server.Addr, cfg.BindRetries, cfg.BindRetryDelay, time.Sleep)
+	if err != nil {
+		return err
+	}
+	return server.Serve(wrapListener(l, server, cfg.TLS.Mode))
+}
@@ -0,0 +1,193 @@
+package email
+
+import (
+	"bytes"
+	"go-smtp-slacker/internal/logger"
+	"io"
+	"net/mail"
+	"strings"
+
+	"github.com/DusanKasan/parsemail"
+)
+
+// SkipReason tells why an email is accepted but not delivered.
+type SkipReason string
+
+// Reasons for skipping an email
+const (
+	SkipUnparsable SkipReason = "unparsable"
+	SkipNoSender   SkipReason = "no sender"
+)
+
+// ErrSkipped is returned for the emails which can't be delivered, but are accepted
+// nonetheless so the client doesn't retry them.
+type ErrSkipped struct {
+	Reason SkipReason
+	Err    error
+}
+
+func (e *ErrSkipped) Error() string {
+	if e.Err != nil {
+		return "email skipped: " + string(e.Reason) + ": " + e.Err.Error()
+	}
+	return "email skipped: " + string(e.Reason)
+}
+
+func (e *ErrSkipped) Unwrap() error {
+	return e.Err
+}
+
+// ParseEmail reads and parses an email: its sender, recipients and subject, and its
+// bodies decoded to UTF-8 along with its attachments. Emails which can't be parsed, or
+// have no sender, are skipped with an *ErrSkipped. Its Bcc recipients are left empty, as
+// they are only known from the envelope.
+func ParseEmail(r io.Reader) (*Email, error) {
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	calendar := findCalendar(b)
+	deliveryStatus := findDeliveryStatus(b)
+
+	emailParsed, err := parsemail.Parse(bytes.NewReader(b))
+	if err != nil {
+		// parsemail can't process text/calendar or delivery status parts, but the headers are parsed nonetheless
+		if calendar == "" && deliveryStatus == "" {
+			return nil, &ErrSkipped{Reason: SkipUnparsable, Err: err}
+		}
+		logger.Debugf("Email contains a calendar or a delivery status, ignoring the parse error: %v", err)
+	}
+
+	if len(emailParsed.From) == 0 {
+		return nil, &ErrSkipped{Reason: SkipNoSender}
+	}
+
+	// parsemail drops the whole list of recipients when one of them is invalid, so the
+	// lists are parsed from the raw header instead
+	header := mail.Header(emailParsed.Header)
+	if msg, err := mail.ReadMessage(bytes.NewReader(b)); err == nil {
+		header = msg.Header
+	}
+	from := emailParsed.From[0].Address
+	to, invalidTo := parseRecipients(header.Get("To"))
+	cc, invalidCc := parseRecipients(header.Get("Cc"))
+	invalid := append(invalidTo, invalidCc...)
+	for _, recipient := range invalid {
+		logger.Warnf("Email from '%s' has an invalid recipient '%s'; skipping it", from, recipient)
+	}
+
+	// Decode the bodies from their transfer encodings, which parsemail leaves as is, keeping
+	// the bodies which can't be decoded (e.g. broken base64) rather than dropping the email
+	var undecodable []string
+	textEncoding, htmlEncoding := bodyTransferEncodings(b)
+	textBody, err := decodeTransfer(emailParsed.TextBody, textEncoding)
+	if err != nil {
+		logger.Warnf("Failed to decode plain text body of email from '%s' from transfer encoding '%s', keeping it as is: %v", from, textEncoding, err)
+		undecodable = append(undecodable, "text")
+	}
+	htmlBody, err := decodeTransfer(emailParsed.HTMLBody, htmlEncoding)
+	if err != nil {
+		logger.Warnf("Failed to decode HTML body of email from '%s' from transfer encoding '%s', keeping it as is: %v", from, htmlEncoding, err)
+		undecodable = append(undecodable, "html")
+	}
+
+	// Decode the bodies from their declared charsets to UTF-8
+	textCharset, htmlCharset := bodyCharsets(b)
+	textBody, err = decodeCharset(textBody, textCharset)
+	if err != nil {
+		logger.Warnf("Failed to decode plain text body from charset '%s': %v", textCharset, err)
+	}
+	htmlBody, err = decodeCharset(htmlBody, htmlCharset)
+	if err != nil {
+		logger.Warnf("Failed to decode HTML body from charset '%s': %v", htmlCharset, err)
+	}
+
+	var attachments []Attachment
+	for _, a := range emailParsed.Attachments {
+		data, err := io.ReadAll(a.Data)
+		if err != nil {
+			logger.Warnf("Failed to read attachment '%s': %v", a.Filename, err)
+			continue
+		}
+		attachments = append(attachments, Attachment{Filename: a.Filename, ContentType: a.ContentType, Data: data})
+	}
+
+	return &Email{
+		From:              from,
+		To:                to,
+		Cc:                cc,
+		InvalidRecipients: invalid,
+		UndecodableBodies: undecodable,
+		Subject:           emailParsed.Subject,
+		Body: EmailBody{
+			HTML:           htmlBody,
+			Text:           textBody,
+			HTMLCharset:    htmlCharset,
+			TextCharset:    textCharset,
+			Attachments:    attachments,
+			Calendar:       calendar,
+			DeliveryStatus: deliveryStatus,
+			Header:         emailParsed.Header,
+			HighPriority:   isHighPriority(emailParsed.Header),
+			ListID:         listID(emailParsed.Header),
+			Raw:            b,
+		},
+	}, nil
+}
+
+// parseRecipients returns the addresses of a list of recipients (e.g. a To header), along
+// with the entries of the list which aren't valid addresses, if any.
+func parseRecipients(list string) (valid, invalid []string) {
+	if addresses, err := mail.ParseAddressList(list); err == nil || strings.TrimSpace(list) == "" {
+		for _, address := range addresses {
+			valid = append(valid, address.Address)
+		}
+		return valid, nil
+	}
+
+	// parse the addresses one by one, to keep the valid ones
+	for _, entry := range splitAddressList(list) {
+		if address, err := mail.ParseAddress(entry); err == nil {
+			valid = append(valid, address.Address)
+		} else {
+			invalid = append(invalid, entry)
+		}
+	}
+	return valid, invalid
+}
+
+// splitAddressList splits a list of addresses at its commas, except the ones quoted or in
+// comments (e.g. "Doe, John" <john@example.com>), skipping the empty entries.
+func splitAddressList(list string) []string {
+	var entries []string
+	var quoted, escaped bool
+	depth, start := 0, 0
+
+	add := func(entry string) {
+		if entry = strings.TrimSpace(entry); entry != "" {
+			entries = append(entries, entry)
+		}
+	}
+
+	for i, c := range list {
+		switch {
+		case escaped:
+			escaped = false
+		case c == '\\':
+			escaped = true
+		case c == '"':
+			quoted = !quoted
+		case quoted:
+		case c == '(' || c == '<':
+			depth++
+		case (c == ')' || c == '>') && depth > 0:
+			depth--
+		case c == ',' && depth == 0:
+			add(list[start:i])
+			start = i + 1
+		}
+	}
+	add(list[start:])
+	return entries
+}
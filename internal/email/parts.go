@@ -0,0 +1,82 @@
+package email
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"strings"
+)
+
+// findCalendar returns the first text/calendar part (e.g. a meeting invite) of a raw
+// email, decoded to UTF-8, or an empty string if there's none.
+func findCalendar(raw []byte) string {
+	return findPart(raw, "text/calendar")
+}
+
+// findDeliveryStatus returns the first message/delivery-status part of a raw email (the
+// machine-readable part of bounces), or an empty string if there's none.
+func findDeliveryStatus(raw []byte) string {
+	return findPart(raw, "message/delivery-status")
+}
+
+// findPart returns the first part of a raw email with the given media type, decoded to
+// UTF-8, or an empty string if there's none.
+func findPart(raw []byte, partType string) string {
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		return ""
+	}
+
+	var walk func(header mimeHeader, body io.Reader) string
+	walk = func(header mimeHeader, body io.Reader) string {
+		mediaType, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+		if err != nil {
+			return ""
+		}
+
+		switch {
+		case mediaType == partType:
+			content, err := io.ReadAll(transferDecoder(header.Get("Content-Transfer-Encoding"), body))
+			if err != nil {
+				return ""
+			}
+			decoded, _ := decodeCharset(string(content), strings.ToLower(params["charset"]))
+			return decoded
+		case strings.HasPrefix(mediaType, "multipart/"):
+			reader := multipart.NewReader(body, params["boundary"])
+			for {
+				part, err := reader.NextPart()
+				if err != nil {
+					return ""
+				}
+				if found := walk(part.Header, part); found != "" {
+					return found
+				}
+			}
+		}
+		return ""
+	}
+
+	return walk(msg.Header, msg.Body)
+}
+
+// mimeHeader is the common interface of the message and part headers.
+type mimeHeader interface {
+	Get(key string) string
+}
+
+// transferDecoder decodes a body according to its Content-Transfer-Encoding. Note that
+// the quoted-printable multipart parts are already decoded by the multipart reader.
+func transferDecoder(encoding string, body io.Reader) io.Reader {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "base64":
+		return base64.NewDecoder(base64.StdEncoding, body)
+	case "quoted-printable":
+		return quotedprintable.NewReader(body)
+	}
+	return body
+}
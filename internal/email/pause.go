@@ -0,0 +1,63 @@
+package email
+
+import (
+	"go-smtp-slacker/internal/logger"
+	"sync/atomic"
+
+	"github.com/emersion/go-smtp"
+)
+
+// errPaused is returned to the clients while the server is paused
+var errPaused = &smtp.SMTPError{
+	Code:         421,
+	EnhancedCode: smtp.EnhancedCode{4, 3, 2},
+	Message:      "Service unavailable, please try again later",
+}
+
+// PauseSwitch pauses a server for maintenance: it keeps running, but temporarily fails
+// every email, so clients retry them later. Safe for concurrent use.
+type PauseSwitch struct {
+	paused atomic.Bool
+}
+
+// PauseSwitchOf returns the pause switch of a server created by NewServer, or a switch
+// pausing nothing for other servers.
+func PauseSwitchOf(server *smtp.Server) *PauseSwitch {
+	if be, ok := server.Backend.(*backend); ok {
+		return &be.pause
+	}
+	return &PauseSwitch{}
+}
+
+// SetPaused pauses or resumes the server, for all sessions.
+func (p *PauseSwitch) SetPaused(pause bool) {
+	if p.paused.Swap(pause) != pause {
+		logPause(pause)
+	}
+}
+
+// TogglePaused pauses the server if running, or resumes it if paused, returning
+// whether it's now paused.
+func (p *PauseSwitch) TogglePaused() bool {
+	for {
+		current := p.paused.Load()
+		if p.paused.CompareAndSwap(current, !current) {
+			logPause(!current)
+			return !current
+		}
+	}
+}
+
+// IsPaused reports whether the server is paused.
+func (p *PauseSwitch) IsPaused() bool {
+	return p.paused.Load()
+}
+
+// logPause logs the server being paused or resumed.
+func logPause(pause bool) {
+	if pause {
+		logger.Warnf("SMTP server paused, temporarily failing all emails")
+	} else {
+		logger.Infof("SMTP server resumed, accepting emails")
+	}
+}
@@ -0,0 +1,21 @@
+package email
+
+import (
+	"net/mail"
+	"strings"
+)
+
+// isHighPriority reports whether the headers flag an email as high priority, either
+// with X-Priority (1 or 2, e.g. "1 (Highest)"), Importance: high or Priority: urgent.
+func isHighPriority(header mail.Header) bool {
+	if priority := strings.TrimSpace(header.Get("X-Priority")); priority != "" {
+		switch priority[0] {
+		case '1', '2':
+			return true
+		}
+	}
+	if strings.EqualFold(strings.TrimSpace(header.Get("Importance")), "high") {
+		return true
+	}
+	return strings.EqualFold(strings.TrimSpace(header.Get("Priority")), "urgent")
+}
@@ -0,0 +1,135 @@
+package email
+
+import (
+	"context"
+	"errors"
+	"go-smtp-slacker/internal/logger"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-smtp"
+)
+
+// errShuttingDown is returned to the clients starting an email while the server shuts down
+var errShuttingDown = &smtp.SMTPError{
+	Code:         421,
+	EnhancedCode: smtp.EnhancedCode{4, 3, 2},
+	Message:      "Service shutting down, please try again later",
+}
+
+// emailQueue holds the received emails until they're forwarded, from its channel. It's
+// closed once the server shut down, so the forwarding ends once the emails left are.
+type emailQueue struct {
+	ch chan *Email
+	// mu guards the sending to ch against its closing
+	mu     sync.RWMutex
+	closed bool
+	// closing is closed first, so the sessions waiting for room in ch give up
+	closing   chan struct{}
+	closeOnce sync.Once
+}
+
+func newEmailQueue(ch chan *Email) *emailQueue {
+	return &emailQueue{ch: ch, closing: make(chan struct{})}
+}
+
+// close closes the channel of the queue, the emails being enqueued failing from now on.
+func (q *emailQueue) close() {
+	q.closeOnce.Do(func() {
+		close(q.closing)
+		q.mu.Lock()
+		defer q.mu.Unlock()
+		q.closed = true
+		close(q.ch)
+	})
+}
+
+// connTracker keeps the open client connections, so the ones left once the grace period
+// of a shutdown ends can be closed.
+type connTracker struct {
+	mu    sync.Mutex
+	conns map[net.Conn]struct{}
+}
+
+func newConnTracker() *connTracker {
+	return &connTracker{conns: make(map[net.Conn]struct{})}
+}
+
+// listen returns a listener tracking the connections accepted by l.
+func (t *connTracker) listen(l net.Listener) net.Listener {
+	return &trackingListener{Listener: l, tracker: t}
+}
+
+// closeAll closes the open connections, returning how many were closed.
+func (t *connTracker) closeAll() int {
+	t.mu.Lock()
+	conns := make([]net.Conn, 0, len(t.conns))
+	for conn := range t.conns {
+		conns = append(conns, conn)
+	}
+	t.mu.Unlock()
+
+	for _, conn := range conns {
+		conn.Close()
+	}
+	return len(conns)
+}
+
+// trackingListener adds the connections it accepts to a tracker.
+type trackingListener struct {
+	net.Listener
+	tracker *connTracker
+}
+
+func (l *trackingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	tracked := &trackedConn{Conn: conn, tracker: l.tracker}
+	l.tracker.mu.Lock()
+	l.tracker.conns[tracked] = struct{}{}
+	l.tracker.mu.Unlock()
+	return tracked, nil
+}
+
+// trackedConn removes itself from its tracker once closed.
+type trackedConn struct {
+	net.Conn
+	tracker *connTracker
+}
+
+func (c *trackedConn) Close() error {
+	c.tracker.mu.Lock()
+	delete(c.tracker.conns, c)
+	c.tracker.mu.Unlock()
+	return c.Conn.Close()
+}
+
+// Shutdown stops the server from accepting connections, and gives the open sessions up
+// to grace to finish their current email and disconnect, new emails being rejected with
+// a 421. The connections left once the grace period ends are closed, interrupting their
+// emails. The channel of the received emails is then closed, so their forwarding ends
+// once the emails left in it are read.
+func Shutdown(server *smtp.Server, grace time.Duration) error {
+	be, _ := server.Backend.(*backend)
+	if be != nil {
+		be.closing.Store(true)
+		defer be.queue.close()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), grace)
+	defer cancel()
+	err := server.Shutdown(ctx)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		return err
+	}
+	if be == nil {
+		return server.Close()
+	}
+
+	closed := be.conns.closeAll()
+	logger.Warnf("Shutdown grace period of %s elapsed, closed %d remaining connections", grace, closed)
+	return nil
+}
@@ -0,0 +1,94 @@
+package email
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"strings"
+	"unicode"
+)
+
+// Handling of the bodies which can't be decoded from their Content-Transfer-Encoding
+const (
+	UndecodableBodyRaw    = "raw"
+	UndecodableBodyReject = "reject"
+)
+
+// bodyTransferEncodings returns the Content-Transfer-Encoding of the plain text and HTML
+// bodies of a raw email, walking nested multipart parts if needed. The quoted-printable
+// parts have none, as the multipart reader already decodes them.
+func bodyTransferEncodings(raw []byte) (textEncoding, htmlEncoding string) {
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		return "", ""
+	}
+
+	var textFound, htmlFound bool
+	var walk func(header mimeHeader, body io.Reader)
+	walk = func(header mimeHeader, body io.Reader) {
+		contentType := header.Get("Content-Type")
+		if contentType == "" {
+			contentType = "text/plain"
+		}
+		mediaType, params, err := mime.ParseMediaType(contentType)
+		if err != nil {
+			return
+		}
+
+		switch {
+		case mediaType == "text/plain" && !textFound:
+			textEncoding, textFound = header.Get("Content-Transfer-Encoding"), true
+		case mediaType == "text/html" && !htmlFound:
+			htmlEncoding, htmlFound = header.Get("Content-Transfer-Encoding"), true
+		case strings.HasPrefix(mediaType, "multipart/"):
+			reader := multipart.NewReader(body, params["boundary"])
+			for {
+				part, err := reader.NextPart()
+				if err != nil {
+					return
+				}
+				walk(part.Header, part)
+			}
+		}
+	}
+
+	walk(msg.Header, msg.Body)
+	return textEncoding, htmlEncoding
+}
+
+// decodeTransfer decodes a body from its Content-Transfer-Encoding. Base64 bodies are
+// decoded regardless of their line breaks and padding. The bodies in the identity
+// encodings (7bit, 8bit and binary) are returned as is, including the 8-bit characters
+// found in 7bit bodies. The bodies which can't be decoded are returned as is, along with
+// the error.
+func decodeTransfer(body, encoding string) (string, error) {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "", "7bit", "8bit", "binary":
+		return body, nil
+	case "base64":
+		compact := strings.Map(func(r rune) rune {
+			if unicode.IsSpace(r) {
+				return -1
+			}
+			return r
+		}, body)
+		decoded, err := base64.RawStdEncoding.DecodeString(strings.TrimRight(compact, "="))
+		if err != nil {
+			return body, err
+		}
+		return string(decoded), nil
+	case "quoted-printable":
+		decoded, err := io.ReadAll(quotedprintable.NewReader(strings.NewReader(body)))
+		if err != nil {
+			return body, err
+		}
+		return string(decoded), nil
+	default:
+		return body, fmt.Errorf("unsupported transfer encoding '%s'", encoding)
+	}
+}
@@ -0,0 +1,94 @@
+package email
+
+import (
+	"context"
+	"go-smtp-slacker/internal/cache"
+	"go-smtp-slacker/internal/logger"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-smtp"
+)
+
+// RecipientVerifier tells whether the messages for a recipient can be delivered (e.g. a
+// Slack user exists for its address), satisfied by *slacker.Service.
+type RecipientVerifier interface {
+	RecipientExists(recipient string) (bool, error)
+}
+
+// errUnknownRecipient is returned to the clients for the recipients which can't be delivered
+var errUnknownRecipient = &smtp.SMTPError{
+	Code:         550,
+	EnhancedCode: smtp.EnhancedCode{5, 1, 1},
+	Message:      "Recipient unknown",
+}
+
+// recipientChecker verifies the recipients at RCPT, caching the results so the same
+// recipients aren't looked up for every email.
+type recipientChecker struct {
+	verifier RecipientVerifier
+	// results holds whether the recipients exist, nil if not cached
+	results *cache.Cache[bool]
+}
+
+// newRecipientChecker creates a checker caching the results of verifier for ttl, or not
+// at all if 0, up to maxSize recipients, or without limit if 0.
+func newRecipientChecker(verifier RecipientVerifier, ttl time.Duration, maxSize int) *recipientChecker {
+	c := &recipientChecker{verifier: verifier}
+	if ttl > 0 {
+		c.results = cache.New[bool]("recipients", ttl, maxSize)
+	}
+	return c
+}
+
+// exists reports whether the recipient can be delivered. Verifications failing (e.g. Slack
+// being unavailable) are only logged and not cached, so the recipient is accepted and its
+// delivery reports the error if it persists.
+func (c *recipientChecker) exists(recipient string) bool {
+	key := strings.ToLower(recipient)
+	if c.results != nil {
+		if exists, ok := c.results.Get(key); ok {
+			logger.Debugf("Using the cached verification of recipient '%s'", recipient)
+			return exists
+		}
+	}
+
+	exists, err := c.verifier.RecipientExists(recipient)
+	if err != nil {
+		logger.Warnf("Failed to verify recipient '%s', accepting it: %v", recipient, err)
+		return true
+	}
+
+	if c.results != nil {
+		c.results.Put(key, exists)
+	}
+	return exists
+}
+
+// RunCacheCleanup removes the expired recipient verifications and DNSBL results of the
+// server from their caches every interval, until the context is done. It returns right
+// away when neither of them is cached.
+func RunCacheCleanup(ctx context.Context, server *smtp.Server, interval time.Duration) {
+	be, _ := server.Backend.(*backend)
+	if be == nil {
+		return
+	}
+
+	var wg sync.WaitGroup
+	if be.verifier != nil && be.verifier.results != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			be.verifier.results.RunCleanup(ctx, interval)
+		}()
+	}
+	if be.dnsbl != nil && be.dnsbl.results != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			be.dnsbl.results.RunCleanup(ctx, interval)
+		}()
+	}
+	wg.Wait()
+}
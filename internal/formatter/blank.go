@@ -0,0 +1,92 @@
+package formatter
+
+import (
+	"strings"
+	"unicode"
+
+	"github.com/slack-go/slack"
+)
+
+// isBlankRune reports whether a character shows nothing: white space, or one of the
+// zero-width characters some HTML emails use as spacers.
+func isBlankRune(r rune) bool {
+	switch r {
+	case '\u200b', '\u200c', '\u200d', '\u2060', '\ufeff':
+		return true
+	}
+	return unicode.IsSpace(r)
+}
+
+// isBlank reports whether a text shows nothing
+func isBlank(text string) bool {
+	return strings.TrimFunc(text, isBlankRune) == ""
+}
+
+// isBlankSection reports whether the elements of a rich text section only hold blank
+// texts. Links, mentions and emojis are shown even without a text.
+func isBlankSection(elements []slack.RichTextSectionElement) bool {
+	for _, element := range elements {
+		text, ok := element.(*slack.RichTextSectionTextElement)
+		if !ok || !isBlank(text.Text) {
+			return false
+		}
+	}
+	return true
+}
+
+// isBlankRichText reports whether an element of a rich text block shows nothing, e.g.
+// a code block of blank lines.
+func isBlankRichText(element slack.RichTextElement) bool {
+	switch e := element.(type) {
+	case *slack.RichTextSection:
+		return isBlankSection(e.Elements)
+	case *slack.RichTextQuote:
+		return isBlankSection(e.Elements)
+	case *slack.RichTextPreformatted:
+		return isBlankSection(e.Elements)
+	case *slack.RichTextList:
+		for _, item := range e.Elements {
+			if !isBlankRichText(item) {
+				return false
+			}
+		}
+		return true
+	default:
+		return false
+	}
+}
+
+// dropBlankBlocks removes the blocks which show nothing (e.g. left by trailing line
+// breaks, spacer paragraphs or empty code blocks), which Slack renders as gaps or
+// rejects, and trims the trailing white space of the section texts.
+func dropBlankBlocks(blocks []slack.Block) []slack.Block {
+	kept := make([]slack.Block, 0, len(blocks))
+	for _, block := range blocks {
+		switch b := block.(type) {
+		case *slack.SectionBlock:
+			if b.Text != nil {
+				b.Text.Text = strings.TrimRightFunc(b.Text.Text, isBlankRune)
+			}
+			if (b.Text == nil || b.Text.Text == "") && len(b.Fields) == 0 && b.Accessory == nil {
+				continue
+			}
+		case *slack.HeaderBlock:
+			if b.Text == nil || isBlank(b.Text.Text) {
+				continue
+			}
+		case *slack.RichTextBlock:
+			elements := make([]slack.RichTextElement, 0, len(b.Elements))
+			for _, element := range b.Elements {
+				if !isBlankRichText(element) {
+					elements = append(elements, element)
+				}
+			}
+			if len(elements) == 0 {
+				continue
+			}
+			b.Elements = elements
+		}
+		kept = append(kept, block)
+	}
+	return kept
+}
@@ -0,0 +1,217 @@
+package formatter
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+	// the time zones of events must be resolved even in images without zoneinfo (e.g. scratch)
+	_ "time/tzdata"
+
+	"github.com/slack-go/slack"
+)
+
+// ErrNoCalendarEvent is returned when a calendar has no event
+var ErrNoCalendarEvent = errors.New("no event in calendar")
+
+// CalendarEvent holds the details of a calendar (iCalendar) event.
+type CalendarEvent struct {
+	Method    string
+	Summary   string
+	Location  string
+	Organizer string
+	Start     time.Time
+	End       time.Time
+	AllDay    bool
+}
+
+// calendarProperty is a content line of an iCalendar object, e.g. DTSTART;TZID=Europe/Lisbon:20240105T100000
+type calendarProperty struct {
+	name   string
+	params map[string]string
+	value  string
+}
+
+// unfoldCalendarLines splits an iCalendar object in content lines, joining the
+// lines folded over multiple lines (continued with a leading space or tab).
+func unfoldCalendarLines(ics string) []string {
+	var lines []string
+	for _, line := range strings.Split(strings.ReplaceAll(ics, "\r\n", "\n"), "\n") {
+		if (strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")) && len(lines) > 0 {
+			lines[len(lines)-1] += line[1:]
+			continue
+		}
+		if strings.TrimSpace(line) != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+// parseCalendarProperty parses a content line.
+func parseCalendarProperty(line string) (calendarProperty, bool) {
+	nameAndParams, value, ok := strings.Cut(line, ":")
+	if !ok {
+		return calendarProperty{}, false
+	}
+
+	parts := strings.Split(nameAndParams, ";")
+	prop := calendarProperty{
+		name:   strings.ToUpper(parts[0]),
+		params: make(map[string]string),
+		value:  value,
+	}
+	for _, param := range parts[1:] {
+		if key, val, ok := strings.Cut(param, "="); ok {
+			prop.params[strings.ToUpper(key)] = strings.Trim(val, `"`)
+		}
+	}
+	return prop, true
+}
+
+// unescapeCalendarText decodes the escaped characters of a text value.
+var unescapeCalendarText = strings.NewReplacer(`\n`, "\n", `\N`, "\n", `\,`, ",", `\;`, ";", `\\`, `\`).Replace
+
+// parseCalendarTime parses a DATE or DATE-TIME value, in the time zone given by the
+// TZID parameter (or UTC). It reports whether the value is a date, without a time.
+func parseCalendarTime(prop calendarProperty) (time.Time, bool, error) {
+	loc := time.UTC
+	if tzid := prop.params["TZID"]; tzid != "" {
+		if l, err := time.LoadLocation(tzid); err == nil {
+			loc = l
+		}
+	}
+
+	value := strings.TrimSpace(prop.value)
+	switch {
+	case prop.params["VALUE"] == "DATE" || len(value) == len("20060102"):
+		t, err := time.ParseInLocation("20060102", value, loc)
+		return t, true, err
+	case strings.HasSuffix(value, "Z"):
+		t, err := time.Parse("20060102T150405Z", value)
+		return t, false, err
+	default:
+		t, err := time.ParseInLocation("20060102T150405", value, loc)
+		return t, false, err
+	}
+}
+
+// ParseCalendar returns the first event of an iCalendar object.
+func ParseCalendar(ics string) (*CalendarEvent, error) {
+	var event *CalendarEvent
+	var method string
+
+	for _, line := range unfoldCalendarLines(ics) {
+		prop, ok := parseCalendarProperty(line)
+		if !ok {
+			continue
+		}
+
+		switch {
+		case prop.name == "METHOD":
+			method = strings.ToUpper(strings.TrimSpace(prop.value))
+		case prop.name == "BEGIN" && strings.EqualFold(prop.value, "VEVENT"):
+			if event == nil {
+				event = &CalendarEvent{}
+			}
+		case prop.name == "END" && strings.EqualFold(prop.value, "VEVENT"):
+			if event != nil {
+				event.Method = method
+				return event, nil
+			}
+		case event == nil:
+			continue
+		case prop.name == "SUMMARY":
+			event.Summary = unescapeCalendarText(prop.value)
+		case prop.name == "LOCATION":
+			event.Location = unescapeCalendarText(prop.value)
+		case prop.name == "ORGANIZER":
+			event.Organizer = prop.params["CN"]
+			if event.Organizer == "" {
+				event.Organizer = strings.TrimPrefix(strings.TrimPrefix(prop.value, "mailto:"), "MAILTO:")
+			}
+		case prop.name == "DTSTART":
+			t, allDay, err := parseCalendarTime(prop)
+			if err != nil {
+				return nil, fmt.Errorf("invalid event start '%s': %w", prop.value, err)
+			}
+			event.Start, event.AllDay = t, allDay
+		case prop.name == "DTEND":
+			t, _, err := parseCalendarTime(prop)
+			if err != nil {
+				return nil, fmt.Errorf("invalid event end '%s': %w", prop.value, err)
+			}
+			event.End = t
+		}
+	}
+
+	return nil, ErrNoCalendarEvent
+}
+
+// when formats the time span of the event.
+func (e *CalendarEvent) when() string {
+	if e.Start.IsZero() {
+		return ""
+	}
+
+	if e.AllDay {
+		// the end date of all-day events is exclusive
+		last := e.End.AddDate(0, 0, -1)
+		if e.End.IsZero() || !last.After(e.Start) {
+			return e.Start.Format("Mon, 02 Jan 2006") + " (all day)"
+		}
+		return e.Start.Format("Mon, 02 Jan 2006") + " – " + last.Format("Mon, 02 Jan 2006") + " (all day)"
+	}
+
+	when := e.Start.Format("Mon, 02 Jan 2006 15:04")
+	switch {
+	case e.End.IsZero():
+	case e.End.Format("20060102") == e.Start.Format("20060102"):
+		when += " – " + e.End.Format("15:04")
+	default:
+		when += " – " + e.End.Format("Mon, 02 Jan 2006 15:04")
+	}
+	return when + " (" + e.Start.Location().String() + ")"
+}
+
+// CalendarToBlocks returns the blocks describing the event of an iCalendar object.
+// Only the EscapeMentions option applies.
+func CalendarToBlocks(ics string, opts Options) ([]slack.Block, error) {
+	event, err := ParseCalendar(sanitizeUTF8(ics))
+	if err != nil {
+		return nil, err
+	}
+
+	title := event.Summary
+	if title == "" {
+		title = "(no title)"
+	}
+	if event.Method == "CANCEL" {
+		title = "Cancelled: " + title
+	}
+
+	lines := []string{":calendar: *" + title + "*"}
+	if when := event.when(); when != "" {
+		lines = append(lines, "*When:* "+when)
+	}
+	if event.Location != "" {
+		lines = append(lines, "*Where:* "+event.Location)
+	}
+	if event.Organizer != "" {
+		lines = append(lines, "*Organizer:* "+event.Organizer)
+	}
+
+	blocks := []slack.Block{
+		&slack.SectionBlock{
+			Type: slack.MBTSection,
+			Text: &slack.TextBlockObject{
+				Type: slack.MarkdownType,
+				Text: strings.Join(lines, "\n"),
+			},
+		},
+	}
+	if opts.EscapeMentions {
+		escapeBlockMentions(blocks)
+	}
+	return blocks, nil
+}
@@ -0,0 +1,136 @@
+package formatter
+
+import (
+	"bufio"
+	"errors"
+	"net/textproto"
+	"strings"
+
+	"github.com/slack-go/slack"
+)
+
+// ErrNoDeliveryStatus is returned when a delivery status has no recipient
+var ErrNoDeliveryStatus = errors.New("no recipient in delivery status")
+
+// RecipientStatus holds the delivery status of a recipient of a bounced email.
+type RecipientStatus struct {
+	Recipient  string
+	Action     string
+	Status     string
+	Diagnostic string
+}
+
+// DeliveryStatus holds the details of a delivery status notification (message/delivery-status).
+type DeliveryStatus struct {
+	ReportingMTA string
+	Recipients   []RecipientStatus
+}
+
+// dsnValue strips the type of a typed field value, e.g. "rfc822; alice@example.com"
+func dsnValue(value string) string {
+	if _, v, ok := strings.Cut(value, ";"); ok {
+		value = v
+	}
+	return strings.TrimSpace(value)
+}
+
+// ParseDeliveryStatus parses a delivery status: the per-message fields, then the fields
+// of each recipient, separated by blank lines.
+func ParseDeliveryStatus(dsn string) (*DeliveryStatus, error) {
+	status := &DeliveryStatus{}
+
+	groups := strings.Split(strings.ReplaceAll(dsn, "\r\n", "\n"), "\n\n")
+	for i, group := range groups {
+		if strings.TrimSpace(group) == "" {
+			continue
+		}
+
+		// the header reader unfolds the fields continued over multiple lines
+		fields, err := textproto.NewReader(bufio.NewReader(strings.NewReader(strings.TrimLeft(group, "\n") + "\n\n"))).ReadMIMEHeader()
+		if err != nil && len(fields) == 0 {
+			continue
+		}
+
+		if i == 0 {
+			status.ReportingMTA = dsnValue(fields.Get("Reporting-MTA"))
+			continue
+		}
+
+		recipient := fields.Get("Final-Recipient")
+		if recipient == "" {
+			recipient = fields.Get("Original-Recipient")
+		}
+		if recipient == "" {
+			continue
+		}
+		status.Recipients = append(status.Recipients, RecipientStatus{
+			Recipient:  dsnValue(recipient),
+			Action:     strings.ToLower(strings.TrimSpace(fields.Get("Action"))),
+			Status:     strings.TrimSpace(fields.Get("Status")),
+			Diagnostic: dsnValue(fields.Get("Diagnostic-Code")),
+		})
+	}
+
+	if len(status.Recipients) == 0 {
+		return nil, ErrNoDeliveryStatus
+	}
+	return status, nil
+}
+
+// escapeMrkdwn escapes the control characters of mrkdwn, so the values of the delivery
+// status (e.g. "<alice@example.com>: User unknown") are shown as is.
+var escapeMrkdwn = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;").Replace
+
+// title summarizes the outcome of the delivery, the worst one first.
+func (s *DeliveryStatus) title() string {
+	actions := make(map[string]bool)
+	for _, recipient := range s.Recipients {
+		actions[recipient.Action] = true
+	}
+
+	switch {
+	case actions["failed"]:
+		return ":x: *Delivery failed*"
+	case actions["delayed"]:
+		return ":hourglass_flowing_sand: *Delivery delayed*"
+	default:
+		return ":incoming_envelope: *Delivery status notification*"
+	}
+}
+
+// DeliveryStatusToBlocks returns the blocks summarizing a delivery status: the status
+// code and reason of each recipient. Its values are always escaped, so no option applies.
+func DeliveryStatusToBlocks(dsn string) ([]slack.Block, error) {
+	status, err := ParseDeliveryStatus(sanitizeUTF8(dsn))
+	if err != nil {
+		return nil, err
+	}
+
+	lines := []string{status.title()}
+	for _, recipient := range status.Recipients {
+		line := "• *" + escapeMrkdwn(recipient.Recipient) + "*"
+		if recipient.Action != "" {
+			line += ": " + escapeMrkdwn(recipient.Action)
+		}
+		if recipient.Status != "" {
+			line += " (" + escapeMrkdwn(recipient.Status) + ")"
+		}
+		if recipient.Diagnostic != "" {
+			line += "\n    " + escapeMrkdwn(recipient.Diagnostic)
+		}
+		lines = append(lines, line)
+	}
+	if status.ReportingMTA != "" {
+		lines = append(lines, "*Reported by:* "+escapeMrkdwn(status.ReportingMTA))
+	}
+
+	return []slack.Block{
+		&slack.SectionBlock{
+			Type: slack.MBTSection,
+			Text: &slack.TextBlockObject{
+				Type: slack.MarkdownType,
+				Text: strings.Join(lines, "\n"),
+			},
+		},
+	}, nil
+}
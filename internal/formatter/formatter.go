@@ -0,0 +1,470 @@
+package formatter
+
+import (
+	"errors"
+	"go-smtp-slacker/internal/logger"
+	"net/url"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/JohannesKaufmann/html-to-markdown/v2/converter"
+	"github.com/JohannesKaufmann/html-to-markdown/v2/plugin/base"
+	"github.com/JohannesKaufmann/html-to-markdown/v2/plugin/commonmark"
+	"github.com/JohannesKaufmann/html-to-markdown/v2/plugin/strikethrough"
+	"github.com/JohannesKaufmann/html-to-markdown/v2/plugin/table"
+	"github.com/slack-go/slack"
+	util "github.com/takara2314/slack-go-util"
+	"golang.org/x/net/html"
+)
+
+// Errors returned when the selected body is empty
+var (
+	ErrEmptyHTMLBody = errors.New("empty HTML body")
+	ErrEmptyTextBody = errors.New("empty plain text body")
+)
+
+// Options holds the settings for converting a message body to Slack blocks.
+type Options struct {
+	// PreferHTML selects the HTML body over the plain text one.
+	PreferHTML bool
+	// EscapeMentions neutralizes mentions (e.g. <!channel> or <@U123>) in the body.
+	EscapeMentions bool
+	// QuoteBody renders the body as a block quote.
+	QuoteBody bool
+	// TrimSignature removes the signature (after a "-- " line) from the body.
+	TrimSignature bool
+	// SignatureMarkers are the starts of the lines also beginning a signature (e.g. a
+	// legal disclaimer), when trimming it.
+	SignatureMarkers []string
+	// HeadingStyle renders the HTML headings as header blocks (default) or bold text.
+	HeadingStyle string
+	// HeadingPrefixes are shown before the HTML headings of each tag (e.g. "h1"), e.g. an emoji.
+	HeadingPrefixes map[string]string
+	// EscapeMode escapes the markdown characters of HTML bodies (default) or not.
+	EscapeMode string
+	// NormalizeLineEndings converts the Windows (\r\n) and classic Mac (\r) line endings
+	// of the body to \n before converting it.
+	NormalizeLineEndings bool
+	// StripNonContent removes the head, style and script elements of HTML bodies, whose
+	// text isn't part of the message, before converting them.
+	StripNonContent bool
+}
+
+// nonContentTags are the HTML elements removed by Options.StripNonContent
+var nonContentTags = []string{"head", "style", "script"}
+
+// mentionRegexp matches Slack's special sequences notifying users or channels:
+// user (<@U123>), channel (<#C123>) and broadcast or group (<!here>, <!subteam^S123>) mentions.
+var mentionRegexp = regexp.MustCompile(`<([@#!][^<>]*)>`)
+
+// EscapeMentions escapes the mention sequences in a mrkdwn text, so they are shown as
+// is instead of notifying anyone.
+func EscapeMentions(text string) string {
+	return mentionRegexp.ReplaceAllString(text, "&lt;$1&gt;")
+}
+
+// escapeBlockMentions escapes the mentions in the mrkdwn texts of the blocks. The
+// texts of the other blocks (e.g. rich text or headers) are never parsed for mentions.
+func escapeBlockMentions(blocks []slack.Block) {
+	escape := func(text *slack.TextBlockObject) {
+		if text != nil && text.Type == slack.MarkdownType {
+			text.Text = EscapeMentions(text.Text)
+		}
+	}
+
+	for _, block := range blocks {
+		switch b := block.(type) {
+		case *slack.SectionBlock:
+			escape(b.Text)
+			for _, field := range b.Fields {
+				escape(field)
+			}
+		case *slack.ContextBlock:
+			for _, element := range b.ContextElements.Elements {
+				if text, ok := element.(*slack.TextBlockObject); ok {
+					escape(text)
+				}
+			}
+		}
+	}
+}
+
+// sanitizeUTF8 replaces invalid UTF-8 sequences (e.g. from a body declared with
+// the wrong charset) with the Unicode replacement character.
+func sanitizeUTF8(str string) string {
+	if utf8.ValidString(str) {
+		return str
+	}
+	logger.Warnf("Message body contains invalid UTF-8, replacing invalid sequences")
+	return strings.ToValidUTF8(str, "\uFFFD")
+}
+
+// NormalizeLineEndings converts the \r\n and lone \r line endings of a text to \n.
+func NormalizeLineEndings(text string) string {
+	if !strings.Contains(text, "\r") {
+		return text
+	}
+	return strings.ReplaceAll(strings.ReplaceAll(text, "\r\n", "\n"), "\r", "\n")
+}
+
+// ConvertToBlocks converts an email body to Slack blocks, using the HTML or the
+// plain text version according to opts. When the plain text is missing, it is
+// generated from the HTML as a last resort.
+func ConvertToBlocks(htmlBody, textBody string, opts Options) ([]slack.Block, error) {
+	blocks, err := convertToBlocks(htmlBody, textBody, opts)
+	if err != nil {
+		return nil, err
+	}
+	if opts.EscapeMentions {
+		escapeBlockMentions(blocks)
+	}
+	if opts.QuoteBody {
+		quoteBlocks(blocks)
+	}
+	return blocks, nil
+}
+
+// quoteMrkdwn prefixes each line of a mrkdwn text with a block quote marker.
+func quoteMrkdwn(text string) string {
+	lines := strings.Split(strings.TrimRight(text, "\n"), "\n")
+	for i, line := range lines {
+		if line == "" {
+			lines[i] = ">"
+		} else {
+			lines[i] = "> " + line
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// quoteBlocks quotes the mrkdwn texts of the section blocks. Other blocks (e.g. rich
+// text lists or headers) have no block quote equivalent and are left as is.
+func quoteBlocks(blocks []slack.Block) {
+	for _, block := range blocks {
+		if section, ok := block.(*slack.SectionBlock); ok && section.Text != nil && section.Text.Type == slack.MarkdownType {
+			section.Text.Text = quoteMrkdwn(section.Text.Text)
+		}
+	}
+}
+
+// convertToBlocks converts the body for ConvertToBlocks, before the mentions are escaped.
+func convertToBlocks(htmlBody, textBody string, opts Options) ([]slack.Block, error) {
+	htmlBody = sanitizeUTF8(htmlBody)
+	textBody = sanitizeUTF8(textBody)
+	if opts.NormalizeLineEndings {
+		htmlBody = NormalizeLineEndings(htmlBody)
+		textBody = NormalizeLineEndings(textBody)
+	}
+
+	if opts.PreferHTML {
+		if strings.TrimSpace(htmlBody) == "" {
+			return nil, ErrEmptyHTMLBody
+		}
+		logger.Debugf("Slack: Converting HTML message to Slack format")
+		return htmlToSlack(htmlBody, opts), nil
+	}
+
+	text := textBody
+	delimiter := textSignatureDelimiter
+	if strings.TrimSpace(text) == "" && strings.TrimSpace(htmlBody) != "" {
+		logger.Debugf("Slack: Plain text body is empty, generating it from the HTML body")
+		text = htmlToPlainText(htmlBody, opts.StripNonContent)
+		delimiter = htmlSignatureDelimiter
+	}
+	if strings.TrimSpace(text) == "" {
+		return nil, ErrEmptyTextBody
+	}
+	if opts.TrimSignature {
+		text = trimSignature(text, delimiter, opts.SignatureMarkers)
+	}
+	logger.Debugf("Slack: Using plain text message")
+	return textToSlack(text), nil
+}
+
+// Modes of escaping the characters of HTML bodies which are markdown syntax (e.g. "*" or "_"):
+// escaped only where they would format the text, or never, keeping the text as is.
+const (
+	EscapeModeSmart    = "smart"
+	EscapeModeDisabled = "disabled"
+)
+
+// htmlToMarkdown returns an html message in markdown
+func htmlToMarkdown(message string, opts Options) (string, error) {
+
+	escapeMode := converter.WithEscapeMode(converter.EscapeModeSmart)
+	if opts.EscapeMode == EscapeModeDisabled {
+		escapeMode = converter.WithEscapeMode(converter.EscapeModeDisabled)
+	}
+
+	c := converter.NewConverter(
+		escapeMode,
+		converter.WithPlugins(
+			base.NewBasePlugin(),
+			commonmark.NewCommonmarkPlugin(
+				commonmark.WithStrongDelimiter("**"), // bold
+				commonmark.WithEmDelimiter("_"),      // italic
+				commonmark.WithBulletListMarker("*"), // bullet list
+				commonmark.WithListEndComment(false), // do not mark the end of a list
+			),
+			table.NewTablePlugin(
+				// table.WithHeaderPromotion(true),
+				// table.WithSkipEmptyRows(true),
+				// table.WithSkipEmptyHeader(true),
+				// table.WithNewlineBehavior("delete"),
+				table.WithNewlineBehavior("preserve"),
+			),
+			strikethrough.NewStrikethroughPlugin(
+				strikethrough.WithDelimiter("~~"), // strikethrough
+			),
+		),
+	)
+
+	// the base plugin removes the head, style and script elements before rendering,
+	// which is overridden to render their text as is
+	if !opts.StripNonContent {
+		for _, tag := range nonContentTags {
+			c.Register.TagType(tag, converter.TagTypeBlock, converter.PriorityEarly)
+		}
+	}
+
+	// Override <br> — return two newlines (paragraph break).
+	c.Register.RendererFor(
+		"br",
+		converter.TagTypeInline,
+		func(ctx converter.Context, w converter.Writer, node *html.Node) converter.RenderStatus {
+			w.WriteString("\n\n")
+			return converter.RenderSuccess
+		},
+		converter.PriorityEarly,
+	)
+
+	// Add a renderer for <input type="checkbox">
+	c.Register.RendererFor(
+		"input",
+		converter.TagTypeInline,
+		func(ctx converter.Context, w converter.Writer, node *html.Node) converter.RenderStatus {
+			isCheckbox := false
+			isChecked := false
+			for _, attr := range node.Attr {
+				if attr.Key == "type" && attr.Val == "checkbox" {
+					isCheckbox = true
+				}
+				if attr.Key == "checked" {
+					isChecked = true
+				}
+			}
+
+			if isCheckbox {
+				w.WriteString(map[bool]string{true: "[x]", false: "[ ]"}[isChecked])
+				return converter.RenderSuccess
+			}
+			return converter.RenderTryNext
+		},
+		converter.PriorityEarly,
+	)
+
+	// Render nested lists and block quotes in a way their structure survives the
+	// conversion to blocks, see nestLists and joinQuoteLines
+	for _, tag := range []string{"ul", "ol"} {
+		c.Register.RendererFor(tag, converter.TagTypeBlock, renderList, converter.PriorityEarly)
+	}
+	c.Register.RendererFor("blockquote", converter.TagTypeBlock, renderBlockquote, converter.PriorityEarly)
+
+	// Render the headings in the configured style, see headingRenderer
+	for _, tag := range headingTags {
+		c.Register.RendererFor(tag, converter.TagTypeBlock, headingRenderer(opts), converter.PriorityEarly)
+	}
+
+	// Render links with their text content only: formatting within the link text
+	// (e.g. <a><b>text</b></a>) would otherwise be dropped with the text by the
+	// markdown to Slack conversion.
+	c.Register.RendererFor(
+		"a",
+		converter.TagTypeInline,
+		func(ctx converter.Context, w converter.Writer, node *html.Node) converter.RenderStatus {
+			href := ""
+			for _, attr := range node.Attr {
+				if attr.Key == "href" {
+					href = strings.TrimSpace(attr.Val)
+				}
+			}
+			text := strings.Join(strings.Fields(nodeText(node)), " ")
+
+			// anchors and relative links can't be opened from Slack, keep their text only
+			if !isAbsoluteLink(href) {
+				w.WriteString(text)
+				return converter.RenderSuccess
+			}
+			if text == "" {
+				text = href
+			}
+
+			w.WriteString("[" + text + "](" + linkURLReplacer.Replace(href) + ")")
+			return converter.RenderSuccess
+		},
+		converter.PriorityEarly,
+	)
+
+	logger.Tracef("Slack: Converting HTML message to markdown")
+	return c.ConvertString(message)
+}
+
+// linkURLReplacer escapes the characters ending a markdown link destination.
+var linkURLReplacer = strings.NewReplacer(" ", "%20", "(", "%28", ")", "%29")
+
+// markdownLinkRegexp matches markdown links, e.g. [text](url)
+var markdownLinkRegexp = regexp.MustCompile(`\[([^\[\]]*)\]\(([^()\s]*)\)`)
+
+// isAbsoluteLink reports whether href is a link that can be opened from Slack.
+func isAbsoluteLink(href string) bool {
+	u, err := url.Parse(href)
+	if err != nil {
+		return false
+	}
+	switch strings.ToLower(u.Scheme) {
+	case "http", "https":
+		return u.Host != ""
+	case "mailto":
+		return u.Opaque != ""
+	}
+	return false
+}
+
+// nodeText returns the text content of an html node.
+func nodeText(n *html.Node) string {
+	if n.Type == html.TextNode {
+		return n.Data
+	}
+	var sb strings.Builder
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		sb.WriteString(nodeText(c))
+	}
+	return sb.String()
+}
+
+// htmlToSlack returns an html message in a Slack format.
+func htmlToSlack(message string, opts Options) []slack.Block {
+
+	// convert html to markdown
+	markdown, err := htmlToMarkdown(message, opts)
+	if err == nil && opts.TrimSignature {
+		markdown = trimSignature(markdown, htmlSignatureDelimiter, opts.SignatureMarkers)
+	}
+	if err != nil {
+		// fallback to the original message within a block if conversion fails
+		return []slack.Block{
+			&slack.SectionBlock{
+				Type: slack.MBTSection,
+				Text: &slack.TextBlockObject{
+					Type: slack.MarkdownType,
+					Text: message,
+				},
+			},
+		}
+	}
+
+	// convert markdown entities to Slack blocks
+	logger.Tracef("Slack: Converting markdown message to Slack format")
+	blocks, err := util.ConvertMarkdownTextToBlocks(markdown)
+
+	if err != nil {
+		// fallback to the original message within a block if conversion fails
+		return []slack.Block{
+			&slack.SectionBlock{
+				Type: slack.MBTSection,
+				Text: &slack.TextBlockObject{
+					Type: slack.MarkdownType,
+					Text: message,
+				},
+			},
+		}
+	}
+
+	blocks = nestLists(blocks)
+	joinQuoteLines(blocks)
+
+	// Links in sections are converted to Slack's <url|text> format, but headers are
+	// plain text where links can't be rendered, so keep only their text
+	for _, block := range blocks {
+		if header, ok := block.(*slack.HeaderBlock); ok && header.Text != nil {
+			header.Text.Text = markdownLinkRegexp.ReplaceAllString(header.Text.Text, "$1")
+		}
+	}
+
+	return dropBlankBlocks(blocks)
+}
+
+// htmlToPlainText strips the tags from an html message, keeping its text content
+// and line breaks between block elements. The text of the head, style and script
+// elements is only kept when stripNonContent is false.
+func htmlToPlainText(message string, stripNonContent bool) string {
+	doc, err := html.Parse(strings.NewReader(message))
+	if err != nil {
+		return message
+	}
+
+	var sb strings.Builder
+	var walk func(n *html.Node)
+	walk = func(n *html.Node) {
+		if n.Type == html.ElementNode {
+			switch n.Data {
+			case "head", "script", "style", "title":
+				if stripNonContent {
+					return
+				}
+			case "br":
+				sb.WriteString("\n")
+				return
+			}
+		}
+		if n.Type == html.TextNode {
+			// whitespace in html text is not significant, line breaks are added by the elements
+			sb.WriteString(strings.NewReplacer("\r", " ", "\n", " ", "\t", " ").Replace(n.Data))
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
+		if n.Type == html.ElementNode {
+			switch n.Data {
+			case "p", "div", "li", "tr", "table", "ul", "ol", "blockquote", "pre", "h1", "h2", "h3", "h4", "h5", "h6", "title", "style", "script":
+				sb.WriteString("\n")
+			}
+		}
+	}
+	walk(doc)
+
+	// trim the lines and drop consecutive blank lines
+	var lines []string
+	for _, line := range strings.Split(sb.String(), "\n") {
+		line = strings.Join(strings.Fields(line), " ")
+		if line == "" && (len(lines) == 0 || lines[len(lines)-1] == "") {
+			continue
+		}
+		lines = append(lines, line)
+	}
+	return strings.TrimSpace(strings.Join(lines, "\n"))
+}
+
+func textToSlack(message string) []slack.Block {
+	// replace the markdown italic __ with slack's implementation _
+	// message = strings.ReplaceAll(message, "__", "_")
+	// // replace single * with _ for italic slack's implementation _
+	// re := regexp.MustCompile(`[\*]{1}(.*?)[\*]{1}`)
+	// message = re.ReplaceAllString(message, "_$1_")
+	// // replace the markdown bold **  with slack's implementation *
+	// message = strings.ReplaceAll(message, "**", "*")
+	// // replace the markdown strikethrough ~~ with slack's implementation ~
+	// message = strings.ReplaceAll(message, "~~", "~")
+	logger.Tracef("Slack: Converting text message to Slack format")
+
+	return dropBlankBlocks([]slack.Block{
+		&slack.SectionBlock{
+			Type: slack.MBTSection,
+			Text: &slack.TextBlockObject{
+				Type: slack.MarkdownType,
+				Text: message,
+			},
+		},
+	})
+}
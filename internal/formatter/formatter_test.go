@@ -0,0 +1,837 @@
+package formatter
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/slack-go/slack"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// sectionTexts returns the text of the section blocks.
+func sectionTexts(blocks []slack.Block) []string {
+	var texts []string
+	for _, block := range blocks {
+		if section, ok := block.(*slack.SectionBlock); ok && section.Text != nil {
+			texts = append(texts, section.Text.Text)
+		}
+	}
+	return texts
+}
+
+func TestConvertToBlocks(t *testing.T) {
+	testCases := []struct {
+		name          string
+		html          string
+		text          string
+		opts          Options
+		expectedErr   error
+		expectedTexts []string
+		expectedTypes []slack.MessageBlockType
+	}{
+		{
+			name:          "inline formatting",
+			html:          "<p>Hello <b>world</b> and <i>italic</i></p>",
+			opts:          Options{PreferHTML: true},
+			expectedTexts: []string{"Hello *world* and _italic_"},
+		},
+		{
+			name:          "links",
+			html:          `<p>A <a href="https://example.com">link</a></p>`,
+			opts:          Options{PreferHTML: true},
+			expectedTexts: []string{"A <https://example.com|link>"},
+		},
+		{
+			name:          "formatted link text",
+			html:          `<p>See <a href="https://example.com/b"><b>the</b> docs</a></p>`,
+			opts:          Options{PreferHTML: true},
+			expectedTexts: []string{"See <https://example.com/b|the docs>"},
+		},
+		{
+			name:          "link without text",
+			html:          `<p><a href="https://example.com/i"><img src="https://example.com/i.png"></a></p>`,
+			opts:          Options{PreferHTML: true},
+			expectedTexts: []string{"<https://example.com/i|https://example.com/i>"},
+		},
+		{
+			name:          "link url with spaces and parentheses",
+			html:          `<p><a href="https://example.com/a b(1)">file (1)</a></p>`,
+			opts:          Options{PreferHTML: true},
+			expectedTexts: []string{"<https://example.com/a%20b%281%29|file (1)>"},
+		},
+		{
+			name:          "mailto links",
+			html:          `<p><a href="mailto:ops@example.com">ops</a></p>`,
+			opts:          Options{PreferHTML: true},
+			expectedTexts: []string{"<mailto:ops@example.com|ops>"},
+		},
+		{
+			name:          "anchors and relative links keep their text",
+			html:          `<p><a href="#top">top</a>, <a href="/path">path</a> and <a name="x">anchor</a></p>`,
+			opts:          Options{PreferHTML: true},
+			expectedTexts: []string{"top, path and anchor"},
+		},
+		{
+			name:          "head, style and script are dropped",
+			html:          "<html><head><title>Report</title><style>p { color: red; }</style></head><body><style>.x{}</style><p>Disk full</p><script>alert('x')</script><noscript>enable js</noscript></body></html>",
+			opts:          Options{PreferHTML: true, StripNonContent: true},
+			expectedTexts: []string{"Disk full"},
+		},
+		{
+			name:          "style and script are dropped from the plain text fallback",
+			html:          "<html><head><style>p { color: red; }</style></head><body><p>Disk full</p><script>alert('x')</script></body></html>",
+			opts:          Options{StripNonContent: true},
+			expectedTexts: []string{"Disk full"},
+		},
+		{
+			name:          "head, style and script are kept",
+			html:          "<html><head><title>Report</title></head><body><style>.x{}</style><p>Disk full</p><script>alert('x')</script></body></html>",
+			opts:          Options{PreferHTML: true},
+			expectedTexts: []string{"Report\n.x{}\nDisk full\nalert('x')"},
+		},
+		{
+			name:          "style and script are kept in the plain text fallback",
+			html:          "<html><head><title>Report</title></head><body><style>.x{}</style><p>Disk full</p><script>alert('x')</script></body></html>",
+			expectedTexts: []string{"Report\n.x{}\nDisk full\nalert('x')"},
+		},
+		{
+			name:          "line breaks",
+			html:          "<p>line1<br>line2</p>",
+			opts:          Options{PreferHTML: true},
+			expectedTexts: []string{"line1\nline2"},
+		},
+		{
+			name:          "checkboxes",
+			html:          `<p><input type="checkbox" checked> done <input type="checkbox"> todo</p>`,
+			opts:          Options{PreferHTML: true},
+			expectedTexts: []string{"[x] done [ ] todo"},
+		},
+		{
+			name:          "tables",
+			html:          "<table><tr><th>a</th><th>b</th></tr><tr><td>1</td><td>2</td></tr></table>",
+			opts:          Options{PreferHTML: true},
+			expectedTexts: []string{"| a | b |\n|---|---|\n| 1 | 2 |"},
+		},
+		{
+			name:          "lists",
+			html:          "<ul><li>one</li><li>two</li></ul>",
+			opts:          Options{PreferHTML: true},
+			expectedTypes: []slack.MessageBlockType{slack.MBTRichText},
+		},
+		{
+			name:        "empty HTML body",
+			html:        "  ",
+			text:        "plain text",
+			opts:        Options{PreferHTML: true},
+			expectedErr: ErrEmptyHTMLBody,
+		},
+		{
+			name:          "plain text is used as is",
+			html:          "<p>ignored</p>",
+			text:          "plain *text*",
+			expectedTexts: []string{"plain *text*"},
+		},
+		{
+			name:          "plain text generated from HTML",
+			html:          "<p>Server <b>db-1</b> is down</p>",
+			expectedTexts: []string{"Server db-1 is down"},
+		},
+		{
+			name:          "latin-1 text declared as UTF-8",
+			text:          "Caf\xe9 ferm\xe9",
+			expectedTexts: []string{"Caf\uFFFD ferm\uFFFD"},
+		},
+		{
+			name:          "latin-1 HTML declared as UTF-8",
+			html:          "<p>Caf\xe9</p>",
+			opts:          Options{PreferHTML: true},
+			expectedTexts: []string{"Caf\uFFFD"},
+		},
+		{
+			name:          "mentions are escaped in plain text",
+			text:          "Hey <!channel> and <!here>, ping <@U123> in <#C123> or <!subteam^S123>",
+			opts:          Options{EscapeMentions: true},
+			expectedTexts: []string{"Hey &lt;!channel&gt; and &lt;!here&gt;, ping &lt;@U123&gt; in &lt;#C123&gt; or &lt;!subteam^S123&gt;"},
+		},
+		{
+			name:          "mentions are kept when not escaping",
+			text:          "Hey <!channel>",
+			expectedTexts: []string{"Hey <!channel>"},
+		},
+		{
+			name:          "mentions are escaped in HTML, links are kept",
+			html:          `<p>Hey &lt;!channel&gt;, see <a href="https://example.com">this</a></p>`,
+			opts:          Options{PreferHTML: true, EscapeMentions: true},
+			expectedTexts: []string{"Hey &lt;!channel&gt;, see <https://example.com|this>"},
+		},
+		{
+			name:          "quoted plain text",
+			text:          "line1\n\nline2\n",
+			opts:          Options{QuoteBody: true},
+			expectedTexts: []string{"> line1\n>\n> line2"},
+		},
+		{
+			name:          "quoted HTML",
+			html:          `<p>Hello <b>world</b>, see <a href="https://example.com">this</a></p>`,
+			opts:          Options{PreferHTML: true, QuoteBody: true},
+			expectedTexts: []string{"> Hello *world*, see <https://example.com|this>"},
+		},
+		{
+			name:          "unquoted plain text",
+			text:          "line1\nline2",
+			expectedTexts: []string{"line1\nline2"},
+		},
+		{
+			name:          "signature kept by default",
+			text:          "Disk full\n\n-- \nJohn Doe\nACME Corp",
+			expectedTexts: []string{"Disk full\n\n-- \nJohn Doe\nACME Corp"},
+		},
+		{
+			name:          "trimmed plain text signature",
+			text:          "Disk full\r\n\r\n-- \r\nJohn Doe\r\nACME Corp",
+			opts:          Options{TrimSignature: true},
+			expectedTexts: []string{"Disk full"},
+		},
+		{
+			name:          "trimmed HTML signature",
+			html:          "<p>Disk full</p><p>-- <br>John Doe<br>ACME Corp</p>",
+			opts:          Options{PreferHTML: true, TrimSignature: true},
+			expectedTexts: []string{"Disk full"},
+		},
+		{
+			name:          "trimmed signature of text generated from HTML",
+			html:          "<p>Disk full</p><p>-- <br>John Doe</p>",
+			opts:          Options{TrimSignature: true},
+			expectedTexts: []string{"Disk full"},
+		},
+		{
+			name:          "trimmed disclaimer marker",
+			html:          "<p>Disk full</p><p><b>Confidentiality notice:</b> this email is confidential</p>",
+			opts:          Options{PreferHTML: true, TrimSignature: true, SignatureMarkers: []string{"confidentiality notice"}},
+			expectedTexts: []string{"Disk full"},
+		},
+		{
+			name:        "no body at all",
+			expectedErr: ErrEmptyTextBody,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			blocks, err := ConvertToBlocks(tc.html, tc.text, tc.opts)
+			if tc.expectedErr != nil {
+				assert.ErrorIs(t, err, tc.expectedErr)
+				return
+			}
+			require.NoError(t, err)
+
+			if tc.expectedTexts != nil {
+				assert.Equal(t, tc.expectedTexts, sectionTexts(blocks))
+			}
+			if tc.expectedTypes != nil {
+				var types []slack.MessageBlockType
+				for _, block := range blocks {
+					types = append(types, block.BlockType())
+				}
+				assert.Equal(t, tc.expectedTypes, types)
+			}
+		})
+	}
+}
+
+func TestTrimSignature(t *testing.T) {
+	testCases := []struct {
+		name      string
+		text      string
+		delimiter string
+		markers   []string
+		expected  string
+	}{
+		{
+			name:      "standard delimiter",
+			text:      "Hello\n\n-- \nJohn Doe\n+1 555 0100",
+			delimiter: textSignatureDelimiter,
+			expected:  "Hello",
+		},
+		{
+			name:      "delimiter without trailing space is not a signature in plain text",
+			text:      "Hello\n--\nJohn Doe",
+			delimiter: textSignatureDelimiter,
+			expected:  "Hello\n--\nJohn Doe",
+		},
+		{
+			name:      "the first delimiter wins",
+			text:      "Hello\n-- \nJohn\n-- \nACME",
+			delimiter: textSignatureDelimiter,
+			expected:  "Hello",
+		},
+		{
+			name:      "marker",
+			text:      "Hello\nSent from my phone",
+			delimiter: textSignatureDelimiter,
+			markers:   []string{"Sent from my"},
+			expected:  "Hello",
+		},
+		{
+			name:      "only a signature",
+			text:      "-- \nJohn Doe",
+			delimiter: textSignatureDelimiter,
+			expected:  "-- \nJohn Doe",
+		},
+		{
+			name:      "no signature",
+			text:      "Hello\nWorld",
+			delimiter: textSignatureDelimiter,
+			markers:   []string{"disclaimer"},
+			expected:  "Hello\nWorld",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, trimSignature(tc.text, tc.delimiter, tc.markers))
+		})
+	}
+}
+
+func TestConvertToBlocksLinksOutsideSections(t *testing.T) {
+	t.Run("links in lists", func(t *testing.T) {
+		blocks, err := ConvertToBlocks(`<ul><li>see <a href="https://example.com/a"><b>docs</b></a></li></ul>`, "", Options{PreferHTML: true})
+		require.NoError(t, err)
+		require.Len(t, blocks, 1)
+
+		richText, ok := blocks[0].(*slack.RichTextBlock)
+		require.True(t, ok)
+		list, ok := richText.Elements[0].(*slack.RichTextList)
+		require.True(t, ok)
+		section, ok := list.Elements[0].(*slack.RichTextSection)
+		require.True(t, ok)
+		assert.Contains(t, section.Elements, &slack.RichTextSectionLinkElement{
+			Type: slack.RTSELink,
+			URL:  "https://example.com/a",
+			Text: "docs",
+		})
+	})
+
+	t.Run("links in headings", func(t *testing.T) {
+		blocks, err := ConvertToBlocks(`<h1>Incident <a href="https://example.com/i/1">#1</a></h1>`, "", Options{PreferHTML: true})
+		require.NoError(t, err)
+		require.Len(t, blocks, 1)
+
+		header, ok := blocks[0].(*slack.HeaderBlock)
+		require.True(t, ok)
+		assert.Equal(t, "Incident #1", header.Text.Text)
+	})
+}
+
+func TestConvertToBlocksHeadings(t *testing.T) {
+	const body = `<h1>Deploy <b>failed</b></h1><p>Build 42 failed.</p><h3>Logs</h3><p>See below.</p><h2> </h2>`
+	prefixes := map[string]string{"h1": ":rotating_light:", "h3": ":small_blue_diamond:"}
+
+	t.Run("header blocks", func(t *testing.T) {
+		blocks, err := ConvertToBlocks(body, "", Options{PreferHTML: true})
+		require.NoError(t, err)
+		require.Len(t, blocks, 4)
+
+		header, ok := blocks[0].(*slack.HeaderBlock)
+		require.True(t, ok, "unexpected block %T", blocks[0])
+		assert.Equal(t, "Deploy failed", header.Text.Text, "formatting isn't shown literally")
+		header, ok = blocks[2].(*slack.HeaderBlock)
+		require.True(t, ok, "unexpected block %T", blocks[2])
+		assert.Equal(t, "Logs", header.Text.Text)
+		assert.Equal(t, []string{"Build 42 failed.", "See below."}, sectionTexts(blocks))
+	})
+
+	t.Run("header blocks with prefixes", func(t *testing.T) {
+		blocks, err := ConvertToBlocks(body, "", Options{PreferHTML: true, HeadingPrefixes: prefixes})
+		require.NoError(t, err)
+		require.Len(t, blocks, 4)
+
+		assert.Equal(t, ":rotating_light: Deploy failed", blocks[0].(*slack.HeaderBlock).Text.Text)
+		assert.Equal(t, ":small_blue_diamond: Logs", blocks[2].(*slack.HeaderBlock).Text.Text)
+	})
+
+	t.Run("bold text", func(t *testing.T) {
+		blocks, err := ConvertToBlocks(body, "", Options{PreferHTML: true, HeadingStyle: HeadingStyleBold})
+		require.NoError(t, err)
+
+		for _, block := range blocks {
+			assert.NotEqual(t, slack.MBTHeader, block.BlockType())
+		}
+		assert.Equal(t, []string{"*Deploy failed*\nBuild 42 failed.\n*Logs*\nSee below."}, sectionTexts(blocks))
+	})
+
+	t.Run("bold text with prefixes", func(t *testing.T) {
+		blocks, err := ConvertToBlocks(`<h1>Deploy</h1><h6>Details</h6>`, "", Options{PreferHTML: true, HeadingStyle: HeadingStyleBold, HeadingPrefixes: prefixes})
+		require.NoError(t, err)
+
+		assert.Equal(t, []string{":rotating_light: *Deploy*\n*Details*"}, sectionTexts(blocks))
+	})
+}
+
+func TestConvertToBlocksEscapeMode(t *testing.T) {
+	const body = `<p>Run snake_case_name with 2*3*4 and C:\Temp</p><p># not a heading</p>`
+
+	t.Run("smart", func(t *testing.T) {
+		for _, mode := range []string{"", EscapeModeSmart} {
+			blocks, err := ConvertToBlocks(body, "", Options{PreferHTML: true, EscapeMode: mode})
+			require.NoError(t, err)
+			require.Len(t, blocks, 1)
+			assert.Equal(t, []string{"Run snake\\_case\\_name with 2\\*3\\*4 and C:\\\\Temp\n\\# not a heading"}, sectionTexts(blocks), "mode %q", mode)
+		}
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		blocks, err := ConvertToBlocks(body, "", Options{PreferHTML: true, EscapeMode: EscapeModeDisabled})
+		require.NoError(t, err)
+		require.Len(t, blocks, 2)
+
+		// the text is kept as is, but the markdown characters format it
+		assert.Equal(t, []string{"Run snake_case_name with 2_3_4 and C:\\Temp"}, sectionTexts(blocks))
+		header, ok := blocks[1].(*slack.HeaderBlock)
+		require.True(t, ok, "unexpected block %T", blocks[1])
+		assert.Equal(t, "not a heading", header.Text.Text)
+	})
+}
+
+// describeLists summarizes the lists of rich text blocks, one line per item: its style,
+// indent and number (offset of its list + position, bullet lists having no offset), and text.
+func describeLists(t *testing.T, blocks []slack.Block) [][]string {
+	t.Helper()
+	var described [][]string
+	for _, block := range blocks {
+		richText, ok := block.(*slack.RichTextBlock)
+		require.True(t, ok, "unexpected block %T", block)
+
+		var lines []string
+		for _, element := range richText.Elements {
+			list, ok := element.(*slack.RichTextList)
+			require.True(t, ok, "unexpected element %T", element)
+			for i, item := range list.Elements {
+				var text string
+				for _, e := range item.(*slack.RichTextSection).Elements {
+					text += e.(*slack.RichTextSectionTextElement).Text
+				}
+				lines = append(lines, fmt.Sprintf("%s/%d/%d: %s", list.Style, list.Indent, list.Offset+i+1, text))
+			}
+		}
+		described = append(described, lines)
+	}
+	return described
+}
+
+func TestConvertToBlocksNestedLists(t *testing.T) {
+	testCases := []struct {
+		name     string
+		html     string
+		expected [][]string
+	}{
+		{
+			name: "flat list",
+			html: "<ul><li>one</li><li>two</li></ul>",
+			expected: [][]string{
+				{"bullet/0/1: one", "bullet/0/2: two"},
+			},
+		},
+		{
+			name: "nested bullet lists",
+			html: "<ul><li>one<ul><li>one.a</li><li>one.b<ul><li>deep</li></ul></li></ul></li><li>two</li></ul>",
+			expected: [][]string{
+				{"bullet/0/1: one", "bullet/1/1: one.a", "bullet/1/2: one.b", "bullet/2/1: deep", "bullet/0/1: two"},
+			},
+		},
+		{
+			name: "ordered lists keep their numbering around nested lists",
+			html: `<ol start="3"><li>first<ul><li>detail</li></ul></li><li>second<ol><li>step</li><li>step</li></ol></li><li>third</li></ol>`,
+			expected: [][]string{
+				{"ordered/0/3: first", "bullet/1/1: detail", "ordered/0/4: second", "ordered/1/1: step", "ordered/1/2: step", "ordered/0/5: third"},
+			},
+		},
+		{
+			name: "items with only a nested list",
+			html: "<ul><li><ul><li>nested</li></ul></li><li>two</li></ul>",
+			expected: [][]string{
+				{"bullet/1/1: nested", "bullet/0/1: two"},
+			},
+		},
+		{
+			name: "separate lists stay apart",
+			html: "<ul><li>one</li></ul><p>between</p><ul><li>two</li></ul><ol><li>three</li></ol>",
+			expected: [][]string{
+				{"bullet/0/1: one"},
+				nil, // the paragraph
+				{"bullet/0/1: two"},
+				{"ordered/0/1: three"},
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			blocks, err := ConvertToBlocks(tc.html, "", Options{PreferHTML: true})
+			require.NoError(t, err)
+
+			// skip the sections, only described by their position
+			var described [][]string
+			for _, block := range blocks {
+				if _, ok := block.(*slack.SectionBlock); ok {
+					described = append(described, nil)
+					continue
+				}
+				described = append(described, describeLists(t, []slack.Block{block})...)
+			}
+			assert.Equal(t, tc.expected, described)
+		})
+	}
+
+	t.Run("formatting in nested items", func(t *testing.T) {
+		blocks, err := ConvertToBlocks(`<ul><li>top<ul><li><b>bold</b> and <a href="https://example.com">link</a></li></ul></li></ul>`, "", Options{PreferHTML: true})
+		require.NoError(t, err)
+		require.Len(t, blocks, 1)
+
+		lists := blocks[0].(*slack.RichTextBlock).Elements
+		require.Len(t, lists, 2)
+		nested := lists[1].(*slack.RichTextList)
+		assert.Equal(t, 1, nested.Indent)
+		assert.Equal(t, []slack.RichTextSectionElement{
+			&slack.RichTextSectionTextElement{Type: slack.RTSEText, Text: "bold", Style: &slack.RichTextSectionTextStyle{Bold: true}},
+			&slack.RichTextSectionTextElement{Type: slack.RTSEText, Text: " and "},
+			&slack.RichTextSectionLinkElement{Type: slack.RTSELink, Text: "link", URL: "https://example.com"},
+		}, nested.Elements[0].(*slack.RichTextSection).Elements)
+	})
+}
+
+func TestConvertToBlocksBlockquotes(t *testing.T) {
+	testCases := []struct {
+		name     string
+		html     string
+		expected []string
+	}{
+		{
+			name:     "single line",
+			html:     "<blockquote>quoted</blockquote>",
+			expected: []string{"quoted"},
+		},
+		{
+			name:     "paragraphs in a single quote",
+			html:     "<blockquote><p>first <b>line</b></p><p></p><p>second<br>third</p></blockquote>",
+			expected: []string{"first line\nsecond\nthird"},
+		},
+		{
+			name:     "nested quotes are flattened",
+			html:     "<blockquote><p>reply</p><blockquote><p>original</p></blockquote></blockquote>",
+			expected: []string{"reply\noriginal"},
+		},
+		{
+			name:     "lines looking like markdown",
+			html:     "<blockquote><p># not a heading</p><p>- not a list</p></blockquote>",
+			expected: []string{"# not a heading\n- not a list"},
+		},
+		{
+			name:     "separate quotes",
+			html:     "<blockquote>one</blockquote><p>between</p><blockquote>two</blockquote>",
+			expected: []string{"one", "two"},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			blocks, err := ConvertToBlocks(tc.html, "", Options{PreferHTML: true})
+			require.NoError(t, err)
+
+			var quotes []string
+			for _, block := range blocks {
+				richText, ok := block.(*slack.RichTextBlock)
+				if !ok {
+					continue
+				}
+				for _, element := range richText.Elements {
+					quote, ok := element.(*slack.RichTextQuote)
+					require.True(t, ok)
+					require.Len(t, quote.Elements, 1)
+					quotes = append(quotes, quote.Elements[0].(*slack.RichTextSectionTextElement).Text)
+				}
+			}
+			assert.Equal(t, tc.expected, quotes)
+		})
+	}
+}
+
+func TestHtmlToPlainText(t *testing.T) {
+	testCases := []struct {
+		name     string
+		html     string
+		expected string
+	}{
+		{
+			name:     "simple paragraph",
+			html:     "<p>Hello <b>world</b></p>",
+			expected: "Hello world",
+		},
+		{
+			name:     "paragraphs and line breaks",
+			html:     "<html><head><title>Alert</title><style>p { color: red; }</style></head><body><p>First line<br>Second line</p><p>Third line</p></body></html>",
+			expected: "First line\nSecond line\nThird line",
+		},
+		{
+			name:     "scripts are dropped",
+			html:     "<div>Visible</div><script>alert('hidden')</script>",
+			expected: "Visible",
+		},
+		{
+			name:     "lists",
+			html:     "<ul>\n  <li>one</li>\n  <li>two</li>\n</ul>",
+			expected: "one\ntwo",
+		},
+		{
+			name:     "entities are decoded",
+			html:     "<p>Tom &amp; Jerry</p>",
+			expected: "Tom & Jerry",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, htmlToPlainText(tc.html, true))
+		})
+	}
+}
+
+const sampleInvite = "BEGIN:VCALENDAR\r\n" +
+	"PRODID:-//Example Corp//Calendar//EN\r\n" +
+	"VERSION:2.0\r\n" +
+	"METHOD:REQUEST\r\n" +
+	"BEGIN:VTIMEZONE\r\n" +
+	"TZID:Europe/Lisbon\r\n" +
+	"END:VTIMEZONE\r\n" +
+	"BEGIN:VEVENT\r\n" +
+	"UID:1234@example.com\r\n" +
+	"ORGANIZER;CN=\"Alice Doe\":mailto:alice@example.com\r\n" +
+	"DTSTART;TZID=Europe/Lisbon:20240105T100000\r\n" +
+	"DTEND;TZID=Europe/Lisbon:20240105T110000\r\n" +
+	"SUMMARY:Weekly sync\\, infra\r\n" +
+	"LOCATION:Room 1 - very long location name folded over\r\n" +
+	"  two lines\r\n" +
+	"END:VEVENT\r\n" +
+	"END:VCALENDAR\r\n"
+
+func TestCalendarToBlocks(t *testing.T) {
+	testCases := []struct {
+		name         string
+		ics          string
+		opts         Options
+		expectedErr  error
+		expectedText string
+	}{
+		{
+			name: "meeting invite",
+			ics:  sampleInvite,
+			expectedText: ":calendar: *Weekly sync, infra*\n" +
+				"*When:* Fri, 05 Jan 2024 10:00 – 11:00 (Europe/Lisbon)\n" +
+				"*Where:* Room 1 - very long location name folded over two lines\n" +
+				"*Organizer:* Alice Doe",
+		},
+		{
+			name: "UTC times over multiple days",
+			ics:  "BEGIN:VCALENDAR\nBEGIN:VEVENT\nSUMMARY:Offsite\nDTSTART:20240105T160000Z\nDTEND:20240106T120000Z\nORGANIZER:mailto:bob@example.com\nEND:VEVENT\nEND:VCALENDAR\n",
+			expectedText: ":calendar: *Offsite*\n" +
+				"*When:* Fri, 05 Jan 2024 16:00 – Sat, 06 Jan 2024 12:00 (UTC)\n" +
+				"*Organizer:* bob@example.com",
+		},
+		{
+			name: "all-day event",
+			ics:  "BEGIN:VCALENDAR\nBEGIN:VEVENT\nSUMMARY:Holiday\nDTSTART;VALUE=DATE:20240105\nDTEND;VALUE=DATE:20240106\nEND:VEVENT\nEND:VCALENDAR\n",
+			expectedText: ":calendar: *Holiday*\n" +
+				"*When:* Fri, 05 Jan 2024 (all day)",
+		},
+		{
+			name:         "cancelled event",
+			ics:          "BEGIN:VCALENDAR\nMETHOD:CANCEL\nBEGIN:VEVENT\nSUMMARY:Weekly sync\nEND:VEVENT\nEND:VCALENDAR\n",
+			expectedText: ":calendar: *Cancelled: Weekly sync*",
+		},
+		{
+			name:         "mentions are escaped",
+			ics:          "BEGIN:VCALENDAR\nBEGIN:VEVENT\nSUMMARY:<!channel> all hands\nEND:VEVENT\nEND:VCALENDAR\n",
+			opts:         Options{EscapeMentions: true},
+			expectedText: ":calendar: *&lt;!channel&gt; all hands*",
+		},
+		{
+			name:        "no event",
+			ics:         "BEGIN:VCALENDAR\nBEGIN:VTODO\nSUMMARY:Todo\nEND:VTODO\nEND:VCALENDAR\n",
+			expectedErr: ErrNoCalendarEvent,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			blocks, err := CalendarToBlocks(tc.ics, tc.opts)
+			if tc.expectedErr != nil {
+				assert.ErrorIs(t, err, tc.expectedErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, []string{tc.expectedText}, sectionTexts(blocks))
+		})
+	}
+}
+
+const sampleDeliveryStatus = "Reporting-MTA: dns; mx.example.com\r\n" +
+	"Arrival-Date: Fri, 5 Jan 2024 10:00:00 +0000\r\n" +
+	"\r\n" +
+	"Final-Recipient: rfc822; nobody@example.org\r\n" +
+	"Original-Recipient: rfc822; nobody@example.org\r\n" +
+	"Action: failed\r\n" +
+	"Status: 5.1.1\r\n" +
+	"Diagnostic-Code: smtp; 550 5.1.1 <nobody@example.org>: Recipient address\r\n" +
+	"    rejected: User unknown\r\n" +
+	"\r\n" +
+	"Final-Recipient: rfc822; slow@example.net\r\n" +
+	"Action: delayed\r\n" +
+	"Status: 4.4.1\r\n"
+
+func TestDeliveryStatusToBlocks(t *testing.T) {
+	testCases := []struct {
+		name         string
+		dsn          string
+		expectedErr  error
+		expectedText string
+	}{
+		{
+			name: "failed and delayed recipients",
+			dsn:  sampleDeliveryStatus,
+			expectedText: ":x: *Delivery failed*\n" +
+				"• *nobody@example.org*: failed (5.1.1)\n" +
+				"    550 5.1.1 &lt;nobody@example.org&gt;: Recipient address rejected: User unknown\n" +
+				"• *slow@example.net*: delayed (4.4.1)\n" +
+				"*Reported by:* mx.example.com",
+		},
+		{
+			name: "delayed recipient",
+			dsn:  "Reporting-MTA: dns; mx.example.com\n\nFinal-Recipient: rfc822; slow@example.net\nAction: delayed\nStatus: 4.4.1\n",
+			expectedText: ":hourglass_flowing_sand: *Delivery delayed*\n" +
+				"• *slow@example.net*: delayed (4.4.1)\n" +
+				"*Reported by:* mx.example.com",
+		},
+		{
+			name: "original recipient only",
+			dsn:  "Reporting-MTA: dns; mx.example.com\n\nOriginal-Recipient: rfc822; alice@example.com\nAction: delivered\nStatus: 2.0.0\n",
+			expectedText: ":incoming_envelope: *Delivery status notification*\n" +
+				"• *alice@example.com*: delivered (2.0.0)\n" +
+				"*Reported by:* mx.example.com",
+		},
+		{
+			name:        "no recipient",
+			dsn:         "Reporting-MTA: dns; mx.example.com\n",
+			expectedErr: ErrNoDeliveryStatus,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			blocks, err := DeliveryStatusToBlocks(tc.dsn)
+			if tc.expectedErr != nil {
+				assert.ErrorIs(t, err, tc.expectedErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, []string{tc.expectedText}, sectionTexts(blocks))
+		})
+	}
+}
+
+func TestConvertToBlocksBlankBlocks(t *testing.T) {
+	testCases := []struct {
+		name     string
+		html     string
+		text     string
+		expected []string
+	}{
+		{
+			name:     "blank code block",
+			html:     "<pre> \n\n</pre><p>after</p>",
+			expected: []string{"after"},
+		},
+		{
+			name:     "zero-width spacer paragraph",
+			html:     "<p>before</p><p>\u200b</p>",
+			expected: []string{"before"},
+		},
+		{
+			name:     "trailing line break left by an image",
+			html:     `<p>before</p><img src="https://example.com/logo.png">`,
+			expected: []string{"before"},
+		},
+		{
+			name:     "trailing blank lines of a text body",
+			text:     "first\n\nsecond \n\n\n",
+			expected: []string{"first\n\nsecond"},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			blocks, err := ConvertToBlocks(tc.html, tc.text, Options{PreferHTML: tc.html != ""})
+			require.NoError(t, err)
+			assert.Len(t, blocks, len(tc.expected))
+			assert.Equal(t, tc.expected, sectionTexts(blocks))
+		})
+	}
+}
+
+func TestDropBlankBlocks(t *testing.T) {
+	text := func(s string) *slack.TextBlockObject {
+		return slack.NewTextBlockObject(slack.MarkdownType, s, false, false)
+	}
+	richText := func(elements ...slack.RichTextSectionElement) *slack.RichTextSection {
+		return slack.NewRichTextSection(elements...)
+	}
+	blankText := slack.NewRichTextSectionTextElement(" \n", nil)
+	link := slack.NewRichTextSectionLinkElement("https://example.com", "", nil)
+
+	blocks := []slack.Block{
+		slack.NewSectionBlock(text(" \n\t"), nil, nil),
+		slack.NewSectionBlock(text("kept  \n"), nil, nil),
+		slack.NewSectionBlock(nil, []*slack.TextBlockObject{text("field")}, nil),
+		slack.NewHeaderBlock(slack.NewTextBlockObject(slack.PlainTextType, "\u200b", false, false)),
+		slack.NewRichTextBlock("", richText(blankText)),
+		slack.NewRichTextBlock("", slack.NewRichTextList(slack.RTEListBullet, 0, richText(blankText)), richText(link)),
+		slack.NewDividerBlock(),
+	}
+
+	kept := dropBlankBlocks(blocks)
+	require.Len(t, kept, 4)
+
+	assert.Equal(t, "kept", kept[0].(*slack.SectionBlock).Text.Text)
+	assert.Len(t, kept[1].(*slack.SectionBlock).Fields, 1)
+	// a link shows even without a text, the blank list around it is dropped
+	assert.Equal(t, []slack.RichTextElement{richText(link)}, kept[2].(*slack.RichTextBlock).Elements)
+	assert.Equal(t, slack.MBTDivider, kept[3].BlockType())
+}
+
+func TestConvertToBlocksLineEndings(t *testing.T) {
+	endings := map[string]string{"crlf": "\r\n", "cr": "\r"}
+
+	for name, eol := range endings {
+		t.Run(name, func(t *testing.T) {
+			text := "Line one" + eol + "Line two" + eol + eol + "Paragraph two" + eol
+			blocks, err := ConvertToBlocks("", text, Options{NormalizeLineEndings: true})
+			require.NoError(t, err)
+			assert.Equal(t, []string{"Line one\nLine two\n\nParagraph two"}, sectionTexts(blocks))
+
+			// HTML bodies are rendered as if written with \n line endings
+			expected, err := ConvertToBlocks("<pre>Line one\nLine two</pre>", "", Options{PreferHTML: true})
+			require.NoError(t, err)
+			html := "<pre>Line one" + eol + "Line two</pre>"
+			blocks, err = ConvertToBlocks(html, "", Options{PreferHTML: true, NormalizeLineEndings: true})
+			require.NoError(t, err)
+			assert.Equal(t, expected, blocks)
+		})
+	}
+
+	t.Run("disabled", func(t *testing.T) {
+		blocks, err := ConvertToBlocks("", "Line one\r\nLine two", Options{})
+		require.NoError(t, err)
+		assert.Equal(t, []string{"Line one\r\nLine two"}, sectionTexts(blocks))
+	})
+}
@@ -0,0 +1,42 @@
+package formatter
+
+import (
+	"strings"
+
+	"github.com/JohannesKaufmann/html-to-markdown/v2/converter"
+	"golang.org/x/net/html"
+)
+
+// Styles of the HTML headings (<h1> to <h6>): Slack header blocks, or bold text
+const (
+	HeadingStyleHeader = "header"
+	HeadingStyleBold   = "bold"
+)
+
+// headingTags are the tags of the HTML headings
+var headingTags = []string{"h1", "h2", "h3", "h4", "h5", "h6"}
+
+// headingRenderer renders the headings in the style of the options, with their prefix if
+// any (e.g. an emoji). Headings show their text only: header blocks are plain text, and
+// formatting within bold text would end it early.
+func headingRenderer(opts Options) converter.HandleRenderFunc {
+	return func(ctx converter.Context, w converter.Writer, n *html.Node) converter.RenderStatus {
+		text := strings.Join(strings.Fields(nodeText(n)), " ")
+		if text == "" {
+			return converter.RenderSuccess
+		}
+		if opts.HeadingStyle == HeadingStyleBold {
+			text = "**" + text + "**"
+		}
+		if prefix := strings.TrimSpace(opts.HeadingPrefixes[n.Data]); prefix != "" {
+			text = prefix + " " + text
+		}
+
+		if opts.HeadingStyle == HeadingStyleBold {
+			w.WriteString("\n\n" + text + "\n\n")
+		} else {
+			w.WriteString("\n\n# " + text + "\n\n")
+		}
+		return converter.RenderSuccess
+	}
+}
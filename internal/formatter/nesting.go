@@ -0,0 +1,253 @@
+package formatter
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/JohannesKaufmann/html-to-markdown/v2/converter"
+	"github.com/slack-go/slack"
+	"golang.org/x/net/html"
+)
+
+// The markdown to blocks conversion drops the lists nested in list items, and splits
+// block quotes at each line. So lists are rendered flat, with their items tagged with
+// their nesting, and quotes on a single line, restored once converted to blocks.
+const (
+	itemTagStart   = "\uE000"
+	itemTagEnd     = "\uE001"
+	quoteLineBreak = "\uE002"
+)
+
+// listItem is an item of a list, or of a list nested in one of its items.
+type listItem struct {
+	text    string
+	ordered bool
+	indent  int
+	number  int
+}
+
+// itemTag returns the tag of an item: whether it starts a list, its indent and number.
+func itemTag(item listItem, first bool) string {
+	start := 0
+	if first {
+		start = 1
+	}
+	return fmt.Sprintf("%s%d.%d.%d%s", itemTagStart, start, item.indent, item.number, itemTagEnd)
+}
+
+// parseItemTag strips the tag from the text of an item, returning its values.
+func parseItemTag(text string) (rest string, first bool, indent, number int, ok bool) {
+	if !strings.HasPrefix(text, itemTagStart) {
+		return text, false, 0, 0, false
+	}
+	tag, rest, found := strings.Cut(strings.TrimPrefix(text, itemTagStart), itemTagEnd)
+	if !found {
+		return text, false, 0, 0, false
+	}
+	var start int
+	if _, err := fmt.Sscanf(tag, "%d.%d.%d", &start, &indent, &number); err != nil {
+		return text, false, 0, 0, false
+	}
+	return rest, start == 1, indent, number, true
+}
+
+// hasAncestor reports whether one of the ancestors of the node is the given element.
+func hasAncestor(n *html.Node, tag string) bool {
+	for p := n.Parent; p != nil; p = p.Parent {
+		if p.Type == html.ElementNode && p.Data == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// isList reports whether the node is a list element
+func isList(n *html.Node) bool {
+	return n.Type == html.ElementNode && (n.Data == "ul" || n.Data == "ol")
+}
+
+// collectListItems appends the items of a list to items, each followed by the items of
+// the lists nested in it, one level further indented. Items are single lines.
+func collectListItems(ctx converter.Context, list *html.Node, indent int, items *[]listItem) {
+	number := 1
+	for _, attr := range list.Attr {
+		if attr.Key == "start" {
+			if start, err := strconv.Atoi(attr.Val); err == nil {
+				number = start
+			}
+		}
+	}
+
+	for li := list.FirstChild; li != nil; li = li.NextSibling {
+		if li.Type != html.ElementNode || li.Data != "li" {
+			continue
+		}
+
+		var buf bytes.Buffer
+		var nested []*html.Node
+		for c := li.FirstChild; c != nil; c = c.NextSibling {
+			if isList(c) {
+				nested = append(nested, c)
+				continue
+			}
+			ctx.RenderNodes(ctx, &buf, c)
+		}
+
+		text := strings.ReplaceAll(buf.String(), quoteLineBreak, " ")
+		if text = strings.Join(strings.Fields(text), " "); text != "" {
+			*items = append(*items, listItem{text: text, ordered: list.Data == "ol", indent: indent, number: number})
+			number++
+		}
+		for _, n := range nested {
+			collectListItems(ctx, n, indent+1, items)
+		}
+	}
+}
+
+// renderList renders a list with the lists nested in it as flat markdown lists, one per
+// run of items of the same type, tagged for nestLists to restore the nesting.
+func renderList(ctx converter.Context, w converter.Writer, n *html.Node) converter.RenderStatus {
+	// lists nested deeper in an item (e.g. in a <div>) are rendered as part of its text
+	if hasAncestor(n, "li") {
+		return converter.RenderTryNext
+	}
+
+	var items []listItem
+	collectListItems(ctx, n, 0, &items)
+	if len(items) == 0 {
+		return converter.RenderSuccess
+	}
+
+	w.WriteString("\n\n")
+	for i, item := range items {
+		marker := "* "
+		if item.ordered {
+			marker = "1. "
+		}
+		w.WriteString(marker + itemTag(item, i == 0) + item.text + "\n")
+	}
+	w.WriteString("\n")
+	return converter.RenderSuccess
+}
+
+// renderBlockquote renders a block quote, and the ones nested in it, as its plain text
+// lines on a single markdown line, restored by joinQuoteLines.
+func renderBlockquote(ctx converter.Context, w converter.Writer, n *html.Node) converter.RenderStatus {
+	var buf strings.Builder
+	if err := html.Render(&buf, n); err != nil {
+		return converter.RenderTryNext
+	}
+
+	var lines []string
+	for _, line := range strings.Split(htmlToPlainText(buf.String(), true), "\n") {
+		if line != "" {
+			lines = append(lines, line)
+		}
+	}
+	if len(lines) == 0 {
+		return converter.RenderSuccess
+	}
+
+	w.WriteString("\n\n> " + quoteLineBreak + strings.Join(lines, quoteLineBreak) + "\n\n")
+	return converter.RenderSuccess
+}
+
+// nestLists restores the nesting of the lists rendered by renderList: the runs of items
+// of the same indent become lists of their own, and the lists continuing a list are
+// added to its block, so Slack shows them nested.
+func nestLists(blocks []slack.Block) []slack.Block {
+	result := make([]slack.Block, 0, len(blocks))
+	var current *slack.RichTextBlock
+
+	for _, block := range blocks {
+		richText, ok := block.(*slack.RichTextBlock)
+		if !ok || len(richText.Elements) != 1 {
+			result = append(result, block)
+			current = nil
+			continue
+		}
+		list, ok := richText.Elements[0].(*slack.RichTextList)
+		if !ok {
+			result = append(result, block)
+			current = nil
+			continue
+		}
+
+		lists, first := splitList(list)
+		switch {
+		case lists == nil:
+			result = append(result, block)
+			current = nil
+		case first || current == nil:
+			richText.Elements = lists
+			result = append(result, richText)
+			current = richText
+		default:
+			current.Elements = append(current.Elements, lists...)
+		}
+	}
+	return result
+}
+
+// splitList strips the tags of the items of a list, splitting it in runs of items of the
+// same indent. It returns nil if an item isn't tagged.
+func splitList(list *slack.RichTextList) ([]slack.RichTextElement, bool) {
+	var lists []slack.RichTextElement
+	var run *slack.RichTextList
+	startsList := false
+
+	for i, element := range list.Elements {
+		section, ok := element.(*slack.RichTextSection)
+		if !ok || len(section.Elements) == 0 {
+			return nil, false
+		}
+		text, ok := section.Elements[0].(*slack.RichTextSectionTextElement)
+		if !ok {
+			return nil, false
+		}
+		rest, first, indent, number, ok := parseItemTag(text.Text)
+		if !ok {
+			return nil, false
+		}
+		if i == 0 {
+			startsList = first
+		}
+
+		if text.Text = rest; rest == "" {
+			section.Elements = section.Elements[1:]
+		}
+
+		if run == nil || run.Indent != indent {
+			run = &slack.RichTextList{Type: slack.RTEList, Style: list.Style, Indent: indent}
+			if list.Style == slack.RTEListOrdered {
+				run.Offset = number - 1
+			}
+			lists = append(lists, run)
+		}
+		run.Elements = append(run.Elements, section)
+	}
+	return lists, startsList
+}
+
+// joinQuoteLines restores the lines of the quotes rendered by renderBlockquote.
+func joinQuoteLines(blocks []slack.Block) {
+	for _, block := range blocks {
+		richText, ok := block.(*slack.RichTextBlock)
+		if !ok {
+			continue
+		}
+		for _, element := range richText.Elements {
+			quote, ok := element.(*slack.RichTextQuote)
+			if !ok {
+				continue
+			}
+			for _, e := range quote.Elements {
+				if text, ok := e.(*slack.RichTextSectionTextElement); ok {
+					text.Text = strings.ReplaceAll(strings.TrimPrefix(text.Text, quoteLineBreak), quoteLineBreak, "\n")
+				}
+			}
+		}
+	}
+}
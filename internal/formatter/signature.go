@@ -0,0 +1,45 @@
+package formatter
+
+import (
+	"go-smtp-slacker/internal/logger"
+	"strings"
+)
+
+// Signature delimiters: the standard one of plain text bodies (RFC 3676) and the one of
+// HTML bodies, whose trailing space is lost to the whitespace collapsing.
+const (
+	textSignatureDelimiter = "-- "
+	htmlSignatureDelimiter = "--"
+)
+
+// isSignatureMarker reports whether a line starts with one of the markers, ignoring the
+// case and any markdown emphasis or quoting.
+func isSignatureMarker(line string, markers []string) bool {
+	line = strings.ToLower(strings.TrimLeft(strings.TrimSpace(line), "*_#> "))
+	for _, marker := range markers {
+		if marker = strings.ToLower(strings.TrimSpace(marker)); marker != "" && strings.HasPrefix(line, marker) {
+			return true
+		}
+	}
+	return false
+}
+
+// trimSignature removes the signature from a text: everything from the delimiter line, or
+// a line starting with one of the markers. Texts that are only a signature are kept as is.
+func trimSignature(text, delimiter string, markers []string) string {
+	lines := strings.Split(text, "\n")
+	for i, line := range lines {
+		line = strings.TrimRight(line, "\r")
+		if line != delimiter && !isSignatureMarker(line, markers) {
+			continue
+		}
+
+		trimmed := strings.TrimRight(strings.Join(lines[:i], "\n"), " \t\r\n")
+		if trimmed == "" {
+			return text
+		}
+		logger.Debugf("Slack: Trimmed the signature from the message body (%d lines)", len(lines)-i)
+		return trimmed
+	}
+	return text
+}
@@ -1,10 +1,14 @@
 package logger
 
 import (
+	"crypto/sha256"
+	"fmt"
 	"io"
 	"log"
 	"os"
 	"strings"
+	"sync/atomic"
+	"time"
 )
 
 type LogLevel int
@@ -18,12 +22,109 @@ const (
 	LevelError
 )
 
-var currentLogLevel LogLevel = LevelInfo // Default log level
+// currentLogLevel is changed at runtime (e.g. by the admin server) while logging, so
+// it's accessed atomically
+var currentLogLevel atomic.Int32
+
+// Default log flags, used unless a custom timestamp format is set
+const defaultFlags = log.LstdFlags | log.Lmicroseconds
+
+var (
+	output          io.Writer = os.Stdout
+	timestampFormat string
+	timestampUTC    bool
+	now             = time.Now
+)
 
 // Function to set global log flags
 func init() {
-	log.SetFlags(log.LstdFlags | log.Lmicroseconds) // Standard log flags
-	log.SetOutput(os.Stdout)
+	currentLogLevel.Store(int32(LevelInfo)) // Default log level
+	log.SetFlags(defaultFlags)              // Standard log flags
+	log.SetOutput(output)
+}
+
+// Named timestamp formats, besides Go time layouts
+var timestampFormats = map[string]string{
+	"rfc3339":     time.RFC3339,
+	"rfc3339nano": time.RFC3339Nano,
+}
+
+// timestampWriter prefixes each log entry with a timestamp in the custom format
+type timestampWriter struct{}
+
+// Method to implement the io.Writer interface
+func (timestampWriter) Write(p []byte) (int, error) {
+	t := now()
+	if timestampUTC {
+		t = t.UTC()
+	}
+	if _, err := output.Write(append([]byte(t.Format(timestampFormat)+" "), p...)); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Function to set the format of the log timestamps, either "rfc3339", "rfc3339nano"
+// or a Go time layout. An empty format keeps the default one. With utc, the
+// timestamps are in UTC instead of local time.
+func SetTimestampFormat(format string, utc bool) {
+	if named, ok := timestampFormats[strings.ToLower(format)]; ok {
+		format = named
+	}
+	timestampFormat = format
+	timestampUTC = utc
+
+	if timestampFormat == "" {
+		flags := defaultFlags
+		if utc {
+			flags |= log.LUTC
+		}
+		log.SetFlags(flags)
+		log.SetOutput(output)
+		return
+	}
+
+	log.SetFlags(0)
+	log.SetOutput(timestampWriter{})
+}
+
+// Redaction modes of the content of emails (subjects and bodies) in logs
+const (
+	RedactNone = "none"
+	RedactMask = "redact"
+	RedactHash = "hash"
+)
+
+var redactionMode = RedactNone
+
+// Function to set how the content of emails is shown in logs: as is ("none" or
+// empty), replaced by its size ("redact"), or by its size and hash ("hash").
+func SetRedaction(mode string) {
+	mode = strings.ToLower(mode)
+	if mode == "" {
+		mode = RedactNone
+	}
+	redactionMode = mode
+}
+
+// Function to redact the content of an email (e.g. its subject or body) before logging
+// it, according to the redaction mode. Its size is always kept, and its hash lets
+// entries with the same content be told apart from others.
+func Redact(content string) string {
+	switch redactionMode {
+	case RedactMask:
+		return fmt.Sprintf("[redacted, %d bytes]", len(content))
+	case RedactHash:
+		sum := sha256.Sum256([]byte(content))
+		return fmt.Sprintf("[sha256:%x, %d bytes]", sum[:8], len(content))
+	default:
+		return content
+	}
+}
+
+// Function to report whether the content of emails is redacted in logs
+func IsRedacting() bool {
+	return redactionMode == RedactMask || redactionMode == RedactHash
 }
 
 // Method to return the string representation of the LogLevel
@@ -44,72 +145,85 @@ func (l LogLevel) String() string {
 	}
 }
 
-// Function to infer the log level from a string
-func ParseLogLevel(levelStr string) LogLevel {
-	switch strings.ToUpper(levelStr) {
+// Function to look up a log level by name, reporting whether the name is valid
+func LookupLogLevel(levelStr string) (LogLevel, bool) {
+	switch strings.ToUpper(strings.TrimSpace(levelStr)) {
 	case "TRACE":
-		return LevelTrace
+		return LevelTrace, true
 	case "DEBUG":
-		return LevelDebug
+		return LevelDebug, true
 	case "INFO":
-		return LevelInfo
-	case "WARNING":
-		return LevelWarning
+		return LevelInfo, true
+	case "WARNING", "WARN":
+		return LevelWarning, true
 	case "ERROR":
-		return LevelError
+		return LevelError, true
 	default:
+		return LevelInfo, false
+	}
+}
+
+// Function to infer the log level from a string
+func ParseLogLevel(levelStr string) LogLevel {
+	level, ok := LookupLogLevel(levelStr)
+	if !ok {
 		log.Printf("WARNING: Invalid log level '%s' in config. Defaulting to INFO.", levelStr)
-		return LevelInfo
 	}
+	return level
 }
 
 // Function to set the global log level
 func SetLogLevel(level LogLevel) {
-	currentLogLevel = level
+	currentLogLevel.Store(int32(level))
 	log.Printf("INFO: Log level set to %s", level)
 }
 
 // Function to get the current global log level
 func GetLogLevel() LogLevel {
-	return currentLogLevel
+	return LogLevel(currentLogLevel.Load())
 }
 
 // Function wrapper for stdlib log.SetOutput
 func SetOutput(w io.Writer) {
+	output = w
+	if timestampFormat != "" {
+		log.SetOutput(timestampWriter{})
+		return
+	}
 	log.SetOutput(w)
 }
 
 // Function to log TRACE level messages
 func Tracef(format string, v ...interface{}) {
-	if currentLogLevel <= LevelTrace {
+	if GetLogLevel() <= LevelTrace {
 		log.Printf("TRACE: "+format, v...)
 	}
 }
 
 // Function to log DEBUG level messages
 func Debugf(format string, v ...interface{}) {
-	if currentLogLevel <= LevelDebug {
+	if GetLogLevel() <= LevelDebug {
 		log.Printf("DEBUG: "+format, v...)
 	}
 }
 
 // Function to log INFO level messages
 func Infof(format string, v ...interface{}) {
-	if currentLogLevel <= LevelInfo {
+	if GetLogLevel() <= LevelInfo {
 		log.Printf("INFO: "+format, v...)
 	}
 }
 
 // Function to log WARNING level messages
 func Warnf(format string, v ...interface{}) {
-	if currentLogLevel <= LevelWarning {
+	if GetLogLevel() <= LevelWarning {
 		log.Printf("WARNING: "+format, v...)
 	}
 }
 
 // Function to log ERROR level messages
 func Errorf(format string, v ...interface{}) {
-	if currentLogLevel <= LevelError {
+	if GetLogLevel() <= LevelError {
 		log.Printf("ERROR: "+format, v...)
 	}
 }
@@ -138,7 +252,7 @@ func NewLineWriter(level LogLevel, prefix string) *LineWriter {
 // Method to implement the io.Writer interface
 func (lw *LineWriter) Write(p []byte) (n int, err error) {
 	// Only process if the specified level is enabled
-	if currentLogLevel > lw.level {
+	if GetLogLevel() > lw.level {
 		return len(p), nil
 	}
 
@@ -158,6 +272,8 @@ func (lw *LineWriter) Write(p []byte) (n int, err error) {
 
 		// Log at the specified level
 		switch lw.level {
+		case LevelTrace:
+			Tracef("%s", logLine)
 		case LevelDebug:
 			Debugf("%s", logLine)
 		case LevelInfo:
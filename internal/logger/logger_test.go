@@ -0,0 +1,133 @@
+package logger
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSetTimestampFormat(t *testing.T) {
+	lisbon := time.FixedZone("WEST", 3600)
+	fixed := time.Date(2024, 1, 5, 10, 30, 0, 123456000, lisbon)
+
+	testCases := []struct {
+		name     string
+		format   string
+		utc      bool
+		expected string
+	}{
+		{
+			name:     "rfc3339",
+			format:   "rfc3339",
+			expected: "2024-01-05T10:30:00+01:00 INFO: hello\n",
+		},
+		{
+			name:     "rfc3339 in UTC",
+			format:   "RFC3339",
+			utc:      true,
+			expected: "2024-01-05T09:30:00Z INFO: hello\n",
+		},
+		{
+			name:     "rfc3339nano in UTC",
+			format:   "rfc3339nano",
+			utc:      true,
+			expected: "2024-01-05T09:30:00.123456Z INFO: hello\n",
+		},
+		{
+			name:     "go layout",
+			format:   "2006-01-02 15:04:05.000",
+			expected: "2024-01-05 10:30:00.123 INFO: hello\n",
+		},
+	}
+
+	originalNow := now
+	now = func() time.Time { return fixed }
+	t.Cleanup(func() {
+		now = originalNow
+		SetTimestampFormat("", false)
+		SetOutput(os.Stdout)
+	})
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			SetOutput(&buf)
+			SetTimestampFormat(tc.format, tc.utc)
+
+			Infof("hello")
+			assert.Equal(t, tc.expected, buf.String())
+		})
+	}
+
+	t.Run("default format", func(t *testing.T) {
+		var buf bytes.Buffer
+		SetTimestampFormat("", true)
+		SetOutput(&buf)
+
+		Infof("hello")
+		assert.Regexp(t, `^\d{4}/\d{2}/\d{2} \d{2}:\d{2}:\d{2}\.\d{6} INFO: hello\n$`, buf.String())
+		assert.Equal(t, defaultFlags|log.LUTC, log.Flags())
+	})
+}
+
+func TestLineWriter(t *testing.T) {
+	testCases := []struct {
+		name         string
+		writerLevel  LogLevel
+		currentLevel LogLevel
+		expected     string
+	}{
+		{name: "error at info", writerLevel: LevelError, currentLevel: LevelInfo, expected: "ERROR: lib: line one\nERROR: lib: line two\n"},
+		{name: "debug at info", writerLevel: LevelDebug, currentLevel: LevelInfo, expected: ""},
+		{name: "debug at debug", writerLevel: LevelDebug, currentLevel: LevelDebug, expected: "DEBUG: lib: line one\nDEBUG: lib: line two\n"},
+		{name: "trace at debug", writerLevel: LevelTrace, currentLevel: LevelDebug, expected: ""},
+		{name: "trace at trace", writerLevel: LevelTrace, currentLevel: LevelTrace, expected: "TRACE: lib: line one\nTRACE: lib: line two\n"},
+	}
+
+	originalLevel := GetLogLevel()
+	t.Cleanup(func() {
+		currentLogLevel.Store(int32(originalLevel))
+		SetOutput(os.Stdout)
+		log.SetFlags(defaultFlags)
+	})
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			SetOutput(&buf)
+			log.SetFlags(0)
+			currentLogLevel.Store(int32(tc.currentLevel))
+
+			_, err := NewLineWriter(tc.writerLevel, "lib:").Write([]byte("line one\nline two\n"))
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expected, buf.String())
+		})
+	}
+}
+
+func TestRedact(t *testing.T) {
+	t.Cleanup(func() { SetRedaction(RedactNone) })
+
+	testCases := []struct {
+		name     string
+		mode     string
+		expected string
+	}{
+		{name: "not redacted by default", mode: "", expected: "Disk full"},
+		{name: "none", mode: "none", expected: "Disk full"},
+		{name: "redact", mode: "redact", expected: "[redacted, 9 bytes]"},
+		{name: "hash", mode: "HASH", expected: "[sha256:dc301aee29819d47, 9 bytes]"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			SetRedaction(tc.mode)
+			assert.Equal(t, tc.expected, Redact("Disk full"))
+			assert.Equal(t, tc.mode != "" && tc.mode != "none", IsRedacting())
+		})
+	}
+}
@@ -0,0 +1,112 @@
+package metrics
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Counter is a monotonically increasing counter, safe for concurrent use.
+type Counter struct {
+	value atomic.Uint64
+}
+
+// Inc increments the counter by one.
+func (c *Counter) Inc() {
+	c.value.Add(1)
+}
+
+// Value returns the current value of the counter.
+func (c *Counter) Value() uint64 {
+	return c.value.Load()
+}
+
+// Delivery counters, counting each message sent to Slack (per recipient, or per group
+// of recipients sharing the same destination).
+var (
+	Delivered      Counter
+	DeliveryFailed Counter
+)
+
+// Dropped counts the emails accepted but deliberately never forwarded to Slack, e.g.
+// still queued when the shutdown grace period ended.
+var Dropped Counter
+
+// Gauge is a value that can go up and down, safe for concurrent use.
+type Gauge struct {
+	value atomic.Int64
+}
+
+// Set sets the value of the gauge.
+func (g *Gauge) Set(value int64) {
+	g.value.Store(value)
+}
+
+// Value returns the current value of the gauge.
+func (g *Gauge) Value() int64 {
+	return g.value.Load()
+}
+
+// Queue gauges, sampling the emails received but not forwarded to Slack yet, to detect
+// backpressure.
+var (
+	QueueDepth    Gauge
+	QueueCapacity Gauge
+)
+
+// SampleQueue records the depth of the queue of received emails in QueueDepth every
+// interval, until the context is done.
+func SampleQueue(ctx context.Context, interval time.Duration, depth func() int, capacity int) {
+	QueueCapacity.Set(int64(capacity))
+	QueueDepth.Set(int64(depth()))
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			QueueDepth.Set(int64(depth()))
+		}
+	}
+}
+
+// cacheSizes holds the gauges of the number of entries of the caches, by name.
+var (
+	cacheSizesMu sync.Mutex
+	cacheSizes   = make(map[string]*Gauge)
+)
+
+// CacheSize returns the gauge of the number of entries of the named cache, created if needed.
+func CacheSize(name string) *Gauge {
+	cacheSizesMu.Lock()
+	defer cacheSizesMu.Unlock()
+
+	gauge, ok := cacheSizes[name]
+	if !ok {
+		gauge = &Gauge{}
+		cacheSizes[name] = gauge
+	}
+	return gauge
+}
+
+// Snapshot returns the current values of the metrics, by name. The size of each cache is
+// named after it, e.g. cache_size_slack_users.
+func Snapshot() map[string]int64 {
+	snapshot := map[string]int64{
+		"delivered":       int64(Delivered.Value()),
+		"delivery_failed": int64(DeliveryFailed.Value()),
+		"dropped":         int64(Dropped.Value()),
+		"queue_depth":     QueueDepth.Value(),
+		"queue_capacity":  QueueCapacity.Value(),
+	}
+
+	cacheSizesMu.Lock()
+	defer cacheSizesMu.Unlock()
+	for name, gauge := range cacheSizes {
+		snapshot["cache_size_"+name] = gauge.Value()
+	}
+	return snapshot
+}
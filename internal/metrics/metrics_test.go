@@ -0,0 +1,37 @@
+package metrics
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSampleQueue(t *testing.T) {
+	queue := make(chan int, 3)
+	queue <- 1
+	queue <- 2
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		SampleQueue(ctx, time.Millisecond, func() int { return len(queue) }, cap(queue))
+		close(done)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+
+	assert.Eventually(t, func() bool { return QueueDepth.Value() == 2 }, time.Second, time.Millisecond)
+	assert.Equal(t, int64(3), QueueCapacity.Value())
+
+	// the depth follows the queue as it fills up and drains
+	queue <- 3
+	assert.Eventually(t, func() bool { return QueueDepth.Value() == 3 }, time.Second, time.Millisecond)
+	<-queue
+	<-queue
+	<-queue
+	assert.Eventually(t, func() bool { return QueueDepth.Value() == 0 }, time.Second, time.Millisecond)
+}
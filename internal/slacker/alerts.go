@@ -0,0 +1,147 @@
+package slacker
+
+import (
+	"context"
+	"fmt"
+	"go-smtp-slacker/internal/logger"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/slack-go/slack"
+)
+
+// alerter accumulates delivery failures, deduplicated by error message, and releases
+// them as a summary at most once per interval. The failures throttled are flushed to
+// post once the interval elapsed, even if no other failure happens by then.
+type alerter struct {
+	mu       sync.Mutex
+	interval time.Duration
+	now      func() time.Time
+	lastSent time.Time
+	failures map[string]int
+	// afterFunc runs f after d, to flush the throttled failures
+	afterFunc func(d time.Duration, f func())
+	// flushing is set while a flush is scheduled
+	flushing bool
+	// post sends the summaries of the flushed failures
+	post func(summary string)
+}
+
+func newAlerter(interval time.Duration, post func(summary string)) *alerter {
+	return &alerter{
+		interval:  interval,
+		now:       time.Now,
+		failures:  make(map[string]int),
+		afterFunc: func(d time.Duration, f func()) { time.AfterFunc(d, f) },
+		post:      post,
+	}
+}
+
+// record adds a failure, returning the summary of the failures to alert about, if the
+// last alert was sent long enough ago.
+func (a *alerter) record(err error) (string, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.failures[err.Error()]++
+
+	now := a.now()
+	if !a.lastSent.IsZero() && now.Sub(a.lastSent) < a.interval {
+		a.scheduleFlush(now)
+		return "", false
+	}
+
+	return a.release(now), true
+}
+
+// release returns the summary of the accumulated failures, starting a new interval.
+func (a *alerter) release(now time.Time) string {
+	summary := a.summary()
+	a.failures = make(map[string]int)
+	a.lastSent = now
+	return summary
+}
+
+// scheduleFlush schedules the flush of the throttled failures for the end of the
+// interval, unless already scheduled.
+func (a *alerter) scheduleFlush(now time.Time) {
+	if a.flushing {
+		return
+	}
+	a.flushing = true
+	a.afterFunc(a.interval-now.Sub(a.lastSent), a.flush)
+}
+
+// flush posts the summary of the throttled failures, if they weren't released by
+// another failure in the meantime. If an alert was posted since the flush was
+// scheduled, the flush is postponed to the end of its interval.
+func (a *alerter) flush() {
+	a.mu.Lock()
+	a.flushing = false
+	if len(a.failures) == 0 {
+		a.mu.Unlock()
+		return
+	}
+	now := a.now()
+	if now.Sub(a.lastSent) < a.interval {
+		a.scheduleFlush(now)
+		a.mu.Unlock()
+		return
+	}
+	summary := a.release(now)
+	a.mu.Unlock()
+
+	a.post(summary)
+}
+
+// summary formats the accumulated failures, the most frequent first.
+func (a *alerter) summary() string {
+	messages := make([]string, 0, len(a.failures))
+	total := 0
+	for message, count := range a.failures {
+		messages = append(messages, message)
+		total += count
+	}
+	sort.Slice(messages, func(i, j int) bool {
+		if a.failures[messages[i]] != a.failures[messages[j]] {
+			return a.failures[messages[i]] > a.failures[messages[j]]
+		}
+		return messages[i] < messages[j]
+	})
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, ":warning: *%d email deliveries to Slack failed*", total)
+	for _, message := range messages {
+		fmt.Fprintf(&sb, "\n• `%s` (×%d)", message, a.failures[message])
+	}
+	return sb.String()
+}
+
+// ReportFailure notifies the ops alert channel, if configured, about a failed delivery.
+// Alerts are throttled: failures are summarized in a single alert at most once per
+// configured interval.
+func (s *Service) ReportFailure(err error) {
+	if s.alerts == nil || err == nil {
+		return
+	}
+
+	summary, ok := s.alerts.record(err)
+	if !ok {
+		logger.Debugf("Slack: Ops alert throttled, failure will be reported later: %v", err)
+		return
+	}
+	s.postAlert(summary)
+}
+
+// postAlert posts the summary of delivery failures to the ops alert channel.
+func (s *Service) postAlert(summary string) {
+	postErr := s.withRetry(context.Background(), "chat.postMessage", func() error {
+		_, _, err := s.client.PostMessage(s.cfg.OpsAlertChannel, slack.MsgOptionText(summary, false))
+		return err
+	})
+	if postErr != nil {
+		logger.Errorf("Slack: Error posting alert to ops channel '%s': %v", s.cfg.OpsAlertChannel, postErr)
+	}
+}
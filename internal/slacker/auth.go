@@ -0,0 +1,41 @@
+package slacker
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/slack-go/slack"
+)
+
+// IsAuthRevoked reports whether a delivery failed because the Slack token is no longer
+// valid, e.g. revoked, or its app uninstalled or its workspace deactivated. Every call
+// then fails the same way, until the token is replaced.
+func IsAuthRevoked(err error) bool {
+	var slackErr slack.SlackErrorResponse
+	if !errors.As(err, &slackErr) {
+		return false
+	}
+	switch slackErr.Err {
+	case "invalid_auth", "token_revoked", "token_expired", "account_inactive", "not_authed":
+		return true
+	}
+	return false
+}
+
+// authTester is the part of the Slack client checking the token.
+type authTester interface {
+	AuthTest() (*slack.AuthTestResponse, error)
+}
+
+// CheckAuth checks that the Slack token is still valid. Clients which can't check it
+// (e.g. in dry run) are assumed valid.
+func (s *Service) CheckAuth() error {
+	tester, ok := s.client.(authTester)
+	if !ok {
+		return nil
+	}
+	if _, err := tester.AuthTest(); err != nil {
+		return fmt.Errorf("slack: authentication failed: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,104 @@
+package slacker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"go-smtp-slacker/internal/config"
+	"go-smtp-slacker/internal/logger"
+
+	"github.com/slack-go/slack"
+)
+
+// isChannelNotFound reports whether a Slack API error means that the channel doesn't
+// exist (or isn't visible to the bot), or is archived.
+func isChannelNotFound(err error) bool {
+	var slackErr slack.SlackErrorResponse
+	return errors.As(err, &slackErr) && (slackErr.Err == "channel_not_found" || slackErr.Err == "is_archived")
+}
+
+// channelNotFoundFallback sends the message for the recipients as a DM to the Slack user of
+// the first one, when configured to, as the channel of their destination wasn't found.
+// Otherwise, or if the user isn't found either, the channel error is returned.
+func (s *Service) channelNotFoundFallback(ctx context.Context, dest *destination, n Notification, notFound *ErrChannelNotFound) error {
+	if s.cfg.ChannelNotFound != ChannelNotFoundDM {
+		return notFound
+	}
+
+	user := dest.ephemeralUser
+	if user == nil {
+		var err error
+		if user, err = s.lookupUser(n.Recipients[0]); err != nil {
+			logger.Errorf("Slack: Channel '%s' not found, and no user to send a DM to for '%s': %v", notFound.Channel, n.Recipients[0], err)
+			return notFound
+		}
+	}
+
+	logger.Warnf("Slack: Channel '%s' not found or archived, sending a DM to user '%s' instead", notFound.Channel, user.Name)
+	return s.sendToDestination(ctx, &destination{user: user, template: dest.template}, n)
+}
+
+// conversationGetter is the part of the Slack client looking up channels.
+type conversationGetter interface {
+	GetConversationInfo(input *slack.GetConversationInfoInput) (*slack.Channel, error)
+}
+
+// configuredChannel is a channel of the configuration, along with the setting it's set in.
+type configuredChannel struct {
+	id      string
+	setting string
+}
+
+// configuredChannels returns the channels of the configuration messages are posted to.
+func configuredChannels(cfg config.SlackConfig) []configuredChannel {
+	var channels []configuredChannel
+	add := func(id, setting string) {
+		if id != "" {
+			channels = append(channels, configuredChannel{id: id, setting: setting})
+		}
+	}
+
+	for _, route := range cfg.Routes {
+		add(route.Channel, fmt.Sprintf("route '%s'", route.Match))
+		for _, channel := range route.AlsoChannels {
+			add(channel, fmt.Sprintf("route '%s'", route.Match))
+		}
+	}
+	for _, route := range cfg.DomainRoutes {
+		add(route.Channel, fmt.Sprintf("domain route '%s'", route.Domain))
+	}
+	add(cfg.FallbackChannel, "fallback-channel")
+	add(cfg.OpsAlertChannel, "ops-alert-channel")
+	add(cfg.SummaryChannel, "summary-channel")
+	return channels
+}
+
+// checkChannels verifies that the configured channels exist and aren't archived, so
+// mistakes are caught at startup rather than on delivery. The check is skipped when
+// the token can't look up channels (e.g. lacking the channels:read scope).
+func checkChannels(client conversationGetter, cfg config.SlackConfig) error {
+	checked := make(map[string]bool)
+	for _, channel := range configuredChannels(cfg) {
+		if checked[channel.id] {
+			continue
+		}
+		checked[channel.id] = true
+
+		info, err := client.GetConversationInfo(&slack.GetConversationInfoInput{ChannelID: channel.id})
+		var slackErr slack.SlackErrorResponse
+		switch {
+		case isChannelNotFound(err):
+			return fmt.Errorf("slack: channel '%s' of %s not found: %w", channel.id, channel.setting, err)
+		case errors.As(err, &slackErr) && slackErr.Err == "missing_scope":
+			logger.Warnf("Slack: The token can't look up channels (%v), skipping the check of the configured channels", err)
+			return nil
+		case err != nil:
+			logger.Warnf("Slack: Failed to check channel '%s' of %s: %v", channel.id, channel.setting, err)
+		case info.IsArchived:
+			return fmt.Errorf("slack: channel '%s' of %s is archived", channel.id, channel.setting)
+		default:
+			logger.Debugf("Slack: Channel '%s' of %s exists", channel.id, channel.setting)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,59 @@
+package slacker
+
+import (
+	"sync"
+	"time"
+)
+
+// cooldown enforces a minimum interval between the messages to the same user. The
+// timestamps older than the interval are cleaned up at most once per interval.
+type cooldown struct {
+	mu          sync.Mutex
+	interval    time.Duration
+	now         func() time.Time
+	lastSent    map[string]time.Time
+	lastCleanup time.Time
+}
+
+func newCooldown(interval time.Duration) *cooldown {
+	return &cooldown{
+		interval: interval,
+		now:      time.Now,
+		lastSent: make(map[string]time.Time),
+	}
+}
+
+// allow reports whether a message can be sent to the user, reserving the slot if so.
+func (c *cooldown) allow(userID string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := c.now()
+	if now.Sub(c.lastCleanup) >= c.interval {
+		c.cleanup(now)
+	}
+
+	if last, ok := c.lastSent[userID]; ok && now.Sub(last) < c.interval {
+		return false
+	}
+	c.lastSent[userID] = now
+	return true
+}
+
+// forget releases the slot of a user, e.g. when the message couldn't be sent.
+func (c *cooldown) forget(userID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.lastSent, userID)
+}
+
+// cleanup removes the timestamps past the cooldown, which no longer hold back any message.
+func (c *cooldown) cleanup(now time.Time) {
+	for userID, last := range c.lastSent {
+		if now.Sub(last) >= c.interval {
+			delete(c.lastSent, userID)
+		}
+	}
+	c.lastCleanup = now
+}
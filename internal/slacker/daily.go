@@ -0,0 +1,96 @@
+package slacker
+
+import (
+	"fmt"
+	"go-smtp-slacker/internal/config"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// defaultDailyThreadText is the text of the daily root messages, unless configured otherwise
+const defaultDailyThreadText = `:date: *Emails of {{.Date.Format "Monday, January 2, 2006"}}*`
+
+// dailyThreadData holds the fields available to the text of the daily root messages.
+type dailyThreadData struct {
+	Date time.Time
+}
+
+// dailyRoot is the root message of the day of a channel. Its lock is held while the
+// root is posted, so concurrent messages to the channel don't post several roots.
+type dailyRoot struct {
+	mu        sync.Mutex
+	day       string
+	timestamp string
+}
+
+// dailyThreads tracks the root message of the day of each channel, the messages posted
+// to the channel being threaded under it. A root is posted by the first message of
+// the day, days starting at midnight in loc.
+type dailyThreads struct {
+	mu   sync.Mutex
+	text *template.Template
+	loc  *time.Location
+	now  func() time.Time
+	// roots maps the channels to their root message of the day
+	roots map[string]*dailyRoot
+}
+
+// newDailyThreads returns the tracker of the daily root messages, or nil if the messages
+// aren't threaded.
+func newDailyThreads(cfg config.DailyThreadConfig) (*dailyThreads, error) {
+	if !cfg.Enabled {
+		return nil, nil
+	}
+
+	text := cfg.Text
+	if text == "" {
+		text = defaultDailyThreadText
+	}
+	tmpl, err := template.New("daily-thread").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("slack: invalid daily thread text: %w", err)
+	}
+
+	d := &dailyThreads{text: tmpl, loc: time.Local, now: time.Now, roots: make(map[string]*dailyRoot)}
+	if cfg.Timezone != "" {
+		if d.loc, err = time.LoadLocation(cfg.Timezone); err != nil {
+			return nil, fmt.Errorf("slack: invalid daily thread timezone '%s': %w", cfg.Timezone, err)
+		}
+	}
+	return d, nil
+}
+
+// root returns the timestamp of the root message of the day of the channel, posting it
+// with post if it's the first message of the day. Only the messages to the same
+// channel wait for the root to be posted.
+func (d *dailyThreads) root(channelID string, post func(text string) (string, error)) (string, error) {
+	d.mu.Lock()
+	root, ok := d.roots[channelID]
+	if !ok {
+		root = &dailyRoot{}
+		d.roots[channelID] = root
+	}
+	d.mu.Unlock()
+
+	root.mu.Lock()
+	defer root.mu.Unlock()
+
+	now := d.now().In(d.loc)
+	day := now.Format(time.DateOnly)
+	if root.day == day {
+		return root.timestamp, nil
+	}
+
+	var sb strings.Builder
+	if err := d.text.Execute(&sb, dailyThreadData{Date: now}); err != nil {
+		return "", fmt.Errorf("rendering daily thread text: %w", err)
+	}
+	timestamp, err := post(sb.String())
+	if err != nil {
+		return "", err
+	}
+	root.day, root.timestamp = day, timestamp
+	return timestamp, nil
+}
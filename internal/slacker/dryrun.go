@@ -0,0 +1,54 @@
+package slacker
+
+import (
+	"fmt"
+	"go-smtp-slacker/internal/config"
+	"go-smtp-slacker/internal/logger"
+	"strings"
+	"time"
+
+	"github.com/slack-go/slack"
+)
+
+// discardClient is the client of the services running in dry run: it never calls Slack,
+// and logs the calls it discards. Every recipient resolves to a user, so the rest of the
+// delivery (routing, templates, policies) runs as usual.
+type discardClient struct{}
+
+func (discardClient) GetUserByEmail(email string) (*slack.User, error) {
+	return &slack.User{ID: "U-" + strings.ToLower(email), Name: email}, nil
+}
+
+func (discardClient) OpenConversation(params *slack.OpenConversationParameters) (*slack.Channel, bool, bool, error) {
+	channel := &slack.Channel{}
+	channel.ID = "D-" + strings.Join(params.Users, ",")
+	return channel, false, false, nil
+}
+
+func (discardClient) PostMessage(channelID string, options ...slack.MsgOption) (string, string, error) {
+	logger.Infof("Slack (dry run): Discarding message to '%s'", channelID)
+	return channelID, fmt.Sprintf("%d.000000", time.Now().Unix()), nil
+}
+
+func (discardClient) PostEphemeral(channelID, userID string, options ...slack.MsgOption) (string, error) {
+	logger.Infof("Slack (dry run): Discarding ephemeral message to '%s' in '%s'", userID, channelID)
+	return fmt.Sprintf("%d.000000", time.Now().Unix()), nil
+}
+
+func (discardClient) AddReaction(name string, item slack.ItemRef) error {
+	logger.Debugf("Slack (dry run): Discarding reaction '%s' in '%s'", name, item.Channel)
+	return nil
+}
+
+func (discardClient) UploadFileV2(params slack.UploadFileV2Parameters) (*slack.FileSummary, error) {
+	logger.Infof("Slack (dry run): Discarding upload of '%s' to '%s'", params.Filename, params.Channel)
+	return &slack.FileSummary{Title: params.Title}, nil
+}
+
+// NewDryRunService creates a Service which never calls Slack, so no token is needed:
+// emails go through the whole delivery, and the messages are logged and discarded.
+// Replies are never bridged.
+func NewDryRunService(cfg config.SlackConfig) (*Service, error) {
+	logger.Warnf("Slack: Running in dry run, messages are logged and discarded")
+	return newService(discardClient{}, cfg)
+}
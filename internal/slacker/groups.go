@@ -0,0 +1,83 @@
+package slacker
+
+import (
+	"bufio"
+	"fmt"
+	"go-smtp-slacker/internal/logger"
+	"os"
+	"strings"
+)
+
+// loadGroups reads a group file, mapping each group address (lowercased) to its members.
+// Each line holds a group in the format `group@example.com: alice@example.com, bob@example.com`.
+func loadGroups(filePath string) (map[string][]string, error) {
+	groups := make(map[string][]string)
+
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("slack: failed to open group file '%s': %w", filePath, err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue // Skip empty lines and comments
+		}
+
+		group, members, ok := strings.Cut(line, ":")
+		group = strings.ToLower(strings.TrimSpace(group))
+		if !ok || group == "" {
+			logger.Warnf("Slack: Skipping malformed line %d in group file '%s': '%s'", lineNum, filePath, line)
+			continue
+		}
+
+		for _, member := range strings.Split(members, ",") {
+			if member = strings.TrimSpace(member); member != "" {
+				groups[group] = append(groups[group], member)
+			}
+		}
+		if len(groups[group]) == 0 {
+			logger.Warnf("Slack: Group '%s' in group file '%s' has no members", group, filePath)
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("slack: error reading group file '%s': %w", filePath, err)
+	}
+	return groups, nil
+}
+
+// ExpandRecipients replaces the group addresses among the recipients by the members of
+// the groups, so each of them is delivered individually. Other recipients are kept as is.
+// Groups aren't nested: members are never expanded themselves.
+func (s *Service) ExpandRecipients(recipients []string) []string {
+	if len(s.groups) == 0 {
+		return recipients
+	}
+
+	expanded := make([]string, 0, len(recipients))
+	seen := make(map[string]bool)
+	add := func(recipient string) {
+		if key := strings.ToLower(recipient); !seen[key] {
+			seen[key] = true
+			expanded = append(expanded, recipient)
+		}
+	}
+
+	for _, recipient := range recipients {
+		members, ok := s.groups[strings.ToLower(recipient)]
+		if !ok {
+			add(recipient)
+			continue
+		}
+		logger.Debugf("Slack: Expanding group '%s' to %d members", recipient, len(members))
+		for _, member := range members {
+			add(member)
+		}
+	}
+	return expanded
+}
@@ -0,0 +1,78 @@
+package slacker
+
+import (
+	"crypto/tls"
+	"fmt"
+	"go-smtp-slacker/internal/config"
+	"go-smtp-slacker/internal/logger"
+	"net/http"
+	"net/url"
+	"os"
+
+	"golang.org/x/net/http/httpproxy"
+)
+
+// proxySchemes are the schemes of the supported proxies
+var proxySchemes = map[string]bool{"http": true, "https": true, "socks5": true}
+
+// tlsVersions maps the minimum TLS versions to their identifiers
+var tlsVersions = map[string]uint16{
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// newHTTPClient returns the HTTP client connecting to Slack, going through the configured
+// proxy and requiring the configured minimum TLS version, or nil to use the default client
+// when neither is set. Without a proxy, the proxy of the environment (HTTPS_PROXY) is used.
+func newHTTPClient(cfg config.SlackConfig) (*http.Client, error) {
+	if cfg.ProxyURL == "" && cfg.MinTLS == "" {
+		return nil, nil
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if cfg.ProxyURL != "" {
+		proxy, err := proxyFunc(cfg.ProxyURL, cfg.NoProxy)
+		if err != nil {
+			return nil, err
+		}
+		transport.Proxy = proxy
+	}
+	if cfg.MinTLS != "" {
+		version, ok := tlsVersions[cfg.MinTLS]
+		if !ok {
+			return nil, fmt.Errorf("slack: unsupported minimum TLS version '%s'", cfg.MinTLS)
+		}
+		logger.Debugf("Slack: Requiring TLS %s or later", cfg.MinTLS)
+		transport.TLSClientConfig = &tls.Config{MinVersion: version}
+	}
+
+	return &http.Client{Transport: transport}, nil
+}
+
+// proxyFunc returns the proxy selection of the requests to Slack, going through proxyURL
+// except for the hosts matching noProxy, in the NO_PROXY syntax (e.g. "slack.com,.internal").
+// Without noProxy, the NO_PROXY of the environment applies.
+func proxyFunc(proxyURL, noProxy string) (func(*http.Request) (*url.URL, error), error) {
+	parsed, err := url.Parse(proxyURL)
+	if err != nil {
+		return nil, fmt.Errorf("slack: invalid proxy URL: %w", err)
+	}
+	if !proxySchemes[parsed.Scheme] || parsed.Host == "" {
+		return nil, fmt.Errorf("slack: invalid proxy URL '%s': expected http://, https:// or socks5://host:port", parsed.Redacted())
+	}
+	if noProxy == "" {
+		noProxy = os.Getenv("NO_PROXY")
+		if noProxy == "" {
+			noProxy = os.Getenv("no_proxy")
+		}
+	}
+
+	logger.Debugf("Slack: Connecting through proxy '%s'", parsed.Redacted())
+	if noProxy != "" {
+		logger.Debugf("Slack: Not using the proxy for '%s'", noProxy)
+	}
+	proxy := (&httpproxy.Config{HTTPProxy: proxyURL, HTTPSProxy: proxyURL, NoProxy: noProxy}).ProxyFunc()
+	return func(req *http.Request) (*url.URL, error) {
+		return proxy(req.URL)
+	}, nil
+}
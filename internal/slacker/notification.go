@@ -0,0 +1,24 @@
+package slacker
+
+import "go-smtp-slacker/internal/email"
+
+// Notification is an email to post to Slack, for a recipient or for recipients sharing the
+// same destination (see GroupRecipients).
+type Notification struct {
+	// Recipients are the addresses the message is delivered to, its destination being
+	// resolved from the first one. The header lists all of them.
+	Recipients []string
+	// Sender is the address of the sender of the email
+	Sender string
+	// To are the recipients listed by the email, the Recipients if empty (e.g. Bcc only)
+	To []string
+	// Subject is the subject of the email
+	Subject string
+	// Body holds the contents of the email: bodies, attachments and header
+	Body email.EmailBody
+	// PreferHTML selects the HTML body over the plain text one
+	PreferHTML bool
+
+	// dest is the destination resolved while grouping the recipients, nil if not resolved yet
+	dest *destination
+}
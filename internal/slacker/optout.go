@@ -0,0 +1,73 @@
+package slacker
+
+import (
+	"bufio"
+	"fmt"
+	"go-smtp-slacker/internal/logger"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// loadOptOuts reads an opt-out file, returning its address patterns (lowercased).
+// Each line holds an address, or a glob pattern (e.g. `*@alerts.example.com`).
+func loadOptOuts(filePath string) ([]string, error) {
+	var patterns []string
+
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("slack: failed to open opt-out file '%s': %w", filePath, err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue // Skip empty lines and comments
+		}
+
+		pattern := strings.ToLower(line)
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			logger.Warnf("Slack: Skipping invalid pattern on line %d in opt-out file '%s': '%s'", lineNum, filePath, line)
+			continue
+		}
+		patterns = append(patterns, pattern)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("slack: error reading opt-out file '%s': %w", filePath, err)
+	}
+	return patterns, nil
+}
+
+// FilterOptedOut removes the recipients who opted out of the notifications, matching
+// an address of the opt-out file case-insensitively.
+func (s *Service) FilterOptedOut(recipients []string) []string {
+	if len(s.optOuts) == 0 {
+		return recipients
+	}
+
+	kept := make([]string, 0, len(recipients))
+	for _, recipient := range recipients {
+		if pattern, ok := s.optedOut(recipient); ok {
+			logger.Infof("Slack: Recipient '%s' opted out (matching '%s'), skipping", recipient, pattern)
+			continue
+		}
+		kept = append(kept, recipient)
+	}
+	return kept
+}
+
+// optedOut returns the opt-out pattern matching the recipient, if any.
+func (s *Service) optedOut(recipient string) (string, bool) {
+	recipient = strings.ToLower(recipient)
+	for _, pattern := range s.optOuts {
+		if matched, _ := filepath.Match(pattern, recipient); matched {
+			return pattern, true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,160 @@
+package slacker
+
+import (
+	"context"
+	"errors"
+	"go-smtp-slacker/internal/logger"
+	"sync"
+
+	"github.com/slack-go/slack/slackevents"
+	"github.com/slack-go/slack/socketmode"
+)
+
+// maxTrackedThreads caps the number of forwarded emails remembered for bridging replies
+const maxTrackedThreads = 10000
+
+// Reply is a message posted in the Slack thread of a forwarded email.
+type Reply struct {
+	Channel  string
+	ThreadTS string
+	User     string
+	Text     string
+	// the sender and subject of the forwarded email
+	Sender  string
+	Subject string
+}
+
+// forwardedEmail holds what's needed to answer the sender of a forwarded email.
+type forwardedEmail struct {
+	Sender  string
+	Subject string
+}
+
+// threadIndex remembers the Slack messages of the forwarded emails, evicting the oldest
+// ones once full.
+type threadIndex struct {
+	mu      sync.Mutex
+	max     int
+	order   []string
+	threads map[string]forwardedEmail
+}
+
+func newThreadIndex(max int) *threadIndex {
+	return &threadIndex{
+		max:     max,
+		threads: make(map[string]forwardedEmail),
+	}
+}
+
+func threadKey(channel, ts string) string {
+	return channel + "/" + ts
+}
+
+// add records the email forwarded as the message ts in channel.
+func (i *threadIndex) add(channel, ts string, e forwardedEmail) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	key := threadKey(channel, ts)
+	if _, ok := i.threads[key]; !ok {
+		i.order = append(i.order, key)
+	}
+	i.threads[key] = e
+
+	for len(i.order) > i.max {
+		delete(i.threads, i.order[0])
+		i.order = i.order[1:]
+	}
+}
+
+// get returns the email forwarded as the message ts in channel, if known.
+func (i *threadIndex) get(channel, ts string) (forwardedEmail, bool) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	e, ok := i.threads[threadKey(channel, ts)]
+	return e, ok
+}
+
+// parseReply returns the reply to a forwarded email carried by a message event, if any.
+// Messages outside threads, edits and other subtypes, and bot messages are ignored.
+func (s *Service) parseReply(ev *slackevents.MessageEvent) (*Reply, bool) {
+	if s.threads == nil || ev == nil {
+		return nil, false
+	}
+	if ev.SubType != "" || ev.BotID != "" || ev.User == "" {
+		return nil, false
+	}
+	if ev.ThreadTimeStamp == "" || ev.ThreadTimeStamp == ev.TimeStamp {
+		return nil, false
+	}
+
+	forwarded, ok := s.threads.get(ev.Channel, ev.ThreadTimeStamp)
+	if !ok {
+		return nil, false
+	}
+
+	return &Reply{
+		Channel:  ev.Channel,
+		ThreadTS: ev.ThreadTimeStamp,
+		User:     ev.User,
+		Text:     ev.Text,
+		Sender:   forwarded.Sender,
+		Subject:  forwarded.Subject,
+	}, true
+}
+
+// handleEventsAPIEvent handles an event received from Slack, logging replies to forwarded emails.
+func (s *Service) handleEventsAPIEvent(event slackevents.EventsAPIEvent) {
+	if event.Type != slackevents.CallbackEvent {
+		return
+	}
+
+	ev, ok := event.InnerEvent.Data.(*slackevents.MessageEvent)
+	if !ok {
+		return
+	}
+
+	reply, ok := s.parseReply(ev)
+	if !ok {
+		return
+	}
+
+	// TODO: email the reply back to the sender
+	logger.Infof("Slack: User '%s' replied to the email from '%s' with subject '%s': %s", reply.User, reply.Sender, logger.Redact(reply.Subject), logger.Redact(reply.Text))
+}
+
+// ListenForReplies listens for the replies to forwarded emails using Socket Mode, until
+// the context is cancelled.
+func (s *Service) ListenForReplies(ctx context.Context) error {
+	if s.socket == nil {
+		return errors.New("slack: bridging replies is not enabled")
+	}
+
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case evt := <-s.socket.Events:
+				switch evt.Type {
+				case socketmode.EventTypeConnecting:
+					logger.Debugf("Slack: Connecting to Socket Mode...")
+				case socketmode.EventTypeConnected:
+					logger.Infof("Slack: Listening for replies to forwarded emails")
+				case socketmode.EventTypeConnectionError:
+					logger.Warnf("Slack: Socket Mode connection failed, retrying")
+				case socketmode.EventTypeEventsAPI:
+					event, ok := evt.Data.(slackevents.EventsAPIEvent)
+					if !ok {
+						continue
+					}
+					s.socket.Ack(*evt.Request)
+					s.handleEventsAPIEvent(event)
+				}
+			}
+		}
+	}()
+
+	return s.socket.RunContext(ctx)
+}
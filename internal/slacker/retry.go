@@ -0,0 +1,85 @@
+package slacker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"go-smtp-slacker/internal/config"
+	"go-smtp-slacker/internal/logger"
+	"math"
+	"math/rand"
+	"time"
+
+	"github.com/slack-go/slack"
+)
+
+// retryable is implemented by the Slack errors that are worth retrying
+// (rate limiting and server side errors).
+type retryable interface {
+	Retryable() bool
+}
+
+// isRetryable reports whether a failed Slack API call should be retried.
+func isRetryable(err error) bool {
+	var r retryable
+	return errors.As(err, &r) && r.Retryable()
+}
+
+// backoff returns the delay before the given retry attempt (starting at 1).
+// The delay grows exponentially from cfg.Backoff, is capped at cfg.MaxBackoff and
+// randomized by ±cfg.Jitter (a fraction of the delay) to avoid retrying in lockstep.
+func backoff(cfg config.RetryConfig, attempt int, random func() float64) time.Duration {
+	delay := float64(cfg.Backoff) * math.Pow(2, float64(attempt-1))
+	if cfg.MaxBackoff > 0 && delay > float64(cfg.MaxBackoff) {
+		delay = float64(cfg.MaxBackoff)
+	}
+	if cfg.Jitter > 0 {
+		// random() is in [0, 1), so the factor is in [1-jitter, 1+jitter)
+		delay *= 1 + cfg.Jitter*(2*random()-1)
+	}
+	return time.Duration(delay)
+}
+
+// sleepContext waits for the delay, returning early with the error of the context once it's done.
+func sleepContext(ctx context.Context, delay time.Duration) error {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// withRetry runs fn, retrying it with backoff while it fails with a retryable error.
+// It stops retrying once the context is done, e.g. when the delivery was given up on,
+// so a call isn't made again after the caller stopped waiting for it.
+func (s *Service) withRetry(ctx context.Context, op string, fn func() error) error {
+	var err error
+	for attempt := 1; ; attempt++ {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			if err == nil {
+				return ctxErr
+			}
+			return fmt.Errorf("%w (no retry: %w)", err, ctxErr)
+		}
+		err = fn()
+		if err == nil || !isRetryable(err) || attempt >= s.cfg.Retry.MaxAttempts {
+			return err
+		}
+
+		delay := backoff(s.cfg.Retry, attempt, rand.Float64)
+
+		// honor the delay requested by Slack when rate limited
+		var rateLimited *slack.RateLimitedError
+		if errors.As(err, &rateLimited) && rateLimited.RetryAfter > delay {
+			delay = rateLimited.RetryAfter
+		}
+
+		logger.Warnf("Slack: %s failed (attempt %d/%d), retrying in %s: %v", op, attempt, s.cfg.Retry.MaxAttempts, delay, err)
+		if sleepErr := s.sleep(ctx, delay); sleepErr != nil {
+			return fmt.Errorf("%w (no retry: %w)", err, sleepErr)
+		}
+	}
+}
@@ -0,0 +1,240 @@
+package slacker
+
+import (
+	"errors"
+	"go-smtp-slacker/internal/config"
+	"go-smtp-slacker/internal/logger"
+	"path/filepath"
+	"strings"
+
+	"github.com/slack-go/slack"
+)
+
+// resolveRoute returns the first configured route matching the recipient address,
+// or nil if no route matches.
+func (s *Service) resolveRoute(recipient string) *config.RouteConfig {
+	for i, route := range s.cfg.Routes {
+		matched, err := filepath.Match(strings.ToLower(route.Match), strings.ToLower(recipient))
+		if err != nil {
+			logger.Errorf("Slack: Invalid glob pattern '%s' in routes: %v", route.Match, err)
+			continue
+		}
+		if matched {
+			logger.Debugf("Slack: Recipient '%s' matched route '%s'", recipient, route.Match)
+			return &s.cfg.Routes[i]
+		}
+	}
+	return nil
+}
+
+// senderName returns the name configured for the first pattern matching the sender
+// address, or the sender itself if none matches.
+func (s *Service) senderName(sender string) string {
+	for _, rewrite := range s.cfg.SenderNames {
+		matched, err := filepath.Match(strings.ToLower(rewrite.Match), strings.ToLower(sender))
+		if err != nil {
+			logger.Errorf("Slack: Invalid glob pattern '%s' in sender names: %v", rewrite.Match, err)
+			continue
+		}
+		if matched {
+			logger.Debugf("Slack: Sender '%s' matched sender name '%s'", sender, rewrite.Match)
+			return rewrite.Name
+		}
+	}
+	return sender
+}
+
+// senderTemplate returns the template configured for the first pattern matching the
+// sender address, or "" if none matches.
+func (s *Service) senderTemplate(sender string) string {
+	for _, selection := range s.cfg.SenderTemplates {
+		matched, err := filepath.Match(strings.ToLower(selection.Match), strings.ToLower(sender))
+		if err != nil {
+			logger.Errorf("Slack: Invalid glob pattern '%s' in sender templates: %v", selection.Match, err)
+			continue
+		}
+		if matched {
+			logger.Debugf("Slack: Sender '%s' matched sender template '%s'", sender, selection.Match)
+			return selection.Template
+		}
+	}
+	return ""
+}
+
+// resolveDomainRoute returns the domain route matching the domain of the recipient
+// address, or nil if no domain route matches.
+func (s *Service) resolveDomainRoute(recipient string) *config.DomainRouteConfig {
+	at := strings.LastIndex(recipient, "@")
+	if at == -1 {
+		return nil
+	}
+	domain := recipient[at+1:]
+
+	for i, route := range s.cfg.DomainRoutes {
+		if strings.EqualFold(route.Domain, domain) {
+			logger.Debugf("Slack: Recipient '%s' matched domain route '%s'", recipient, route.Domain)
+			return &s.cfg.DomainRoutes[i]
+		}
+	}
+	return nil
+}
+
+// Modes of delivery for the recipients of an email sharing the same destination
+const (
+	SameDestinationPerRecipient = "per-recipient"
+	SameDestinationCombined     = "combined"
+)
+
+// destination is where the message for a recipient is posted: a channel, or a DM with a user.
+type destination struct {
+	channel  string
+	user     *slack.User
+	template string
+	// ephemeralUser is the only user seeing the message posted to the channel, if set
+	ephemeralUser *slack.User
+}
+
+// key identifies the destination, messages with the same key look the same.
+func (d *destination) key() string {
+	if d.user != nil {
+		return d.template + "/" + d.user.ID
+	}
+	if d.ephemeralUser != nil {
+		return d.template + "/" + d.channel + "/" + d.ephemeralUser.ID
+	}
+	return d.template + "/" + d.channel
+}
+
+// resolveDestination returns the destination of the messages for a recipient, or nil
+// if the messages are dropped.
+func (s *Service) resolveDestination(userEmail string) (*destination, error) {
+	dest := &destination{}
+
+	route := s.resolveRoute(userEmail)
+	if route != nil {
+		dest.template = route.Template
+	}
+
+	// without a route, the domain of the recipient may still have a default destination
+	lookupEmail := userEmail
+	if route != nil {
+		dest.channel = route.Channel
+	} else if domainRoute := s.resolveDomainRoute(userEmail); domainRoute != nil {
+		dest.channel = domainRoute.Channel
+		if domainRoute.User != "" {
+			logger.Debugf("Slack: Routing email for '%s' to user '%s'", userEmail, domainRoute.User)
+			lookupEmail = domainRoute.User
+		}
+	}
+
+	if dest.channel != "" {
+		logger.Debugf("Slack: Routing email for '%s' to channel '%s'", userEmail, dest.channel)
+		if s.cfg.EphemeralInChannel {
+			s.resolveEphemeralUser(dest, lookupEmail)
+		}
+		return dest, nil
+	}
+
+	// retrieve user by email
+	user, err := s.lookupUser(lookupEmail)
+	switch {
+	case err == nil:
+		logger.Debugf("Slack: Found matching user for email '%s': '%s'", lookupEmail, user.Name)
+		dest.user = user
+	case !isUserNotFound(err):
+		// the lookup may succeed later, so don't treat it as a missing user
+		logger.Errorf("Slack: Error looking up user by email '%s': %v", lookupEmail, err)
+		return nil, &ErrUserLookup{User: lookupEmail, Err: err}
+	case s.cfg.UserNotFound == UserNotFoundDrop:
+		logger.Warnf("Slack: No user found for email '%s', dropping the message", lookupEmail)
+		return nil, nil
+	case s.cfg.UserNotFound == UserNotFoundFallback:
+		logger.Warnf("Slack: No user found for email '%s', posting to fallback channel '%s'", lookupEmail, s.cfg.FallbackChannel)
+		dest.channel = s.cfg.FallbackChannel
+	default:
+		logger.Warnf("Slack: Error finding user by email '%s': %v", lookupEmail, err)
+		return nil, &ErrUserNotFound{User: lookupEmail, Err: err}
+	}
+
+	return dest, nil
+}
+
+// resolveEphemeralUser sets the user the message posted to the channel of the destination is
+// only shown to. Recipients without a Slack user (e.g. mailing lists routed to the channel),
+// or whose lookup fails, get the message posted to the channel as usual.
+func (s *Service) resolveEphemeralUser(dest *destination, userEmail string) {
+	user, err := s.lookupUser(userEmail)
+	switch {
+	case err == nil:
+		logger.Debugf("Slack: Only showing the message in channel '%s' to user '%s'", dest.channel, user.Name)
+		dest.ephemeralUser = user
+	case isUserNotFound(err):
+		logger.Debugf("Slack: No user found for email '%s', posting the message to channel '%s' for everyone", userEmail, dest.channel)
+	default:
+		logger.Warnf("Slack: Error looking up user by email '%s', posting the message to channel '%s' for everyone: %v", userEmail, dest.channel, err)
+	}
+}
+
+// RecipientExists reports whether the messages for a recipient can be delivered, i.e. it
+// isn't rejected for lacking a Slack user. Recipients routed to a channel, falling back to
+// a channel or dropped by configuration are delivered as configured, so they exist. Group
+// addresses exist if any of their members does, as they're expanded before delivery.
+func (s *Service) RecipientExists(recipient string) (bool, error) {
+	var errs []error
+	for _, member := range s.ExpandRecipients([]string{recipient}) {
+		exists, err := s.memberExists(member)
+		if exists {
+			return true, nil
+		}
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return false, errors.Join(errs...)
+}
+
+// memberExists reports whether the messages for a single recipient can be delivered.
+func (s *Service) memberExists(recipient string) (bool, error) {
+	_, err := s.resolveDestination(recipient)
+	var notFound *ErrUserNotFound
+	switch {
+	case errors.As(err, &notFound):
+		return false, nil
+	case err != nil:
+		return false, err
+	}
+	return true, nil
+}
+
+// GroupRecipients groups the recipients of an email to be sent together, returning the
+// Notifications to send with their Recipients set, the caller filling in the email. Unless
+// configured to combine them, each recipient gets its own message. Otherwise, the recipients
+// sharing the same destination (e.g. aliases of the same Slack user) get a single message,
+// while the ones failing to resolve are kept apart, to report their errors on delivery. The
+// destinations resolved while grouping are kept, not to resolve them again when sending.
+func (s *Service) GroupRecipients(recipients []string) []Notification {
+	groups := make([]Notification, 0, len(recipients))
+	if s.cfg.SameDestination != SameDestinationCombined {
+		for _, recipient := range recipients {
+			groups = append(groups, Notification{Recipients: []string{recipient}})
+		}
+		return groups
+	}
+
+	index := make(map[string]int)
+	for _, recipient := range recipients {
+		dest, err := s.resolveDestination(recipient)
+		if err != nil || dest == nil {
+			groups = append(groups, Notification{Recipients: []string{recipient}})
+			continue
+		}
+		if i, ok := index[dest.key()]; ok {
+			logger.Debugf("Slack: Combining the message for '%s' with the one for '%s'", recipient, groups[i].Recipients[0])
+			groups[i].Recipients = append(groups[i].Recipients, recipient)
+			continue
+		}
+		index[dest.key()] = len(groups)
+		groups = append(groups, Notification{Recipients: []string{recipient}, dest: dest})
+	}
+	return groups
+}
@@ -0,0 +1,113 @@
+package slacker
+
+import (
+	"fmt"
+	"go-smtp-slacker/internal/config"
+	"strings"
+	"time"
+)
+
+// defaultBusinessDays are the days of the business hours, unless configured otherwise
+var defaultBusinessDays = []string{"mon", "tue", "wed", "thu", "fri"}
+
+// scheduler decides when the messages are posted: after a delay, or during business hours.
+type scheduler struct {
+	delay time.Duration
+	// the business hours, as offsets from midnight
+	start, end time.Duration
+	days       map[time.Weekday]bool
+	loc        *time.Location
+	now        func() time.Time
+}
+
+// parseTimeOfDay parses a time of the day, e.g. 09:30, as an offset from midnight.
+func parseTimeOfDay(value string) (time.Duration, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(value))
+	if err != nil {
+		return 0, fmt.Errorf("invalid time of the day '%s', expected HH:MM", value)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// parseWeekday parses the (abbreviated) English name of a day of the week.
+func parseWeekday(value string) (time.Weekday, error) {
+	value = strings.ToLower(strings.TrimSpace(value))
+	for day := time.Sunday; day <= time.Saturday; day++ {
+		name := strings.ToLower(day.String())
+		if value == name || value == name[:3] {
+			return day, nil
+		}
+	}
+	return 0, fmt.Errorf("invalid day of the week '%s'", value)
+}
+
+// newScheduler returns the scheduler of the messages, or nil if they're posted right away.
+func newScheduler(cfg config.ScheduleConfig) (*scheduler, error) {
+	if cfg.Delay <= 0 && cfg.BusinessHours == "" {
+		return nil, nil
+	}
+
+	s := &scheduler{delay: cfg.Delay, loc: time.Local, now: time.Now}
+	if cfg.Delay > 0 {
+		return s, nil
+	}
+
+	startValue, endValue, ok := strings.Cut(cfg.BusinessHours, "-")
+	if !ok {
+		return nil, fmt.Errorf("slack: invalid business hours '%s', expected HH:MM-HH:MM", cfg.BusinessHours)
+	}
+	var err error
+	if s.start, err = parseTimeOfDay(startValue); err != nil {
+		return nil, fmt.Errorf("slack: invalid business hours: %w", err)
+	}
+	if s.end, err = parseTimeOfDay(endValue); err != nil {
+		return nil, fmt.Errorf("slack: invalid business hours: %w", err)
+	}
+	if s.end <= s.start {
+		return nil, fmt.Errorf("slack: invalid business hours '%s', the end must be after the start", cfg.BusinessHours)
+	}
+
+	days := cfg.BusinessDays
+	if len(days) == 0 {
+		days = defaultBusinessDays
+	}
+	s.days = make(map[time.Weekday]bool)
+	for _, value := range days {
+		day, err := parseWeekday(value)
+		if err != nil {
+			return nil, fmt.Errorf("slack: invalid business days: %w", err)
+		}
+		s.days[day] = true
+	}
+
+	if cfg.Timezone != "" {
+		if s.loc, err = time.LoadLocation(cfg.Timezone); err != nil {
+			return nil, fmt.Errorf("slack: invalid timezone '%s': %w", cfg.Timezone, err)
+		}
+	}
+
+	return s, nil
+}
+
+// postAt returns when a message should be posted, reporting false if it should be posted now.
+func (s *scheduler) postAt() (time.Time, bool) {
+	now := s.now().In(s.loc)
+	if s.delay > 0 {
+		return now.Add(s.delay), true
+	}
+
+	midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, s.loc)
+	if s.days[now.Weekday()] && now.Sub(midnight) >= s.start && now.Sub(midnight) < s.end {
+		return time.Time{}, false
+	}
+
+	// the start of the next business hours
+	for i := 0; i <= 7; i++ {
+		day := midnight.AddDate(0, 0, i)
+		start := time.Date(day.Year(), day.Month(), day.Day(), 0, 0, 0, 0, s.loc).Add(s.start)
+		if s.days[day.Weekday()] && start.After(now) {
+			return start, true
+		}
+	}
+	return time.Time{}, false
+}
@@ -0,0 +1,49 @@
+package slacker
+
+import (
+	"regexp"
+	"sort"
+)
+
+// severityRule maps a subject keyword to the emoji prepended to the header
+type severityRule struct {
+	keyword string
+	emoji   string
+	re      *regexp.Regexp
+}
+
+// newSeverityRules compiles the keyword to emoji mapping, ignoring the keywords without emoji.
+func newSeverityRules(emojis map[string]string) []severityRule {
+	rules := make([]severityRule, 0, len(emojis))
+	for keyword, emoji := range emojis {
+		if keyword == "" || emoji == "" {
+			continue
+		}
+		rules = append(rules, severityRule{
+			keyword: keyword,
+			emoji:   emoji,
+			re:      regexp.MustCompile(`(?i)\b` + regexp.QuoteMeta(keyword) + `\b`),
+		})
+	}
+	sort.Slice(rules, func(i, j int) bool { return rules[i].keyword < rules[j].keyword })
+	return rules
+}
+
+// severityEmoji returns the emoji of the keyword found first in the subject, matched
+// case-insensitively as a whole word, or an empty string if there's no match.
+func (s *Service) severityEmoji(subject string) string {
+	emoji := ""
+	first, longest := -1, 0
+	for _, rule := range s.severities {
+		loc := rule.re.FindStringIndex(subject)
+		if loc == nil {
+			continue
+		}
+		// the earliest match wins, and the longest keyword among those at the same position
+		if first == -1 || loc[0] < first || (loc[0] == first && loc[1]-loc[0] > longest) {
+			emoji = rule.emoji
+			first, longest = loc[0], loc[1]-loc[0]
+		}
+	}
+	return emoji
+}
@@ -1,20 +1,29 @@
 package slacker
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"go-smtp-slacker/internal/config"
 	"go-smtp-slacker/internal/email"
+	"go-smtp-slacker/internal/formatter"
 	"go-smtp-slacker/internal/logger"
-	"go-smtp-slacker/internal/utils"
+	"mime"
+	"net/mail"
+	"net/textproto"
+	"net/url"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"text/template"
+	"time"
 
-	"github.com/JohannesKaufmann/html-to-markdown/v2/converter"
-	"github.com/JohannesKaufmann/html-to-markdown/v2/plugin/base"
-	"github.com/JohannesKaufmann/html-to-markdown/v2/plugin/commonmark"
-	"github.com/JohannesKaufmann/html-to-markdown/v2/plugin/strikethrough"
-	"github.com/JohannesKaufmann/html-to-markdown/v2/plugin/table"
 	"github.com/slack-go/slack"
-	util "github.com/takara2314/slack-go-util"
-	"golang.org/x/net/html"
+	"github.com/slack-go/slack/socketmode"
 )
 
 type ErrUserNotFound struct {
@@ -26,15 +35,41 @@ func (e *ErrUserNotFound) Error() string {
 	return fmt.Sprintf("error finding user by email '%s': %v", e.User, e.Err)
 }
 
+func (e *ErrUserNotFound) Unwrap() error {
+	return e.Err
+}
+
+type ErrUserLookup struct {
+	User string
+	Err  error
+}
+
+func (e *ErrUserLookup) Error() string {
+	return fmt.Sprintf("error looking up user by email '%s': %v", e.User, e.Err)
+}
+
+func (e *ErrUserLookup) Unwrap() error {
+	return e.Err
+}
+
 type ErrUserDM struct {
 	User string
 	Err  error
+	// Hint explains why DMs can't be opened at all, if known
+	Hint string
 }
 
 func (e *ErrUserDM) Error() string {
+	if e.Hint != "" {
+		return fmt.Sprintf("error opening DM with user '%s': %v (%s)", e.User, e.Err, e.Hint)
+	}
 	return fmt.Sprintf("error opening DM with user '%s': %v", e.User, e.Err)
 }
 
+func (e *ErrUserDM) Unwrap() error {
+	return e.Err
+}
+
 type ErrSendMessage struct {
 	User string
 	Err  error
@@ -44,143 +79,182 @@ func (e *ErrSendMessage) Error() string {
 	return fmt.Sprintf("error sending message to user '%s': %v", e.User, e.Err)
 }
 
-// htmlToMarkdown returns an html message in markdown
-func htmlToMarkdown(message string) (string, error) {
-
-	c := converter.NewConverter(
-		// converter.WithEscapeMode("disabled"),
-		converter.WithPlugins(
-			base.NewBasePlugin(),
-			commonmark.NewCommonmarkPlugin(
-				commonmark.WithStrongDelimiter("**"), // bold
-				commonmark.WithEmDelimiter("_"),      // italic
-				commonmark.WithBulletListMarker("*"), // bullet list
-				commonmark.WithListEndComment(false), // do not mark the end of a list
-			),
-			table.NewTablePlugin(
-				// table.WithHeaderPromotion(true),
-				// table.WithSkipEmptyRows(true),
-				// table.WithSkipEmptyHeader(true),
-				// table.WithNewlineBehavior("delete"),
-				table.WithNewlineBehavior("preserve"),
-			),
-			strikethrough.NewStrikethroughPlugin(
-				strikethrough.WithDelimiter("~~"), // strikethrough
-			),
-		),
-	)
+func (e *ErrSendMessage) Unwrap() error {
+	return e.Err
+}
 
-	// Override <br> — return two newlines (paragraph break).
-	c.Register.RendererFor(
-		"br",
-		converter.TagTypeInline,
-		func(ctx converter.Context, w converter.Writer, node *html.Node) converter.RenderStatus {
-			w.WriteString("\n\n")
-			return converter.RenderSuccess
-		},
-		converter.PriorityEarly,
-	)
+// ErrChannelNotFound is returned when the channel of a destination (e.g. of a route)
+// doesn't exist, or is archived.
+type ErrChannelNotFound struct {
+	Channel string
+	Err     error
+}
 
-	// Add a renderer for <input type="checkbox">
-	c.Register.RendererFor(
-		"input",
-		converter.TagTypeInline,
-		func(ctx converter.Context, w converter.Writer, node *html.Node) converter.RenderStatus {
-			isCheckbox := false
-			isChecked := false
-			for _, attr := range node.Attr {
-				if attr.Key == "type" && attr.Val == "checkbox" {
-					isCheckbox = true
-				}
-				if attr.Key == "checked" {
-					isChecked = true
-				}
-			}
+func (e *ErrChannelNotFound) Error() string {
+	return fmt.Sprintf("channel '%s' not found or archived: %v", e.Channel, e.Err)
+}
 
-			if isCheckbox {
-				w.WriteString(map[bool]string{true: "[x]", false: "[ ]"}[isChecked])
-				return converter.RenderSuccess
-			}
-			return converter.RenderTryNext
-		},
-		converter.PriorityEarly,
-	)
+func (e *ErrChannelNotFound) Unwrap() error {
+	return e.Err
+}
 
-	logger.Tracef("Slack: Converting HTML message to markdown")
-	return c.ConvertString(message)
+// ErrCooldown is returned when the message for a user is dropped, as a message was
+// sent to them less than the per-user cooldown ago.
+type ErrCooldown struct {
+	User     string
+	Cooldown time.Duration
 }
 
-// htmlToSlack returns an html message in a Slack format.
-func htmlToSlack(message string) []slack.Block {
+func (e *ErrCooldown) Error() string {
+	return fmt.Sprintf("message to user '%s' dropped, a message was sent to them less than %s ago", e.User, e.Cooldown)
+}
 
-	// convert html to markdown
-	markdown, err := htmlToMarkdown(message)
-	if err != nil {
-		// fallback to the original message within a block if conversion fails
-		return []slack.Block{
-			&slack.SectionBlock{
-				Type: slack.MBTSection,
-				Text: &slack.TextBlockObject{
-					Type: slack.MarkdownType,
-					Text: message,
-				},
-			},
-		}
+// ErrDropped is returned when the message for a recipient without a Slack user is
+// dropped, as configured by user-not-found.
+var ErrDropped = errors.New("message dropped, no user found for the recipient")
+
+// ErrPartialDelivery is returned when the message reached some of the destinations of
+// a recipient but not all of them.
+type ErrPartialDelivery struct {
+	Delivered int
+	Errs      []error
+}
+
+func (e *ErrPartialDelivery) Error() string {
+	return fmt.Sprintf("message delivered to %d destinations, failed for %d: %v", e.Delivered, len(e.Errs), errors.Join(e.Errs...))
+}
+
+func (e *ErrPartialDelivery) Unwrap() []error {
+	return e.Errs
+}
+
+// truncate shortens a string to at most max characters, ending it with an ellipsis
+// when truncated. A max of 0 disables truncation.
+func truncate(str string, max int) string {
+	runes := []rune(str)
+	if max <= 0 || len(runes) <= max {
+		return str
+	}
+	if max == 1 {
+		return "…"
 	}
+	return string(runes[:max-1]) + "…"
+}
 
-	// convert markdown entities to Slack blocks
-	logger.Tracef("Slack: Converting markdown message to Slack format")
-	blocks, err := util.ConvertMarkdownTextToBlocks(markdown)
+// Actions taken when a recipient has no matching Slack user
+const (
+	UserNotFoundReject   = "reject"
+	UserNotFoundDrop     = "drop"
+	UserNotFoundFallback = "fallback"
+)
 
-	if err != nil {
-		// fallback to the original message within a block if conversion fails
-		return []slack.Block{
-			&slack.SectionBlock{
-				Type: slack.MBTSection,
-				Text: &slack.TextBlockObject{
-					Type: slack.MarkdownType,
-					Text: message,
-				},
-			},
-		}
-	}
-	// Convert Markdown links [text](url) to Slack format <url|text> before returning
-	// re := regexp.MustCompile(`\[(.*?)\]\((.*?)\)`)
-	// markdown = re.ReplaceAllString(markdown, "<$2|$1>")
-
-	return blocks
-}
-
-func textToSlack(message string) []slack.Block {
-	// replace the markdown italic __ with slack's implementation _
-	// message = strings.ReplaceAll(message, "__", "_")
-	// // replace single * with _ for italic slack's implementation _
-	// re := regexp.MustCompile(`[\*]{1}(.*?)[\*]{1}`)
-	// message = re.ReplaceAllString(message, "_$1_")
-	// // replace the markdown bold **  with slack's implementation *
-	// message = strings.ReplaceAll(message, "**", "*")
-	// // replace the markdown strikethrough ~~ with slack's implementation ~
-	// message = strings.ReplaceAll(message, "~~", "~")
-	logger.Tracef("Slack: Converting text message to Slack format")
+// Actions taken when a DM can't be opened with a user (e.g. missing im:write scope)
+const (
+	DMUnavailableReject   = "reject"
+	DMUnavailableFallback = "fallback"
+)
 
-	return []slack.Block{
-		&slack.SectionBlock{
-			Type: slack.MBTSection,
-			Text: &slack.TextBlockObject{
-				Type: slack.MarkdownType,
-				Text: message,
-			},
-		},
+// Actions taken when the channel of a destination doesn't exist or is archived
+const (
+	ChannelNotFoundReject = "reject"
+	ChannelNotFoundDM     = "dm"
+)
+
+// Actions taken when the Slack token is revoked while running
+const (
+	AuthRevokedStop  = "stop"
+	AuthRevokedPause = "pause"
+)
+
+// dmUnavailableHint explains the Slack API errors meaning that a DM can never be opened
+// with the user, returning an empty string for other (e.g. transient) errors.
+func dmUnavailableHint(err error) string {
+	var slackErr slack.SlackErrorResponse
+	if !errors.As(err, &slackErr) {
+		return ""
+	}
+	switch slackErr.Err {
+	case "missing_scope":
+		return "the Slack token lacks the im:write scope needed to open DMs, add it or route the recipient to a channel"
+	case "cannot_dm_bot":
+		return "the user is a bot, which can't receive DMs, route the recipient to a channel"
 	}
+	return ""
+}
+
+// isUserNotFound reports whether a Slack API error means that no user matches the email.
+func isUserNotFound(err error) bool {
+	var slackErr slack.SlackErrorResponse
+	return errors.As(err, &slackErr) && slackErr.Err == "users_not_found"
+}
+
+const (
+	DividersNone   = "none"
+	DividersBoth   = "both"
+	DividersTop    = "top"
+	DividersBottom = "bottom"
+)
+
+// SlackClient is the subset of the Slack API used by the Service, satisfied by *slack.Client.
+type SlackClient interface {
+	GetUserByEmail(email string) (*slack.User, error)
+	OpenConversation(params *slack.OpenConversationParameters) (*slack.Channel, bool, bool, error)
+	PostMessage(channelID string, options ...slack.MsgOption) (string, string, error)
+	PostEphemeral(channelID, userID string, options ...slack.MsgOption) (string, error)
+	AddReaction(name string, item slack.ItemRef) error
+	UploadFileV2(params slack.UploadFileV2Parameters) (*slack.FileSummary, error)
 }
 
+// Service delivers emails to Slack. It's safe for concurrent use: its configuration is
+// read-only once created, and the state shared between deliveries (threads, alerts and
+// cooldowns) is guarded by their own locks.
 type Service struct {
-	client *slack.Client
+	client     SlackClient
+	cfg        config.SlackConfig
+	templates  map[string]*template.Template
+	sleep      func(context.Context, time.Duration) error
+	threads    *threadIndex
+	socket     *socketmode.Client
+	alerts     *alerter
+	severities []severityRule
+	// uploads limits the concurrent file uploads, if set
+	uploads   chan struct{}
+	cooldown  *cooldown
+	scheduler *scheduler
+	// daily tracks the daily root messages the messages are threaded under, if set
+	daily *dailyThreads
+	// groups maps the group addresses to their members
+	groups map[string][]string
+	// optOuts are the address patterns of the recipients who opted out
+	optOuts []string
+	// users caches the users found by email, if set
+	users *userCache
 }
 
 // NewService creates a new Slack client
-func NewService(token utils.Secret) (*Service, error) {
-	client := slack.New(token.GetValue())
+func NewService(cfg config.SlackConfig) (*Service, error) {
+	var options []slack.Option
+	if cfg.APIURL != "" {
+		// the client expects the API URL to end with a slash
+		apiURL := strings.TrimSuffix(cfg.APIURL, "/") + "/"
+		logger.Debugf("Slack: Using custom API URL '%s'", apiURL)
+		options = append(options, slack.OptionAPIURL(apiURL))
+	}
+
+	httpClient, err := newHTTPClient(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if httpClient != nil {
+		options = append(options, slack.OptionHTTPClient(httpClient))
+	}
+
+	if cfg.BridgeReplies {
+		// Socket Mode connections are opened with the app-level token
+		options = append(options, slack.OptionAppLevelToken(cfg.AppToken.GetValue()))
+	}
+
+	client := slack.New(cfg.Token.GetValue(), options...)
 
 	resp, err := client.AuthTest()
 	if err != nil {
@@ -192,79 +266,1000 @@ func NewService(token utils.Secret) (*Service, error) {
 
 	logger.Debugf("Slack: Token verified. Connected as user '%s'", resp.User)
 
-	return &Service{
-		client: client,
-	}, nil
+	if err := checkChannels(client, cfg); err != nil {
+		return nil, err
+	}
+
+	s, err := newService(client, cfg)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.BridgeReplies {
+		s.socket = socketmode.New(client)
+	}
+
+	return s, nil
+}
+
+// newService creates a Service around an existing client, preparing the message templates.
+func newService(client SlackClient, cfg config.SlackConfig) (*Service, error) {
+	defaultTemplate := defaultHeaderTemplate
+	if cfg.Compact {
+		defaultTemplate = compactHeaderTemplate
+	}
+	templates, err := parseTemplates(cfg.Templates, defaultTemplate)
+	if err != nil {
+		return nil, err
+	}
+
+	// make sure every route references an existing template
+	for _, route := range cfg.Routes {
+		if route.Template == "" {
+			continue
+		}
+		if _, ok := templates[strings.ToLower(route.Template)]; !ok {
+			return nil, fmt.Errorf("slack: route '%s' references unknown template '%s'", route.Match, route.Template)
+		}
+	}
+	for _, selection := range cfg.SenderTemplates {
+		if _, ok := templates[strings.ToLower(selection.Template)]; !ok {
+			return nil, fmt.Errorf("slack: sender template '%s' references unknown template '%s'", selection.Match, selection.Template)
+		}
+	}
+
+	scheduler, err := newScheduler(cfg.Schedule)
+	if err != nil {
+		return nil, err
+	}
+	daily, err := newDailyThreads(cfg.DailyThread)
+	if err != nil {
+		return nil, err
+	}
+
+	var groups map[string][]string
+	if cfg.Groups != "" {
+		if groups, err = loadGroups(cfg.Groups); err != nil {
+			return nil, err
+		}
+		logger.Infof("Slack: Loaded %d groups from group file '%s'", len(groups), cfg.Groups)
+	}
+
+	var optOuts []string
+	if cfg.OptOutFile != "" {
+		if optOuts, err = loadOptOuts(cfg.OptOutFile); err != nil {
+			return nil, err
+		}
+		logger.Infof("Slack: Loaded %d opted out addresses from opt-out file '%s'", len(optOuts), cfg.OptOutFile)
+	}
+
+	s := &Service{
+		client:     client,
+		cfg:        cfg,
+		templates:  templates,
+		sleep:      sleepContext,
+		severities: newSeverityRules(cfg.SeverityEmojis),
+		scheduler:  scheduler,
+		daily:      daily,
+		groups:     groups,
+		optOuts:    optOuts,
+	}
+	if cfg.BridgeReplies {
+		s.threads = newThreadIndex(maxTrackedThreads)
+	}
+	if cfg.OpsAlertChannel != "" {
+		s.alerts = newAlerter(cfg.OpsAlertInterval, s.postAlert)
+	}
+	if cfg.PerUserCooldown > 0 {
+		s.cooldown = newCooldown(cfg.PerUserCooldown)
+	}
+	if cfg.MaxConcurrentUploads > 0 {
+		s.uploads = make(chan struct{}, cfg.MaxConcurrentUploads)
+	}
+	if cfg.UserCacheTTL > 0 {
+		s.users = newUserCache(cfg.UserCacheTTL, cfg.UserCacheMaxSize)
+	}
+
+	return s, nil
 }
 
-func (s *Service) Client() *slack.Client {
+func (s *Service) Client() SlackClient {
 	return s.client
 }
 
-// SendMessage sends a Slack message
-func (s *Service) SendMessage(userEmail, sender string, to []string, subject string, body email.EmailBody, preferHTMLBody bool) error {
+// emptyBodyBlocks returns the blocks used in place of an empty body
+func emptyBodyBlocks() []slack.Block {
+	return []slack.Block{
+		slack.NewContextBlock("", slack.NewTextBlockObject(slack.MarkdownType, "_(no body)_", false, false)),
+	}
+}
+
+// highPriorityMarker flags the header of high priority emails, when highlighted
+const highPriorityMarker = ":warning: *High priority*"
+
+// maxHeadersChars is the maximum length of a text object in a context block
+const maxHeadersChars = 3000
+
+// headersBlock returns a context block listing the values of the selected email headers,
+// in the given order, or nil if the email has none of them.
+func headersBlock(header mail.Header, names []string) slack.Block {
+	var lines []string
+	for _, name := range names {
+		for _, value := range header[textproto.CanonicalMIMEHeaderKey(name)] {
+			lines = append(lines, name+": "+value)
+		}
+	}
+	if len(lines) == 0 {
+		return nil
+	}
+
+	// plain text, as header values are neither formatted nor trusted
+	text := truncate(strings.Join(lines, "\n"), maxHeadersChars)
+	return slack.NewContextBlock("", slack.NewTextBlockObject(slack.PlainTextType, text, false, false))
+}
+
+// listIDBlock returns a context block showing the mailing list of an email.
+func listIDBlock(listID string) slack.Block {
+	// plain text, as header values are neither formatted nor trusted
+	text := truncate("Mailing list: "+listID, maxHeadersChars)
+	return slack.NewContextBlock("", slack.NewTextBlockObject(slack.PlainTextType, text, false, false))
+}
+
+// gravatarURL returns the URL of the Gravatar avatar of an email address, falling back
+// to a generated identicon for addresses without one.
+func gravatarURL(address string) string {
+	hash := sha256.Sum256([]byte(strings.ToLower(strings.TrimSpace(address))))
+	return "https://www.gravatar.com/avatar/" + hex.EncodeToString(hash[:]) + "?s=64&d=identicon"
+}
+
+// senderAvatarBlock returns a context block showing the avatar of the sender next to its
+// address, or nil if the sender isn't an email address.
+func senderAvatarBlock(sender string) slack.Block {
+	address := sender
+	if parsed, err := mail.ParseAddress(sender); err == nil {
+		address = parsed.Address
+	}
+	if !strings.Contains(address, "@") {
+		return nil
+	}
+
+	return slack.NewContextBlock("",
+		slack.NewImageBlockElement(gravatarURL(address), address),
+		// plain text, as the sender isn't trusted
+		slack.NewTextBlockObject(slack.PlainTextType, sender, false, false),
+	)
+}
+
+// defaultLinkText is the text of the link button, unless configured otherwise
+const defaultLinkText = "View source"
+
+// linkButtonBlock returns an actions block with a button opening the URL found in the
+// header of the email, or nil if the header holds no web URL.
+func linkButtonBlock(header mail.Header, name, text string) slack.Block {
+	if text == "" {
+		text = defaultLinkText
+	}
+
+	link := strings.TrimSpace(header.Get(name))
+	if link == "" {
+		return nil
+	}
+	u, err := url.Parse(link)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		logger.Warnf("Slack: Ignoring the link in header '%s', not a web URL: '%s'", name, link)
+		return nil
+	}
+
+	button := slack.NewButtonBlockElement("open_link", "", slack.NewTextBlockObject(slack.PlainTextType, text, false, false)).WithURL(link)
+	return slack.NewActionBlock("", button)
+}
+
+// newDividerBlock returns a new divider block
+func newDividerBlock() *slack.DividerBlock {
+	return &slack.DividerBlock{
+		Type: slack.MBTDivider,
+	}
+}
+
+// Limits of a Slack message: the number of blocks, and the size of their serialized
+// JSON, used as a conservative estimate of the 40000 characters of text Slack accepts.
+const (
+	maxMessageBlocks = 50
+	maxMessageSize   = 40000
+)
+
+// composeBlocks assembles the message blocks, surrounding them with the configured dividers.
+// The trailing body blocks which don't fit within the limits of a message are dropped.
+func (s *Service) composeBlocks(headerBlock slack.Block, bodyBlocks []slack.Block) []slack.Block {
+	dividers := s.cfg.Dividers
+	if dividers == "" {
+		dividers = DividersBoth
+	}
+
+	var leading, trailing []slack.Block
+	if dividers == DividersBoth || dividers == DividersTop {
+		leading = append(leading, newDividerBlock())
+	}
+	leading = append(leading, headerBlock)
+	if dividers == DividersBoth || dividers == DividersBottom {
+		trailing = append(trailing, newDividerBlock())
+	}
+
+	bodyBlocks = fitBlocks(bodyBlocks, append(leading, trailing...))
+
+	msgBlocks := append([]slack.Block{}, leading...)
+	msgBlocks = append(msgBlocks, bodyBlocks...)
+	msgBlocks = append(msgBlocks, trailing...)
+
+	return msgBlocks
+}
+
+// maxSectionChars is the maximum length of the text of a section block
+const maxSectionChars = 3000
+
+// compactBlock returns the single block of a compact message: the header followed by the
+// mrkdwn texts of the body blocks. Plain texts (e.g. the included headers), images and
+// buttons are left out.
+func compactBlock(headerText string, bodyBlocks []slack.Block) slack.Block {
+	lines := []string{headerText}
+	for _, block := range bodyBlocks {
+		switch b := block.(type) {
+		case *slack.SectionBlock:
+			if b.Text != nil && b.Text.Type == slack.MarkdownType {
+				lines = append(lines, b.Text.Text)
+			}
+			for _, field := range b.Fields {
+				if field.Type == slack.MarkdownType {
+					lines = append(lines, field.Text)
+				}
+			}
+		case *slack.ContextBlock:
+			for _, element := range b.ContextElements.Elements {
+				if text, ok := element.(*slack.TextBlockObject); ok && text.Type == slack.MarkdownType {
+					lines = append(lines, text.Text)
+				}
+			}
+		}
+	}
+
+	return &slack.SectionBlock{
+		Type: slack.MBTSection,
+		Text: &slack.TextBlockObject{
+			Type: slack.MarkdownType,
+			Text: truncate(strings.Join(lines, "\n"), maxSectionChars),
+		},
+	}
+}
+
+// blockSize returns the size of the serialized block
+func blockSize(block slack.Block) int {
+	rendered, err := json.Marshal(block)
+	if err != nil {
+		return 0
+	}
+	return len(rendered)
+}
+
+// fitBlocks returns the body blocks which fit in a message along with the fixed blocks.
+// When some are dropped, a note replaces them, so the message isn't silently cut short.
+func fitBlocks(bodyBlocks, fixed []slack.Block) []slack.Block {
+	// the size of the serialized list: the blocks in brackets, separated by commas, those
+	// of the body blocks being counted along with them
+	count, size := len(fixed), 1+len(fixed)
+	for _, block := range fixed {
+		size += blockSize(block)
+	}
+
+	sizes := make([]int, len(bodyBlocks))
+	total := size
+	for i, block := range bodyBlocks {
+		sizes[i] = blockSize(block) + 1
+		total += sizes[i]
+	}
+	if count+len(bodyBlocks) <= maxMessageBlocks && total <= maxMessageSize {
+		return bodyBlocks
+	}
+
+	// keep room for the note
+	note := truncatedNoteBlock()
+	count, size = count+1, size+blockSize(note)+1
+
+	kept := 0
+	for kept < len(bodyBlocks) && count+kept+1 <= maxMessageBlocks && size+sizes[kept] <= maxMessageSize {
+		size += sizes[kept]
+		kept++
+	}
+
+	fitted := append([]slack.Block{}, bodyBlocks[:kept]...)
+	// shorten the text of the first block which doesn't fit, rather than dropping it all,
+	// as a plain text body is a single block
+	if kept < len(bodyBlocks) && count+kept+1 <= maxMessageBlocks {
+		if block := shrinkSection(bodyBlocks[kept], maxMessageSize-size-1); block != nil {
+			fitted = append(fitted, block)
+		}
+	}
+
+	logger.Warnf("Slack: Message is too long, showing %d of its %d body blocks", len(fitted), len(bodyBlocks))
+	return append(fitted, note)
+}
+
+// shrinkSection returns a copy of a section block with its text truncated to fit in the
+// given size once serialized, or nil when it's not a section or nothing of it fits.
+func shrinkSection(block slack.Block, room int) slack.Block {
+	section, ok := block.(*slack.SectionBlock)
+	if !ok || section.Text == nil || section.Fields != nil || section.Accessory != nil {
+		return nil
+	}
+
+	shrunk, text := *section, *section.Text
+	shrunk.Text = &text
+	original := section.Text.Text
+	// escaped and multi-byte characters take more room than one byte, so shorten the text
+	// in proportion to its serialized size until it fits
+	for max, size := len([]rune(original)), blockSize(section); max > 1; {
+		max -= max*(size-room)/size + 1
+		text.Text = truncate(original, max)
+		if size = blockSize(&shrunk); size <= room {
+			return &shrunk
+		}
+	}
+	return nil
+}
+
+// truncatedNoteBlock returns the note shown below a body too long to fit in a message
+func truncatedNoteBlock() slack.Block {
+	return slack.NewContextBlock("", slack.NewTextBlockObject(slack.MarkdownType, "_The email is too long to be shown in full._", false, false))
+}
+
+// messageOptions returns the options used to post a message with the given blocks,
+// including the custom username and icon, if configured.
+func (s *Service) messageOptions(blocks []slack.Block) []slack.MsgOption {
+	options := []slack.MsgOption{slack.MsgOptionBlocks(blocks...)}
+
+	if s.cfg.Username != "" {
+		options = append(options, slack.MsgOptionUsername(s.cfg.Username))
+	}
+	if s.cfg.IconEmoji != "" {
+		options = append(options, slack.MsgOptionIconEmoji(s.cfg.IconEmoji))
+	}
+	if s.cfg.IconURL != "" {
+		options = append(options, slack.MsgOptionIconURL(s.cfg.IconURL))
+	}
+
+	return options
+}
+
+// SendMessage sends a single Slack message for the recipients of the notification.
+// The failed Slack calls aren't retried anymore once the context is done.
+func (s *Service) SendMessage(ctx context.Context, n Notification) error {
+	if len(n.Recipients) == 0 {
+		return errors.New("slack: notification has no recipient")
+	}
+	recipients := n.Recipients
+	userEmail := strings.Join(recipients, ", ")
+
+	// only list the recipients themselves for emails without listed recipients (e.g. Bcc only)
+	if len(n.To) == 0 {
+		n.To = recipients
+	}
 
-	// retrieve user by email
-	user, err := s.client.GetUserByEmail(userEmail)
+	// resolve the destination: either a channel configured in a matching route, or a DM with
+	// the user, unless already resolved while grouping the recipients
+	dest, err := n.dest, error(nil)
+	if dest == nil {
+		dest, err = s.resolveDestination(recipients[0])
+	}
+	route := s.resolveRoute(recipients[0])
+	if route == nil || len(route.AlsoChannels) == 0 {
+		switch {
+		case err != nil:
+			return err
+		case dest == nil:
+			return ErrDropped
+		}
+		return s.sendToDestination(ctx, dest, n)
+	}
+
+	// fan out to the additional channels of the route, whatever the outcome of the others
+	var errs []error
+	delivered := 0
+	var cooldownErr *ErrCooldown
 	if err != nil {
-		logger.Warnf("Slack: Error finding user by email '%s': %v", userEmail, err)
-		return &ErrUserNotFound{User: userEmail, Err: err}
+		errs = append(errs, err)
+	} else if dest != nil {
+		// a DM dropped by the cooldown isn't a failure of the other destinations
+		if err := s.sendToDestination(ctx, dest, n); err != nil && !errors.As(err, &cooldownErr) {
+			errs = append(errs, err)
+		} else if err == nil {
+			delivered++
+		}
+	}
+	for _, channel := range route.AlsoChannels {
+		logger.Debugf("Slack: Also routing email for '%s' to channel '%s'", userEmail, channel)
+		extra := &destination{channel: channel, template: route.Template}
+		if dest != nil {
+			extra.ephemeralUser = dest.ephemeralUser
+		}
+		if err := s.sendToDestination(ctx, extra, n); err != nil {
+			errs = append(errs, err)
+		} else {
+			delivered++
+		}
+	}
+
+	switch {
+	case len(errs) == 0:
+		return nil
+	case delivered > 0:
+		return &ErrPartialDelivery{Delivered: delivered, Errs: errs}
+	default:
+		return errors.Join(errs...)
+	}
+}
+
+// sendToDestination posts the message for the recipients of the notification to a resolved destination.
+func (s *Service) sendToDestination(ctx context.Context, dest *destination, n Notification) error {
+	sender, to, subject, body := n.Sender, n.To, n.Subject, n.Body
+	userEmail := strings.Join(n.Recipients, ", ")
+	user, target, templateName := dest.user, dest.channel, dest.template
+	// the template of a route is specific to the recipient, it prevails over the one of the sender
+	if templateName == "" {
+		templateName = s.senderTemplate(sender)
+	}
+	if user != nil {
+		target = user.ID
 	}
-	logger.Debugf("Slack: Found matching user for email '%s': '%s'", userEmail, user.Name)
 
 	// generate the message
+	// compact messages are a single section, so HTML bodies are shown as plain text, as
+	// are the plain text only emails, whatever the preference
+	opts := formatter.Options{
+		PreferHTML:           n.PreferHTML && !s.cfg.Compact && strings.TrimSpace(body.HTML) != "",
+		EscapeMentions:       s.cfg.EscapeMentions,
+		QuoteBody:            s.cfg.QuoteBody,
+		TrimSignature:        s.cfg.TrimSignatures,
+		SignatureMarkers:     s.cfg.SignatureMarkers,
+		HeadingStyle:         s.cfg.HeadingStyle,
+		HeadingPrefixes:      s.cfg.HeadingPrefixes,
+		EscapeMode:           s.cfg.MarkdownEscape,
+		NormalizeLineEndings: s.cfg.NormalizeLineEndings,
+		StripNonContent:      s.cfg.StripNonContentHTML,
+	}
+
+	// describe the event of calendar invites
+	var calendarBlocks []slack.Block
+	var err error
+	if body.Calendar != "" {
+		calendarBlocks, err = formatter.CalendarToBlocks(body.Calendar, opts)
+		if err != nil {
+			logger.Warnf("Slack: Failed to parse the calendar invite, ignoring it: %v", err)
+		}
+	}
+
+	// summarize the delivery status of bounces
+	var statusBlocks []slack.Block
+	if body.DeliveryStatus != "" {
+		statusBlocks, err = formatter.DeliveryStatusToBlocks(body.DeliveryStatus)
+		if err != nil {
+			logger.Warnf("Slack: Failed to parse the delivery status, ignoring it: %v", err)
+		}
+	}
+
+	// high priority emails are never held back, and ephemeral messages can't be scheduled
+	var postAt time.Time
+	scheduled := false
+	if s.scheduler != nil && !body.HighPriority && dest.ephemeralUser == nil {
+		postAt, scheduled = s.scheduler.postAt()
+	}
+
 	var bodyBlocks []slack.Block
-	if preferHTMLBody {
-		if strings.TrimSpace(body.HTML) == "" {
-			return &ErrSendMessage{User: user.ID, Err: fmt.Errorf("empty HTML body")}
+	var snippet string
+	emptyBody := strings.TrimSpace(body.HTML) == "" && strings.TrimSpace(body.Text) == ""
+	// the attachments don't count, they're uploaded apart from the message
+	bodySize := len(body.Text) + len(body.HTML)
+	oversized := s.cfg.Oversized.Threshold > 0 && bodySize > s.cfg.Oversized.Threshold
+	switch {
+	case oversized:
+		// too large to be read in Slack, only tell the email was received
+		logger.Warnf("Slack: Email body of %d bytes is larger than %d bytes, posting the header only", bodySize, s.cfg.Oversized.Threshold)
+		calendarBlocks = nil
+		bodyBlocks = []slack.Block{oversizedNoteBlock(bodySize)}
+	case len(statusBlocks) > 0:
+		// the summary is more concise than the verbose explanations of the bounces
+		logger.Debugf("Slack: Email is a delivery status notification, posting its summary only")
+		bodyBlocks = statusBlocks
+	case emptyBody && len(calendarBlocks) > 0:
+		logger.Debugf("Slack: Invite has no body, posting the event only")
+	case emptyBody && s.cfg.AllowEmptyBody:
+		logger.Debugf("Slack: Email has no body, posting the header only")
+		bodyBlocks = emptyBodyBlocks()
+	default:
+		// only show a preview of long plain text bodies, the full text is uploaded as a snippet
+		text := body.Text
+		if s.cfg.NormalizeLineEndings {
+			// counting the lines of the preview needs \n line endings
+			text = formatter.NormalizeLineEndings(text)
 		}
-		logger.Debugf("Slack: Converting HTML message to Slack format")
-		bodyBlocks = htmlToSlack(body.HTML)
-	} else {
-		if strings.TrimSpace(body.Text) == "" {
-			return &ErrSendMessage{User: user.ID, Err: fmt.Errorf("empty plain text body")}
+		// ephemeral and scheduled messages have no thread to upload the full text to
+		if !opts.PreferHTML && s.cfg.PreviewLines > 0 && dest.ephemeralUser == nil && !scheduled {
+			if preview, truncated := previewLines(text, s.cfg.PreviewLines); truncated {
+				text, snippet = preview, text
+			}
+		}
+
+		bodyBlocks, err = formatter.ConvertToBlocks(body.HTML, text, opts)
+		if err != nil && len(calendarBlocks) == 0 {
+			return &ErrSendMessage{User: target, Err: err}
+		}
+		if snippet != "" {
+			bodyBlocks = append(bodyBlocks, previewNoteBlock(s.cfg.PreviewLines))
 		}
-		logger.Debugf("Slack: Using plain text message")
-		bodyBlocks = textToSlack(body.Text)
 	}
+	bodyBlocks = append(calendarBlocks, bodyBlocks...)
 
-	dividerBlock := &slack.DividerBlock{
-		Type: slack.MBTDivider,
+	// link back to the source of the email, below the body
+	if s.cfg.LinkHeader != "" {
+		if block := linkButtonBlock(body.Header, s.cfg.LinkHeader, s.cfg.LinkText); block != nil {
+			bodyBlocks = append(bodyBlocks, block)
+		}
+	}
+
+	// show the selected headers between the header and the body
+	if len(s.cfg.IncludeHeaders) > 0 {
+		if block := headersBlock(body.Header, s.cfg.IncludeHeaders); block != nil {
+			bodyBlocks = append([]slack.Block{block}, bodyBlocks...)
+		}
+	}
+
+	// show the mailing list of the email above the selected headers
+	if s.cfg.ShowListID && body.ListID != "" {
+		bodyBlocks = append([]slack.Block{listIDBlock(body.ListID)}, bodyBlocks...)
+	}
+
+	// show the avatar of the sender right below the header, already shown in compact messages
+	if s.cfg.ShowSenderAvatar && !s.cfg.Compact {
+		if block := senderAvatarBlock(sender); block != nil {
+			bodyBlocks = append([]slack.Block{block}, bodyBlocks...)
+		}
+	}
+
+	headerSubject := subject
+	if strings.TrimSpace(headerSubject) == "" {
+		headerSubject = s.cfg.DefaultSubject
+	}
+
+	header := headerData{
+		From:        s.senderName(sender),
+		To:          to,
+		Recipient:   userEmail,
+		Subject:     truncate(headerSubject, s.cfg.MaxSubjectChars),
+		Attachments: len(body.Attachments),
+	}
+	if s.cfg.EscapeMentions {
+		header.From = formatter.EscapeMentions(header.From)
+		header.Subject = formatter.EscapeMentions(header.Subject)
+	}
+
+	headerText, err := s.renderHeader(templateName, header)
+	if err != nil {
+		return &ErrSendMessage{User: target, Err: err}
+	}
+
+	// the attachments of oversized emails are left out, along with their body
+	uploadAttachments := s.cfg.UploadAttachments && len(body.Attachments) > 0 && !oversized
+	uploadRaw := oversized && s.cfg.Oversized.UploadRaw
+
+	// tell the attachments were left out, when they aren't uploaded
+	if s.cfg.ShowAttachmentCount && !uploadAttachments && header.Attachments > 0 {
+		headerText += " " + attachmentCountNote(header.Attachments)
+	}
+
+	// flag the severity found in the subject
+	if emoji := s.severityEmoji(subject); emoji != "" {
+		headerText = emoji + " " + headerText
+	}
+	if s.cfg.HighlightHighPriority && body.HighPriority {
+		headerText = highPriorityMarker + "\n" + headerText
 	}
 
 	headerBlock := &slack.SectionBlock{
 		Type: slack.MBTSection,
 		Text: &slack.TextBlockObject{
 			Type: slack.MarkdownType,
-			Text: fmt.Sprintf("*New notification from:* %s\n*Subject:* %s", sender, subject),
+			Text: headerText,
 		},
 	}
 
-	// open a DM with the user
-	channel, _, _, err := s.client.OpenConversation(&slack.OpenConversationParameters{
-		Users: []string{user.ID},
-	})
-	if err != nil {
-		logger.Errorf("Slack: Error opening DM with user '%s': %v", user.ID, err)
-		return &ErrUserDM{User: user.ID, Err: err}
+	// don't flood users with direct messages
+	if s.cooldown != nil && user != nil && !s.cooldown.allow(user.ID) {
+		logger.Warnf("Slack: Dropping the message for '%s', a message was sent to user '%s' less than %s ago", userEmail, user.Name, s.cfg.PerUserCooldown)
+		return &ErrCooldown{User: user.Name, Cooldown: s.cfg.PerUserCooldown}
+	}
+
+	channelID := target
+	if user != nil {
+		// open a DM with the user
+		var channel *slack.Channel
+		err := s.withRetry(ctx, "conversations.open", func() (err error) {
+			channel, _, _, err = s.client.OpenConversation(&slack.OpenConversationParameters{
+				Users: []string{user.ID},
+			})
+			return err
+		})
+		hint := dmUnavailableHint(err)
+		switch {
+		case err == nil:
+			logger.Debugf("Slack: Opened DM channel '%s' with user '%s'", channel.ID, user.Name)
+			channelID = channel.ID
+		case hint != "" && s.cfg.DMUnavailable == DMUnavailableFallback:
+			logger.Warnf("Slack: Can't open DM with user '%s' (%s), posting to fallback channel '%s'", user.ID, hint, s.cfg.FallbackChannel)
+			if s.cooldown != nil {
+				s.cooldown.forget(user.ID)
+			}
+			user, target, channelID = nil, s.cfg.FallbackChannel, s.cfg.FallbackChannel
+		default:
+			logger.Errorf("Slack: Error opening DM with user '%s': %v", user.ID, err)
+			if s.cooldown != nil {
+				s.cooldown.forget(user.ID)
+			}
+			return &ErrUserDM{User: user.ID, Err: err, Hint: hint}
+		}
 	}
-	logger.Debugf("Slack: Opened DM channel '%s' with user '%s'", channel.ID, user.Name)
 
 	// compose the Slack message blocks
-	msgBlocks := []slack.Block{}
-	msgBlocks = append(msgBlocks, dividerBlock)
-	msgBlocks = append(msgBlocks, headerBlock)
-	msgBlocks = append(msgBlocks, bodyBlocks...)
-	msgBlocks = append(msgBlocks, dividerBlock)
+	var msgBlocks []slack.Block
+	if s.cfg.Compact {
+		msgBlocks = []slack.Block{compactBlock(headerText, bodyBlocks)}
+	} else {
+		msgBlocks = s.composeBlocks(headerBlock, bodyBlocks)
+	}
+	options := s.messageOptions(msgBlocks)
 
-	logger.Debugf("Slack: Sending message to user '%s'", user.ID)
-	_, _, err = s.client.PostMessage(channel.ID, slack.MsgOptionBlocks(msgBlocks...))
+	// ephemeral messages are only shown to the user, and can't be scheduled
+	if ephemeral := dest.ephemeralUser; ephemeral != nil {
+		err := s.postEphemeral(ctx, channelID, ephemeral, options, sender, userEmail, uploadAttachments || uploadRaw)
+		var notFound *ErrChannelNotFound
+		if errors.As(err, &notFound) {
+			return s.channelNotFoundFallback(ctx, dest, n, notFound)
+		}
+		return err
+	}
+
+	method := "chat.postMessage"
+	if scheduled {
+		method = "chat.scheduleMessage"
+		options = append(options, slack.MsgOptionSchedule(strconv.FormatInt(postAt.Unix(), 10)))
+	}
+
+	// thread the message under the root message of the day of the channel; DMs aren't
+	// threaded, nor scheduled messages, which may be posted on another day
+	var threadTS string
+	if s.daily != nil && user == nil && !scheduled {
+		if threadTS = s.dailyThreadRoot(ctx, channelID); threadTS != "" {
+			options = append(options, slack.MsgOptionTS(threadTS))
+			// the files of all the emails of the day would be mixed in the daily thread;
+			// the other uploads are rejected along with daily-thread by the config
+			if uploadRaw {
+				logger.Warnf("Slack: Message to '%s' is in the daily thread, skipping the upload of the raw email", target)
+				uploadRaw = false
+			}
+		}
+	}
+
+	logger.Debugf("Slack: Sending message to '%s'", target)
+	// only render the blocks when they're logged
+	if logger.GetLogLevel() <= logger.LevelDebug {
+		if rendered, err := json.Marshal(msgBlocks); err == nil {
+			logger.Debugf("Slack: Message blocks for '%s': %s", target, logger.Redact(string(rendered)))
+		}
+	}
+	var postedChannel, postedTS string
+	err = s.withRetry(ctx, method, func() (err error) {
+		postedChannel, postedTS, err = s.client.PostMessage(channelID, options...)
+		return err
+	})
 	if err != nil {
-		logger.Errorf("Slack: Error sending message to user '%s': %v", user.ID, err)
-		return &ErrSendMessage{User: user.ID, Err: err}
-	} else {
+		logger.Errorf("Slack: Error sending message to '%s': %v", target, err)
+		if s.cooldown != nil && user != nil {
+			s.cooldown.forget(user.ID)
+		}
+		// the channels routed to may have been deleted or archived since configured
+		if dest.user == nil && isChannelNotFound(err) {
+			return s.channelNotFoundFallback(ctx, dest, n, &ErrChannelNotFound{Channel: target, Err: err})
+		}
+		return &ErrSendMessage{User: target, Err: err}
+	}
+
+	if scheduled {
+		// scheduled messages have no thread yet, to upload files to or to track replies in
+		if uploadAttachments || uploadRaw {
+			logger.Warnf("Slack: Message to '%s' is scheduled, skipping the upload of its files", target)
+		}
+		logger.Infof("Slack: Successfully scheduled message from '%s' to '%s' ('%s') for %s", sender, target, userEmail, postAt.Format(time.RFC3339))
+		return nil
+	}
+
+	if s.cfg.PostReaction != "" {
+		s.addReaction(ctx, postedChannel, postedTS)
+	}
+	// files are uploaded to the thread the message is in, if any
+	if threadTS == "" {
+		threadTS = postedTS
+	}
+	if snippet != "" {
+		s.uploadSnippet(ctx, postedChannel, threadTS, snippet)
+	}
+	if uploadAttachments {
+		s.uploadAttachments(ctx, postedChannel, threadTS, body.Attachments)
+	}
+	if uploadRaw {
+		s.uploadRawEmail(ctx, postedChannel, threadTS, body.Raw)
+	}
+
+	// remember the message, so replies in its thread can be traced back to the email
+	if s.threads != nil {
+		s.threads.add(postedChannel, postedTS, forwardedEmail{Sender: sender, Subject: subject})
+	}
+
+	if user != nil {
 		logger.Infof("Slack: Successfully sent message from '%s' to Slack user '%s' ('%s')", sender, user.Name, userEmail)
+	} else {
+		logger.Infof("Slack: Successfully sent message from '%s' to Slack channel '%s' ('%s')", sender, channelID, userEmail)
+	}
+
+	return nil
+}
+
+// dailyThreadRoot returns the timestamp of the root message of the day of the channel,
+// posting it if needed. If it can't be posted, the message is posted outside of a thread,
+// so an empty timestamp is returned.
+func (s *Service) dailyThreadRoot(ctx context.Context, channelID string) string {
+	timestamp, err := s.daily.root(channelID, func(text string) (string, error) {
+		block := slack.NewSectionBlock(slack.NewTextBlockObject(slack.MarkdownType, text, false, false), nil, nil)
+		options := append(s.messageOptions([]slack.Block{block}), slack.MsgOptionText(text, false))
+		var timestamp string
+		err := s.withRetry(ctx, "chat.postMessage", func() (err error) {
+			_, timestamp, err = s.client.PostMessage(channelID, options...)
+			return err
+		})
+		return timestamp, err
+	})
+	if err != nil {
+		logger.Warnf("Slack: Failed to post the daily root message to '%s', posting outside of a thread: %v", channelID, err)
+		return ""
+	}
+	return timestamp
+}
+
+// addReaction adds the configured reaction to the posted message, so delivered messages
+// are easy to spot. Failures are only logged, as the message was already delivered.
+func (s *Service) addReaction(ctx context.Context, channelID, timestamp string) {
+	name := strings.Trim(s.cfg.PostReaction, ":")
+	err := s.withRetry(ctx, "reactions.add", func() error {
+		return s.client.AddReaction(name, slack.NewRefToMessage(channelID, timestamp))
+	})
+	if err != nil {
+		logger.Warnf("Slack: Failed to add reaction '%s' to message '%s' in '%s': %v", name, timestamp, channelID, err)
+	}
+}
+
+// postEphemeral posts a message to a channel, only shown to the given user. Such messages
+// have no thread, so the files of the email can't be uploaded along with it.
+func (s *Service) postEphemeral(ctx context.Context, channelID string, user *slack.User, options []slack.MsgOption, sender, userEmail string, hasFiles bool) error {
+	logger.Debugf("Slack: Sending ephemeral message to '%s' in channel '%s'", user.ID, channelID)
+	err := s.withRetry(ctx, "chat.postEphemeral", func() (err error) {
+		_, err = s.client.PostEphemeral(channelID, user.ID, options...)
+		return err
+	})
+	if err != nil {
+		logger.Errorf("Slack: Error sending ephemeral message to '%s' in channel '%s': %v", user.ID, channelID, err)
+		if isChannelNotFound(err) {
+			return &ErrChannelNotFound{Channel: channelID, Err: err}
+		}
+		return &ErrSendMessage{User: channelID, Err: err}
 	}
 
+	if hasFiles {
+		logger.Warnf("Slack: Message to '%s' in channel '%s' is ephemeral, skipping the upload of its files", user.ID, channelID)
+	}
+	logger.Infof("Slack: Successfully sent ephemeral message from '%s' to Slack user '%s' in channel '%s' ('%s')", sender, user.Name, channelID, userEmail)
 	return nil
 }
+
+// previewLines returns the first n lines of a text, reporting whether it was truncated.
+func previewLines(text string, n int) (string, bool) {
+	lines := strings.Split(strings.TrimSpace(text), "\n")
+	if len(lines) <= n {
+		return text, false
+	}
+	return strings.Join(lines[:n], "\n"), true
+}
+
+// previewNoteBlock returns the note shown below the preview of a long body
+func previewNoteBlock(n int) slack.Block {
+	text := fmt.Sprintf("_Showing the first %d lines, the full text is in the thread._", n)
+	return slack.NewContextBlock("", slack.NewTextBlockObject(slack.MarkdownType, text, false, false))
+}
+
+// uploadSnippet uploads the full text of a body as a snippet in the thread of the posted
+// message. Failures are only logged, as the message was already delivered.
+func (s *Service) uploadSnippet(ctx context.Context, channelID, threadTS, text string) {
+	err := s.withRetry(ctx, "files.uploadV2", func() error {
+		_, err := s.uploadFile(slack.UploadFileV2Parameters{
+			Content:         text,
+			FileSize:        len(text),
+			Filename:        "body.txt",
+			Title:           "Full email body",
+			SnippetType:     "text",
+			Channel:         channelID,
+			ThreadTimestamp: threadTS,
+		})
+		return err
+	})
+	if err != nil {
+		logger.Warnf("Slack: Error uploading the email body to '%s': %v", channelID, err)
+	}
+}
+
+// oversizedNoteBlock returns the context block standing for the body of an email too
+// large to be shown, of size bytes.
+func oversizedNoteBlock(size int) slack.Block {
+	text := fmt.Sprintf("_(email body too large, %d KB)_", (size+1023)/1024)
+	return slack.NewContextBlock("", slack.NewTextBlockObject(slack.MarkdownType, text, false, false))
+}
+
+// uploadRawEmail uploads the email as received, as an .eml file in the thread of the posted
+// message. Failures are only logged, as the message was already delivered.
+func (s *Service) uploadRawEmail(ctx context.Context, channelID, threadTS string, raw []byte) {
+	err := s.withRetry(ctx, "files.uploadV2", func() error {
+		_, err := s.uploadFile(slack.UploadFileV2Parameters{
+			Reader:          bytes.NewReader(raw),
+			FileSize:        len(raw),
+			Filename:        "email.eml",
+			Title:           "Full email",
+			Channel:         channelID,
+			ThreadTimestamp: threadTS,
+		})
+		return err
+	})
+	if err != nil {
+		logger.Warnf("Slack: Error uploading the raw email to '%s': %v", channelID, err)
+	}
+}
+
+// uploadAttachments uploads the email attachments in the thread of the posted message, up to
+// the configured maximum. Failed uploads are only logged, as the message was already delivered.
+func (s *Service) uploadAttachments(ctx context.Context, channelID, threadTS string, attachments []email.Attachment) {
+	if s.cfg.MaxAttachments > 0 && len(attachments) > s.cfg.MaxAttachments {
+		logger.Warnf("Slack: Email has %d attachments, only uploading the first %d", len(attachments), s.cfg.MaxAttachments)
+		attachments = attachments[:s.cfg.MaxAttachments]
+	}
+
+	for _, attachment := range attachments {
+		if len(attachment.Data) == 0 {
+			logger.Debugf("Slack: Skipping empty attachment '%s'", attachment.Filename)
+			continue
+		}
+
+		filename := attachment.Filename
+		if filename == "" {
+			filename = "attachment"
+		}
+
+		params := slack.UploadFileV2Parameters{
+			FileSize:        len(attachment.Data),
+			Filename:        filename,
+			Channel:         channelID,
+			ThreadTimestamp: threadTS,
+		}
+		// images are shown inline in an image block, so they're uploaded without being
+		// shared, text files as snippets, other files are shared as plain files
+		mediaType := attachmentMediaType(attachment)
+		inline := s.isInlineImage(mediaType)
+		switch {
+		case inline:
+			params.AltTxt = filename
+			params.Channel, params.ThreadTimestamp = "", ""
+		case strings.HasPrefix(mediaType, "text/"):
+			params.SnippetType = "text"
+		}
+		if s.cfg.AttachmentMessages {
+			s.postAttachmentMessage(ctx, channelID, threadTS, filename, mediaType)
+		}
+		logger.Debugf("Slack: Uploading attachment '%s' ('%s')", filename, mediaType)
+
+		var file *slack.FileSummary
+		err := s.withRetry(ctx, "files.uploadV2", func() (err error) {
+			params.Reader = bytes.NewReader(attachment.Data)
+			file, err = s.uploadFile(params)
+			return err
+		})
+		if err != nil {
+			logger.Warnf("Slack: Error uploading attachment '%s' to '%s': %v", attachment.Filename, channelID, err)
+			continue
+		}
+		if inline {
+			s.postInlineImage(ctx, channelID, threadTS, file.ID, filename)
+		}
+	}
+}
+
+// postInlineImage posts the uploaded image in an image block, in the thread of the posted
+// message. Failures are only logged, as the message was already delivered.
+func (s *Service) postInlineImage(ctx context.Context, channelID, threadTS, fileID, filename string) {
+	block := slack.NewImageBlockSlackFile(&slack.SlackFileObject{ID: fileID}, filename, "", slack.NewTextBlockObject(slack.PlainTextType, filename, false, false))
+	options := append(s.messageOptions([]slack.Block{block}), slack.MsgOptionText(filename, false), slack.MsgOptionTS(threadTS))
+
+	err := s.withRetry(ctx, "chat.postMessage", func() error {
+		_, _, err := s.client.PostMessage(channelID, options...)
+		return err
+	})
+	if err != nil {
+		logger.Warnf("Slack: Error posting the image of attachment '%s' to '%s': %v", filename, channelID, err)
+	}
+}
+
+// postAttachmentMessage posts a message calling out an attachment, with its name and type,
+// in the thread of the posted message, ahead of its upload. Failures are only logged, as
+// the message was already delivered.
+func (s *Service) postAttachmentMessage(ctx context.Context, channelID, threadTS, filename, mediaType string) {
+	text := ":paperclip: " + filename
+	if mediaType != "" {
+		text += " (" + mediaType + ")"
+	}
+	// plain text, as the names of the attachments aren't trusted
+	block := slack.NewContextBlock("", slack.NewTextBlockObject(slack.PlainTextType, text, true, false))
+	options := append(s.messageOptions([]slack.Block{block}), slack.MsgOptionText(text, false), slack.MsgOptionTS(threadTS))
+
+	err := s.withRetry(ctx, "chat.postMessage", func() error {
+		_, _, err := s.client.PostMessage(channelID, options...)
+		return err
+	})
+	if err != nil {
+		logger.Warnf("Slack: Error posting the message of attachment '%s' to '%s': %v", filename, channelID, err)
+	}
+}
+
+// attachmentMediaType returns the lowercased media type of an attachment, without its
+// parameters, guessed from the file extension when missing.
+func attachmentMediaType(attachment email.Attachment) string {
+	contentType := attachment.ContentType
+	if contentType == "" {
+		contentType = mime.TypeByExtension(filepath.Ext(attachment.Filename))
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return ""
+	}
+	return strings.ToLower(mediaType)
+}
+
+// isInlineImage reports whether attachments of the media type are shown inline, matching
+// the configured types exactly or by their prefix (e.g. image/*).
+func (s *Service) isInlineImage(mediaType string) bool {
+	if mediaType == "" {
+		return false
+	}
+	for _, inlineType := range s.cfg.InlineImageTypes {
+		inlineType = strings.ToLower(strings.TrimSpace(inlineType))
+		if prefix, ok := strings.CutSuffix(inlineType, "/*"); ok {
+			if strings.HasPrefix(mediaType, prefix+"/") {
+				return true
+			}
+			continue
+		}
+		if mediaType == inlineType {
+			return true
+		}
+	}
+	return false
+}
+
+// uploadFile uploads a file, waiting for a free slot when the concurrent uploads are limited.
+func (s *Service) uploadFile(params slack.UploadFileV2Parameters) (*slack.FileSummary, error) {
+	if s.uploads != nil {
+		s.uploads <- struct{}{}
+		defer func() { <-s.uploads }()
+	}
+
+	return s.client.UploadFileV2(params)
+}
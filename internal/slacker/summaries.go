@@ -0,0 +1,67 @@
+package slacker
+
+import (
+	"context"
+	"fmt"
+	"go-smtp-slacker/internal/logger"
+	"go-smtp-slacker/internal/metrics"
+	"time"
+
+	"github.com/slack-go/slack"
+)
+
+// summarizer reports the deliveries since its previous summary.
+type summarizer struct {
+	interval  time.Duration
+	delivered *metrics.Counter
+	failed    *metrics.Counter
+	// the counter values at the previous summary
+	lastDelivered uint64
+	lastFailed    uint64
+}
+
+func newSummarizer(interval time.Duration) *summarizer {
+	return &summarizer{
+		interval:      interval,
+		delivered:     &metrics.Delivered,
+		failed:        &metrics.DeliveryFailed,
+		lastDelivered: metrics.Delivered.Value(),
+		lastFailed:    metrics.DeliveryFailed.Value(),
+	}
+}
+
+// next returns the summary of the deliveries since the previous one.
+func (m *summarizer) next() string {
+	delivered, failed := m.delivered.Value(), m.failed.Value()
+	summary := fmt.Sprintf(":bar_chart: *Delivery summary for the last %s*\n• Forwarded: %d\n• Failed: %d",
+		m.interval, delivered-m.lastDelivered, failed-m.lastFailed)
+	m.lastDelivered, m.lastFailed = delivered, failed
+	return summary
+}
+
+// RunSummaries posts a summary of the deliveries to the summary channel once per
+// configured interval, until the context is cancelled.
+func (s *Service) RunSummaries(ctx context.Context) {
+	s.runSummaries(ctx, newSummarizer(s.cfg.SummaryInterval), time.After)
+}
+
+// runSummaries runs the summaries with the given clock.
+func (s *Service) runSummaries(ctx context.Context, m *summarizer, after func(time.Duration) <-chan time.Time) {
+	logger.Infof("Slack: Posting delivery summaries to channel '%s' every %s", s.cfg.SummaryChannel, m.interval)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-after(m.interval):
+		}
+
+		summary := m.next()
+		err := s.withRetry(ctx, "chat.postMessage", func() error {
+			_, _, err := s.client.PostMessage(s.cfg.SummaryChannel, slack.MsgOptionText(summary, false))
+			return err
+		})
+		if err != nil {
+			logger.Errorf("Slack: Error posting delivery summary to channel '%s': %v", s.cfg.SummaryChannel, err)
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package slacker
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"text/template"
+)
+
+// DefaultTemplate is the name of the template used when no other template is selected.
+// It can be overridden by defining a template with this name.
+const DefaultTemplate = "default"
+
+// defaultHeaderTemplate is the built-in header format.
+const defaultHeaderTemplate = "*New notification from:* {{.From}}\n*Subject:* {{.Subject}}"
+
+// compactHeaderTemplate is the built-in header format of compact messages, on a single line.
+const compactHeaderTemplate = "*{{.Subject}}* from {{.From}}"
+
+// headerData holds the values available to the header templates.
+type headerData struct {
+	From      string
+	To        []string
+	Recipient string
+	Subject   string
+	// Attachments is the number of files attached to the email
+	Attachments int
+}
+
+// parseTemplates parses the configured header templates, adding the built-in default
+// template (defaultText) unless it was overridden.
+func parseTemplates(templates map[string]string, defaultText string) (map[string]*template.Template, error) {
+	parsed := make(map[string]*template.Template)
+
+	for name, text := range templates {
+		// viper keys are case-insensitive, so are the template names
+		name = strings.ToLower(name)
+		tmpl, err := template.New(name).Parse(text)
+		if err != nil {
+			return nil, fmt.Errorf("slack: failed to parse template '%s': %w", name, err)
+		}
+		parsed[name] = tmpl
+	}
+
+	if _, ok := parsed[DefaultTemplate]; !ok {
+		parsed[DefaultTemplate] = template.Must(template.New(DefaultTemplate).Parse(defaultText))
+	}
+
+	return parsed, nil
+}
+
+// attachmentCountNote returns the note of the number of attachments, e.g. "(2 attachments)"
+func attachmentCountNote(n int) string {
+	if n == 1 {
+		return "_(1 attachment)_"
+	}
+	return fmt.Sprintf("_(%d attachments)_", n)
+}
+
+// renderHeader renders the header text using the named template, falling back
+// to the default template if name is empty.
+func (s *Service) renderHeader(name string, data headerData) (string, error) {
+	if name == "" {
+		name = DefaultTemplate
+	}
+
+	tmpl, ok := s.templates[strings.ToLower(name)]
+	if !ok {
+		return "", fmt.Errorf("template '%s' not found", name)
+	}
+
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return "", fmt.Errorf("failed to render template '%s': %w", name, err)
+	}
+	return buf.String(), nil
+}
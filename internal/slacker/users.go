@@ -0,0 +1,88 @@
+package slacker
+
+import (
+	"context"
+	"go-smtp-slacker/internal/cache"
+	"go-smtp-slacker/internal/logger"
+	"strings"
+	"time"
+
+	"github.com/slack-go/slack"
+)
+
+// userCache keeps the users found by email, so they aren't looked up for every email.
+// Missing users aren't cached, as they may be added to the workspace at any time.
+type userCache struct {
+	users *cache.Cache[*slack.User]
+}
+
+// newUserCache creates a cache of users for ttl, up to maxSize users, or without limit if 0.
+func newUserCache(ttl time.Duration, maxSize int) *userCache {
+	return &userCache{users: cache.New[*slack.User]("slack_users", ttl, maxSize)}
+}
+
+// get returns the cached user of an email, if not expired.
+func (c *userCache) get(email string) (*slack.User, bool) {
+	return c.users.Get(strings.ToLower(email))
+}
+
+// put caches the user of an email until the TTL expires.
+func (c *userCache) put(email string, user *slack.User) {
+	c.users.Put(strings.ToLower(email), user)
+}
+
+// lookupUser returns the user of an email, from the cache if enabled.
+func (s *Service) lookupUser(email string) (*slack.User, error) {
+	if s.users != nil {
+		if user, ok := s.users.get(email); ok {
+			logger.Debugf("Slack: Using the cached user '%s' for email '%s'", user.Name, email)
+			return user, nil
+		}
+	}
+
+	var user *slack.User
+	err := s.withRetry(context.Background(), "users.lookupByEmail", func() (err error) {
+		user, err = s.client.GetUserByEmail(email)
+		return err
+	})
+	if err == nil && s.users != nil {
+		s.users.put(email, user)
+	}
+	return user, err
+}
+
+// PrewarmUserCache looks up the users of the addresses, e.g. the usernames of the user
+// database, so the first emails to them don't wait for the lookups. Slack can't look up
+// several emails at once, so they are looked up one at a time, the entries which aren't
+// email addresses being skipped. Failed lookups are only logged.
+func (s *Service) PrewarmUserCache(ctx context.Context, addresses []string) {
+	if s.users == nil {
+		logger.Warnf("Slack: The user cache is disabled, not prewarming it")
+		return
+	}
+
+	found := 0
+	for _, address := range addresses {
+		if ctx.Err() != nil {
+			return
+		}
+		if !strings.Contains(address, "@") {
+			continue
+		}
+		if _, err := s.lookupUser(address); err != nil {
+			logger.Debugf("Slack: Failed to prewarm the user cache for '%s': %v", address, err)
+			continue
+		}
+		found++
+	}
+	logger.Infof("Slack: Prewarmed the user cache with %d users", found)
+}
+
+// RunCacheCleanup removes the expired users from the cache every interval, until the
+// context is done. It returns right away when the cache is disabled.
+func (s *Service) RunCacheCleanup(ctx context.Context, interval time.Duration) {
+	if s.users == nil {
+		return
+	}
+	s.users.users.RunCleanup(ctx, interval)
+}
@@ -1,69 +1,449 @@
 package main
 
 import (
+	"context"
 	"errors"
+	"fmt"
+	"go-smtp-slacker/internal/admin"
 	"go-smtp-slacker/internal/config"
 	"go-smtp-slacker/internal/email"
 	"go-smtp-slacker/internal/logger"
+	"go-smtp-slacker/internal/metrics"
 	"go-smtp-slacker/internal/slacker"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
 
+	"github.com/emersion/go-smtp"
 	"github.com/kr/pretty"
 )
 
+// Exit codes for the different fatal conditions
+const (
+	exitCodeOK     = 0
+	exitCodeConfig = 2
+	exitCodeSlack  = 3
+	exitCodeServer = 4
+)
+
+// queueSampleInterval is how often the depth of the queue of received emails is sampled
+const queueSampleInterval = 5 * time.Second
+
+// cacheCleanupInterval is how often the expired entries are removed from the caches
+const cacheCleanupInterval = time.Minute
+
+// newSlackService creates the Slack service; it's a variable so tests can replace it.
+var newSlackService = slacker.NewService
+
+// newDryRunService creates the Slack service used in dry run, which never calls Slack.
+var newDryRunService = slacker.NewDryRunService
+
 func main() {
+	os.Exit(run())
+}
+
+// run starts the application and returns the exit code.
+func run() int {
 	// Load configuration from YAML
 	cfg, err := config.LoadConfig()
 	if err != nil {
-		logger.Fatalf("Failed to load config: %v", err)
+		logger.Errorf("Failed to load config: %v", err)
+		return exitCodeConfig
 	}
 
 	// Set log level loaded from the config
+	logger.SetTimestampFormat(cfg.LogTimestampFormat, cfg.LogUTC)
 	logger.SetLogLevel(logger.ParseLogLevel(cfg.LogLevel))
+	logger.SetRedaction(cfg.LogRedactContent)
 	logger.Debugf("Loaded configuration: %# v\n", pretty.Formatter(cfg))
 
-	// Initialize Slack service
-	slackService, err := slacker.NewService(cfg.Slack.Token)
+	// Initialize Slack service, without authenticating in dry run
+	createSlackService := newSlackService
+	if cfg.Slack.DryRun {
+		createSlackService = newDryRunService
+	}
+	slackService, err := createSlackService(*cfg.Slack)
 	if err != nil {
-		logger.Fatalf("Failed to initialize Slack service: %v", err)
+		logger.Errorf("Failed to initialize Slack service: %v", err)
+		return exitCodeSlack
 	}
 
 	// Start the SMTP server
-	server, emailChan := email.NewServer(*cfg.SMTP)
+	server, emailChan, err := email.NewServer(*cfg.SMTP, slackService)
+	if err != nil {
+		logger.Errorf("Failed to initialize SMTP server: %v", err)
+		return exitCodeConfig
+	}
 
-	// Forward incoming emails to Slack in a separate goroutine
+	// Look up the users of the user database ahead of their first emails
+	if cfg.Slack.PrewarmCache {
+		if *cfg.SMTP.Auth.Enabled {
+			usernames, err := email.LoadUsernames(cfg.SMTP.Auth)
+			if err != nil {
+				logger.Errorf("Failed to load the usernames to prewarm the Slack user cache: %v", err)
+				return exitCodeConfig
+			}
+			go slackService.PrewarmUserCache(context.Background(), usernames)
+		} else {
+			logger.Warnf("Authentication is disabled, there is no user database to prewarm the Slack user cache with")
+		}
+	}
+
+	// Pause or resume the server on SIGUSR1, e.g. for maintenance
+	pause := email.PauseSwitchOf(server)
+	pause.SetPaused(cfg.SMTP.StartPaused)
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR1)
+	defer signal.Stop(signals)
+	go togglePauseOnSignal(context.Background(), signals, pause)
+
+	// Stop or pause the forwarding if the Slack token is revoked while running
+	authRevoked := make(chan struct{})
+	revokedHandler := &authRevokedHandler{
+		action:   cfg.Slack.AuthRevoked,
+		interval: cfg.Slack.AuthCheckInterval,
+		checker:  slackService,
+		pause:    pause,
+		stop:     func() { close(authRevoked) },
+	}
+
+	// Forward incoming emails to Slack in a separate goroutine, until the queue is
+	// closed by the shutdown and drained
+	forwarded := make(chan struct{})
 	go func() {
+		defer close(forwarded)
 		for e := range emailChan {
-			logger.Debugf("Received email from %s to %v with subject: '%s'", e.From, e.To, e.Subject)
+			logger.Debugf("Received email from %s to %v with subject: '%s'", e.From, e.To, logger.Redact(e.Subject))
+			err := forwardEmail(context.Background(), slackService, *cfg.SMTP.PreferHTMLBody, cfg.Slack.PerRecipientTimeout, e.From, e.To, e.Bcc, e.Subject, e.Body)
+			revokedHandler.handle(context.Background(), err)
+			e.Done(err)
+		}
+	}()
+
+	// Sample the emails waiting to be forwarded, to detect backpressure
+	go metrics.SampleQueue(context.Background(), queueSampleInterval, func() int { return len(emailChan) }, cap(emailChan))
+
+	// Remove the expired entries from the caches, so they don't grow with stale entries
+	go slackService.RunCacheCleanup(context.Background(), cacheCleanupInterval)
+	go email.RunCacheCleanup(context.Background(), server, cacheCleanupInterval)
+
+	// Serve the admin endpoints
+	if cfg.Admin.ListenAddr != "" {
+		adminServer := admin.NewServer(cfg.Admin, pause)
+		go func() {
+			logger.Infof("Starting admin server at %s...", cfg.Admin.ListenAddr)
+			if err := adminServer.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				logger.Errorf("Admin server error: %v", err)
+			}
+		}()
+	}
+
+	// Post periodic delivery summaries
+	if cfg.Slack.SummaryChannel != "" {
+		go slackService.RunSummaries(context.Background())
+	}
 
-			// Skip if no recipients
-			if len(e.To) == 0 {
-				logger.Infof("Email from %s has no recipient; skipping", e.From)
+	// Listen for replies to the forwarded emails
+	if cfg.Slack.BridgeReplies && !cfg.Slack.DryRun {
+		go func() {
+			if err := slackService.ListenForReplies(context.Background()); err != nil {
+				logger.Errorf("Failed to listen for Slack replies: %v", err)
+			}
+		}()
+	}
+
+	// Shut down on SIGTERM or SIGINT, giving the sessions time to finish their emails
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGTERM, os.Interrupt)
+	defer signal.Stop(stop)
+	shutdownDone := make(chan time.Time, 1)
+	go func() {
+		shutdownDone <- shutdownOnSignal(context.Background(), stop, authRevoked, server, cfg.SMTP.ShutdownGrace)
+	}()
+
+	logger.Infof("Starting SMTP server at %s...", cfg.SMTP.ListenAddr)
+	if err := email.ListenAndServe(server, *cfg.SMTP); err != nil && !errors.Is(err, smtp.ErrServerClosed) {
+		logger.Errorf("SMTP server error: %v", err)
+		return exitCodeServer
+	}
+	// the emails accepted before the shutdown are forwarded within the grace period left
+	drainQueue(emailChan, forwarded, <-shutdownDone)
+
+	select {
+	case <-authRevoked:
+		return exitCodeSlack
+	default:
+		return exitCodeOK
+	}
+}
+
+// togglePauseOnSignal pauses the SMTP server, or resumes it if paused, on each signal
+// received, until the context is done.
+func togglePauseOnSignal(ctx context.Context, signals <-chan os.Signal, pause *email.PauseSwitch) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-signals:
+			pause.TogglePaused()
+		}
+	}
+}
+
+// shutdownOnSignal shuts the SMTP server down on the first signal, or once stopped is
+// closed, giving the open sessions up to grace to finish, and returns once done or when
+// the context is done. It returns the end of the grace period, which the forwarding of
+// the emails left in the queue is given until.
+func shutdownOnSignal(ctx context.Context, signals <-chan os.Signal, stopped <-chan struct{}, server *smtp.Server, grace time.Duration) time.Time {
+	select {
+	case <-ctx.Done():
+		return time.Time{}
+	case sig := <-signals:
+		logger.Infof("Received %s, shutting down the SMTP server within %s", sig, grace)
+	case <-stopped:
+		logger.Infof("Shutting down the SMTP server within %s", grace)
+	}
+	deadline := time.Now().Add(grace)
+	if err := email.Shutdown(server, grace); err != nil {
+		logger.Errorf("Failed to shut down the SMTP server: %v", err)
+	}
+	return deadline
+}
+
+// drainQueue waits for the emails left in the queue once the SMTP server shut down to be
+// forwarded, until the deadline. The emails still queued then were already accepted, so
+// they're lost: each is logged and counted as dropped.
+func drainQueue(queue <-chan *email.Email, forwarded <-chan struct{}, deadline time.Time) {
+	if left := len(queue); left > 0 {
+		logger.Infof("Forwarding the %d emails left in the queue before exiting", left)
+	}
+
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+	select {
+	case <-forwarded:
+		return
+	case <-timer.C:
+	}
+
+	for {
+		select {
+		case e, ok := <-queue:
+			if !ok {
+				return
+			}
+			metrics.Dropped.Inc()
+			logger.Errorf("Shutdown grace period elapsed, dropping the queued email from %s to %v with subject: '%s'", e.From, e.To, logger.Redact(e.Subject))
+		default:
+			return
+		}
+	}
+}
+
+// authChecker is the part of the Slack service checking its token.
+type authChecker interface {
+	CheckAuth() error
+}
+
+// authRevokedHandler handles the Slack token being revoked while running, which fails
+// every delivery: it either stops the forwarding, or pauses the SMTP server until the
+// token works again, so the clients keep the emails and retry them later.
+type authRevokedHandler struct {
+	action   string
+	interval time.Duration
+	checker  authChecker
+	// pause pauses the SMTP server
+	pause *email.PauseSwitch
+	// stop stops the forwarding, shutting the SMTP server down
+	stop func()
+	// handling is set from the first revoked token error, until the server is resumed
+	handling atomic.Bool
+}
+
+// handle reacts to the error of a delivery, if it means that the token was revoked.
+func (h *authRevokedHandler) handle(ctx context.Context, err error) {
+	if !slacker.IsAuthRevoked(err) || !h.handling.CompareAndSwap(false, true) {
+		return
+	}
+
+	if h.action == slacker.AuthRevokedPause {
+		logger.Errorf("Slack token is no longer valid, pausing the SMTP server until it works again: %v", err)
+		h.pause.SetPaused(true)
+		go h.resumeOnAuth(ctx)
+		return
+	}
+
+	logger.Errorf("Slack token is no longer valid, stopping: restart with a new token to resume forwarding emails: %v", err)
+	h.stop()
+}
+
+// resumeOnAuth checks the token every interval, resuming the SMTP server once it works
+// again, or until the context is done.
+func (h *authRevokedHandler) resumeOnAuth(ctx context.Context) {
+	ticker := time.NewTicker(h.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := h.checker.CheckAuth(); err != nil {
+				logger.Warnf("Slack token is still not valid, keeping the SMTP server paused: %v", err)
 				continue
 			}
+			logger.Infof("Slack token is valid again, resuming the SMTP server")
+			h.handling.Store(false)
+			h.pause.SetPaused(false)
+			return
+		}
+	}
+}
+
+// slackSender is the part of the Slack service used to forward emails.
+type slackSender interface {
+	ExpandRecipients(recipients []string) []string
+	FilterOptedOut(recipients []string) []string
+	GroupRecipients(recipients []string) []slacker.Notification
+	SendMessage(ctx context.Context, n slacker.Notification) error
+	ReportFailure(err error)
+}
+
+// errAbandoned is returned for the deliveries given up on once their timeout elapsed.
+var errAbandoned = errors.New("delivery abandoned")
+
+// sendMessage sends the notification to its recipients, giving up once the timeout
+// elapses or the context is done. A timeout of 0 waits for the delivery indefinitely.
+// The Slack calls of an abandoned delivery aren't retried anymore, but the one in
+// flight may still succeed later.
+func sendMessage(ctx context.Context, slackService slackSender, timeout time.Duration, n slacker.Notification) error {
+	if timeout <= 0 {
+		return slackService.SendMessage(ctx, n)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	result := make(chan error, 1)
+	go func() {
+		result <- slackService.SendMessage(ctx, n)
+	}()
 
-			// Send to each recipient
-			for _, recipient := range e.To {
-				err := slackService.SendMessage(recipient, e.From, e.To, e.Subject, e.Body, *cfg.SMTP.PreferHTMLBody)
+	select {
+	case err := <-result:
+		return err
+	case <-ctx.Done():
+		return fmt.Errorf("%w: to '%s' after %s: %w", errAbandoned, strings.Join(n.Recipients, ", "), timeout, ctx.Err())
+	}
+}
+
+// forwardEmail sends an email to each of its recipients on Slack, returning the
+// error to report back to the SMTP client, if any delivery failed. Each delivery
+// is given up to timeout, so a slow recipient doesn't hold back the others.
+// The bcc recipients are delivered to as well, without being listed in the headers.
+func forwardEmail(ctx context.Context, slackService slackSender, preferHTMLBody bool, timeout time.Duration, from string, to, bcc []string, subject string, body email.EmailBody) error {
+	all := make([]string, 0, len(to)+len(bcc))
+	all = slackService.ExpandRecipients(append(append(all, to...), bcc...))
+
+	// Skip if no recipients
+	if len(all) == 0 {
+		logger.Infof("Email from %s has no recipient; skipping", from)
+		return nil
+	}
+
+	// Skip the recipients who opted out, after expanding the groups they're members of
+	if all = slackService.FilterOptedOut(all); len(all) == 0 {
+		logger.Infof("All recipients of the email from %s opted out; skipping", from)
+		return nil
+	}
+
+	// Send to each recipient, or once to the recipients sharing the same destination
+	var errs []error
+	delivered := 0
+	for _, n := range slackService.GroupRecipients(all) {
+		recipient := strings.Join(n.Recipients, ", ")
+		n.Sender = from
+		n.To = to
+		n.Subject = subject
+		n.Body = body
+		n.PreferHTML = preferHTMLBody
+		err := sendMessage(ctx, slackService, timeout, n)
+
+		// messages dropped by the per-user cooldown or by user-not-found aren't delivered,
+		// but didn't fail either
+		var cooldownErr *slacker.ErrCooldown
+		if errors.As(err, &cooldownErr) || errors.Is(err, slacker.ErrDropped) {
+			metrics.Dropped.Inc()
+			continue
+		}
+
+		// an abandoned delivery may still have reached its destination, so it's reported
+		// without being counted as failed, not to have the client post the email again
+		if errors.Is(err, errAbandoned) {
+			logger.Warnf("Gave up waiting for the message to '%s': %v", recipient, err)
+			slackService.ReportFailure(err)
+			continue
+		}
+
+		// if we failed to send the message (not using plain text), retry forcing the usage of plain text
+		if err != nil {
+			logger.Warnf("Failed to send message to '%s': %v", recipient, err)
 
-				// if we failed to send the message (not using plain text), retry forcing the usage of plain text
+			// retrying a partial delivery would post the message again to the destinations it reached
+			var sendErr *slacker.ErrSendMessage
+			var partialErr *slacker.ErrPartialDelivery
+			if errors.As(err, &sendErr) && !errors.As(err, &partialErr) && preferHTMLBody {
+				logger.Warnf("Retrying with plain text")
+				n.PreferHTML = false
+				err = sendMessage(ctx, slackService, timeout, n)
 				if err != nil {
-					logger.Warnf("Failed to send message to '%s': %v", recipient, err)
-
-					var sendErr *slacker.ErrSendMessage
-					if errors.As(err, &sendErr) && *cfg.SMTP.PreferHTMLBody {
-						logger.Warnf("Retrying with plain text")
-						err := slackService.SendMessage(recipient, e.From, e.To, e.Subject, e.Body, true)
-						if err != nil {
-							logger.Errorf("Failed to send message to '%s': %v", recipient, err)
-						}
-					}
+					logger.Errorf("Failed to send message to '%s': %v", recipient, err)
 				}
 			}
 		}
-	}()
 
-	logger.Infof("Starting SMTP server at %s...", cfg.SMTP.ListenAddr)
-	if err := server.ListenAndServe(); err != nil {
-		logger.Fatalf("SMTP server error: %v", err)
+		var partialErr *slacker.ErrPartialDelivery
+		if err != nil {
+			metrics.DeliveryFailed.Inc()
+			slackService.ReportFailure(err)
+			errs = append(errs, err)
+			if errors.As(err, &partialErr) {
+				delivered++
+			}
+		} else {
+			metrics.Delivered.Inc()
+			delivered++
+		}
+	}
+
+	return deliveryError(errs, delivered)
+}
+
+// deliveryError combines the delivery failures into the error reported back to the SMTP
+// client. Once the message was delivered to any destination, the email is accepted, as a
+// retry would post it again to them: the failures are only reported to the ops alerts.
+func deliveryError(errs []error, delivered int) error {
+	if len(errs) == 0 {
+		return nil
+	}
+	if delivered > 0 {
+		logger.Warnf("Email delivered to %d destinations but failed for %d, accepting it not to post it again on retry: %v", delivered, len(errs), errors.Join(errs...))
+		return nil
+	}
+
+	// retrying won't help if none of the failed recipients exist in Slack
+	for _, err := range errs {
+		var notFoundErr *slacker.ErrUserNotFound
+		if !errors.As(err, &notFoundErr) {
+			return errors.Join(errs...)
+		}
+	}
+	return &smtp.SMTPError{
+		Code:    550,
+		Message: "Recipient not found in Slack",
 	}
 }